@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+)
+
+// version is the version of the exporter, set at build time with
+// -ldflags "-X main.version=...".
+var version = "dev"
+
+// documentFields are the fields of MetricDocument and HistogramDocument, by
+// their default names.
+var documentFields = []string{
+	"@timestamp", "name", "description", "value", "unit", "labels",
+	"metricType", "sampleRate", "counterMode", "delta", "sum", "buckets",
+}
+
+// documentSchemaConfig is the YAML configuration of the documents indexed
+// in Elasticsearch.
+type documentSchemaConfig struct {
+	// Fields renames fields, by their default names. Fields renamed to ""
+	// are omitted.
+	Fields map[string]string `yaml:"fields"`
+	Labels struct {
+		// Flatten moves labels from the labels field to the top level of
+		// documents.
+		Flatten bool `yaml:"flatten"`
+		// Prefix is prepended to the names of labels.
+		Prefix string `yaml:"prefix"`
+	} `yaml:"labels"`
+	// Static are fields added to every document. ${hostname} and
+	// ${version} in their values expand to the host name and the version
+	// of the exporter, and other ${VAR} to environment variables.
+	Static map[string]string `yaml:"static"`
+}
+
+// documentSchema turns MetricDocument and HistogramDocument into the
+// documents indexed according to a documentSchemaConfig. A nil schema
+// indexes them as they are.
+type documentSchema struct {
+	// names maps default field names to the names they are indexed under,
+	// "" for omitted fields.
+	names         map[string]string
+	flattenLabels bool
+	labelPrefix   string
+	static        map[string]interface{}
+}
+
+func loadDocumentSchema(fileName string) (*documentSchema, error) {
+	content, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	var config documentSchemaConfig
+	if err := yaml.UnmarshalStrict(content, &config); err != nil {
+		return nil, err
+	}
+	return newDocumentSchema(config)
+}
+
+func newDocumentSchema(config documentSchemaConfig) (*documentSchema, error) {
+	s := &documentSchema{
+		names:         make(map[string]string, len(documentFields)),
+		flattenLabels: config.Labels.Flatten,
+		labelPrefix:   config.Labels.Prefix,
+		static:        make(map[string]interface{}, len(config.Static)),
+	}
+	for _, field := range documentFields {
+		s.names[field] = field
+	}
+	for field, name := range config.Fields {
+		if _, ok := s.names[field]; !ok {
+			return nil, fmt.Errorf("unknown document field %q", field)
+		}
+		s.names[field] = name
+	}
+
+	taken := map[string]string{}
+	for _, field := range documentFields {
+		name := s.names[field]
+		if name == "" || (field == "labels" && s.flattenLabels) {
+			continue
+		}
+		if other, ok := taken[name]; ok {
+			return nil, fmt.Errorf("document fields %q and %q are both named %q", other, field, name)
+		}
+		taken[name] = field
+	}
+
+	hostname, _ := os.Hostname()
+	for name, value := range config.Static {
+		if field, ok := taken[name]; ok {
+			return nil, fmt.Errorf("static field %q conflicts with document field %q", name, field)
+		}
+		s.static[name] = os.Expand(value, func(variable string) string {
+			switch variable {
+			case "hostname":
+				return hostname
+			case "version":
+				return version
+			}
+			return os.Getenv(variable)
+		})
+	}
+	return s, nil
+}
+
+// document returns what is indexed for document, a MetricDocument or a
+// HistogramDocument. Static fields are set first, then flattened labels and
+// then the fields of the document, so each overrides the former.
+func (s *documentSchema) document(document interface{}) interface{} {
+	if s == nil {
+		return document
+	}
+
+	var metric MetricDocument
+	var histogram *HistogramDocument
+	switch d := document.(type) {
+	case MetricDocument:
+		metric = d
+	case HistogramDocument:
+		metric = d.MetricDocument
+		histogram = &d
+	default:
+		return document
+	}
+
+	fields := make(map[string]interface{}, len(s.static)+len(metric.Labels)+len(documentFields))
+	for name, value := range s.static {
+		fields[name] = value
+	}
+	set := func(field string, value interface{}) {
+		if name := s.names[field]; name != "" {
+			fields[name] = value
+		}
+	}
+
+	labels := metric.Labels
+	if s.labelPrefix != "" {
+		labels = make(map[string]string, len(metric.Labels))
+		for label, value := range metric.Labels {
+			labels[s.labelPrefix+label] = value
+		}
+	}
+	if s.flattenLabels {
+		for label, value := range labels {
+			fields[label] = value
+		}
+	} else {
+		set("labels", labels)
+	}
+
+	set("@timestamp", metric.Timestamp)
+	set("name", metric.Name)
+	set("description", metric.Description)
+	set("value", metric.Value)
+	set("metricType", metric.MetricType)
+	// These match the omitempty fields of MetricDocument.
+	if metric.Unit != "" {
+		set("unit", metric.Unit)
+	}
+	if metric.SampleRate != 0 {
+		set("sampleRate", metric.SampleRate)
+	}
+	if metric.CounterMode != "" {
+		set("counterMode", metric.CounterMode)
+	}
+	if metric.Delta != nil {
+		set("delta", *metric.Delta)
+	}
+	if histogram != nil {
+		set("sum", histogram.Sum)
+		set("buckets", histogram.Buckets)
+	}
+	return fields
+}
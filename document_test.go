@@ -0,0 +1,155 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jvosantos/statsd_exporter/metrics"
+)
+
+func TestDocumentSchema(t *testing.T) {
+	timestamp := time.Unix(1500000000, 0)
+	delta := 2.0
+	counter := MetricDocument{
+		Timestamp:   timestamp,
+		Name:        "requests",
+		Description: "Requests.",
+		Value:       0.5,
+		Labels:      metrics.Labels{"job": "api"},
+		MetricType:  "counter",
+		CounterMode: "rate",
+		Delta:       &delta,
+	}
+	histogram := HistogramDocument{
+		MetricDocument: MetricDocument{
+			Timestamp:  timestamp,
+			Name:       "latency",
+			Value:      3,
+			Unit:       "ms",
+			Labels:     metrics.Labels{"job": "api"},
+			MetricType: "histogram",
+		},
+		Sum:     12,
+		Buckets: []BucketDocument{{UpperBound: 10, Count: 3}},
+	}
+	os.Setenv("STATSD_EXPORTER_TEST_ENV", "test")
+	defer os.Unsetenv("STATSD_EXPORTER_TEST_ENV")
+
+	scenarios := []struct {
+		name     string
+		config   string
+		document interface{}
+		expected map[string]interface{}
+	}{
+		{
+			name:     "default fields",
+			config:   "{}",
+			document: counter,
+			expected: map[string]interface{}{
+				"@timestamp": timestamp, "name": "requests", "description": "Requests.", "value": 0.5,
+				"labels": metrics.Labels{"job": "api"}, "metricType": "counter", "counterMode": "rate", "delta": 2.0,
+			},
+		},
+		{
+			name:     "renamed and omitted fields",
+			config:   "fields:\n  '@timestamp': timestamp\n  description: ''\n  value: metric_value\n",
+			document: counter,
+			expected: map[string]interface{}{
+				"timestamp": timestamp, "name": "requests", "metric_value": 0.5,
+				"labels": metrics.Labels{"job": "api"}, "metricType": "counter", "counterMode": "rate", "delta": 2.0,
+			},
+		},
+		{
+			name:     "flattened and prefixed labels",
+			config:   "fields:\n  counterMode: ''\n  delta: ''\n  description: ''\nlabels:\n  flatten: true\n  prefix: label_\n",
+			document: counter,
+			expected: map[string]interface{}{
+				"@timestamp": timestamp, "name": "requests", "value": 0.5, "label_job": "api", "metricType": "counter",
+			},
+		},
+		{
+			name:     "static fields",
+			config:   "fields:\n  description: ''\nstatic:\n  env: '${STATSD_EXPORTER_TEST_ENV}'\n  exporter: 'v${version}'\n",
+			document: histogram,
+			expected: map[string]interface{}{
+				"@timestamp": timestamp, "name": "latency", "value": 3.0, "unit": "ms",
+				"labels": metrics.Labels{"job": "api"}, "metricType": "histogram", "sum": 12.0,
+				"buckets": []BucketDocument{{UpperBound: 10, Count: 3}}, "env": "test", "exporter": "vdev",
+			},
+		},
+		{
+			name:     "flattened labels override static fields",
+			config:   "fields:\n  description: ''\n  counterMode: ''\n  delta: ''\nlabels:\n  flatten: true\nstatic:\n  job: static\n  team: a\n",
+			document: counter,
+			expected: map[string]interface{}{
+				"@timestamp": timestamp, "name": "requests", "value": 0.5, "job": "api", "team": "a", "metricType": "counter",
+			},
+		},
+	}
+
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			path := writeDocumentConfig(t, s.config)
+			defer os.RemoveAll(filepath.Dir(path))
+			schema, err := loadDocumentSchema(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			document := schema.document(s.document)
+			if !reflect.DeepEqual(document, s.expected) {
+				t.Errorf("expected document %v, got %v", s.expected, document)
+			}
+		})
+	}
+}
+
+func TestDocumentSchemaNil(t *testing.T) {
+	var schema *documentSchema
+	document := MetricDocument{Name: "requests"}
+	if indexed := schema.document(document); !reflect.DeepEqual(indexed, document) {
+		t.Errorf("expected the document as it is, got %v", indexed)
+	}
+}
+
+func TestLoadDocumentSchemaErrors(t *testing.T) {
+	scenarios := []struct {
+		name   string
+		config string
+		err    string
+	}{
+		{name: "unknown field", config: "fields:\n  host: hostname\n", err: `unknown document field "host"`},
+		{name: "duplicate name", config: "fields:\n  name: value\n", err: "are both named"},
+		{name: "static field conflict", config: "static:\n  value: '1'\n", err: `conflicts with document field "value"`},
+		{name: "unknown key", config: "field:\n  name: metric\n", err: "field field not found"},
+	}
+
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			path := writeDocumentConfig(t, s.config)
+			defer os.RemoveAll(filepath.Dir(path))
+			_, err := loadDocumentSchema(path)
+			if err == nil || !strings.Contains(err.Error(), s.err) {
+				t.Fatalf("expected error containing %q, got %v", s.err, err)
+			}
+		})
+	}
+}
+
+// writeDocumentConfig writes config to a file in a new temporary directory
+// and returns its path.
+func writeDocumentConfig(t *testing.T, config string) string {
+	dir, err := ioutil.TempDir("", "document")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "documents.yaml")
+	if err := ioutil.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
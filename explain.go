@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/jvosantos/statsd_exporter/mappings"
+	"github.com/jvosantos/statsd_exporter/metrics"
+	"github.com/jvosantos/statsd_exporter/statsd"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// maxExplainLineLength bounds the request bodies of the explain endpoint.
+const maxExplainLineLength = 65536
+
+// explainedEvent describes how one event of a StatsD line is processed.
+type explainedEvent struct {
+	Parsed  parsedEvent          `json:"parsed"`
+	Mapping mappings.Explanation `json:"mapping"`
+	// DroppedBy is "template", "action", "relabel_configs",
+	// "negative_counter" or "max_series" if the event is dropped.
+	DroppedBy string `json:"droppedBy,omitempty"`
+	// SeriesLimited is the overflow_policy applied if the event's series
+	// would be over the max_series of its mapping.
+	SeriesLimited string `json:"seriesLimited,omitempty"`
+	// Document is the document indexed for the event, according to the
+	// document schema. Histogram timers and counters not in raw mode are
+	// aggregated and only indexed on flush, so they have none.
+	Document interface{} `json:"document,omitempty"`
+	Buckets  []float64   `json:"buckets,omitempty"`
+}
+
+// parsedEvent is an event as the statsd parser returned it.
+type parsedEvent struct {
+	Name       string             `json:"name"`
+	Type       metrics.MetricType `json:"type"`
+	Value      float64            `json:"value"`
+	Relative   bool               `json:"relative,omitempty"`
+	SampleRate float64            `json:"sampleRate"`
+	Labels     metrics.Labels     `json:"labels"`
+}
+
+// explainHandler serves explanations of how the StatsD line passed in the
+// line query parameter, or else the request body, is parsed and mapped with
+// the current configuration. It does not record the events, nor count mapping
+// hits, fill the mapping cache or add series to the max_series limits.
+func explainHandler(exporter *Exporter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		line := r.URL.Query().Get("line")
+		if line == "" && r.Body != nil {
+			body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxExplainLineLength))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			line = strings.TrimSpace(string(body))
+		}
+		if line == "" {
+			http.Error(w, "missing StatsD line in the line parameter or the request body", http.StatusBadRequest)
+			return
+		}
+
+		events, rejected := statsd.ParseLine([]byte(line))
+		defer metrics.ReleaseEvents(events)
+		explained := make([]explainedEvent, 0, len(events))
+		for _, event := range events {
+			explained = append(explained, exporter.explainEvent(event))
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(struct {
+			Line   string           `json:"line"`
+			Events []explainedEvent `json:"events"`
+			// Rejected are the reasons samples or tags of the line were
+			// rejected for, as counted in the telemetry.
+			Rejected []string `json:"rejected,omitempty"`
+		}{line, explained, rejected})
+	}
+}
+
+func (b *Exporter) explainEvent(event metrics.Event) explainedEvent {
+	explained := explainedEvent{
+		Parsed: parsedEvent{
+			Name:       event.MetricName(),
+			Type:       event.MetricType(),
+			Value:      event.Value(),
+			SampleRate: event.SampleRate(),
+			Labels:     event.Labels(),
+		},
+		Mapping: b.mapper.Explain(event.MetricName(), event.MetricType(), event.Labels()),
+	}
+	if gauge, ok := event.(*metrics.GaugeEvent); ok {
+		explained.Parsed.Relative = gauge.Relative()
+	}
+
+	mapped := b.mapEventWith(b.mapper.LookupMapping, event)
+	if mapped == nil {
+		explained.DroppedBy = "relabel_configs"
+		if explained.Mapping.Error != "" {
+			explained.DroppedBy = "template"
+		} else if explained.Mapping.Action == string(mappings.ActionTypeDrop) {
+			explained.DroppedBy = "action"
+		}
+		return explained
+	}
+
+	if mapped.metricType == "counter" && mapped.value < 0 {
+		explained.DroppedBy = "negative_counter"
+		return explained
+	}
+
+	if mapping := mapped.mapping; mapping.MaxSeries > 0 && !b.series.allows(mapped.name, mapped.labels, mapping.MaxSeries) {
+		explained.SeriesLimited = string(mapping.OverflowPolicy)
+		if !overflowSeries(mapped) {
+			explained.DroppedBy = "max_series"
+			return explained
+		}
+	}
+
+	explained.Buckets = mapped.buckets
+	aggregated := mapped.metricType == "histogram" ||
+		(mapped.metricType == "counter" && mapped.counterMode != "" && mapped.counterMode != string(mappings.CounterModeRaw))
+	if !aggregated {
+		document := MetricDocument{
+			Timestamp:   time.Now(),
+			Name:        mapped.name,
+			Description: mapped.help,
+			Value:       mapped.value,
+			Unit:        mapped.unit,
+			Labels:      mapped.labels,
+			MetricType:  mapped.metricType,
+		}
+		if mapped.metricType != "gauge" {
+			document.SampleRate = event.SampleRate()
+		}
+		if mapped.metricType == "counter" {
+			document.CounterMode = string(mappings.CounterModeRaw)
+		}
+		explained.Document = b.schema.document(document)
+	}
+	return explained
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/jvosantos/statsd_exporter/mappings"
+	"github.com/jvosantos/statsd_exporter/metrics"
+)
+
+const testExplainMappings = `
+defaults:
+  timer_type: histogram
+  buckets: [1, 10]
+mappings:
+- match: svc.*.*
+  name: svc_${2}
+  labels:
+    svc: "$1"
+- match: raw.*
+  name: raw
+  timer_type: raw
+- match: drop.*
+  name: dropped
+  action: drop
+- match: env.*
+  name: '{{ .Labels.env }}'
+- match: relabeled.*
+  name: relabeled
+  labels:
+    component: "$1"
+  relabel_configs:
+  - source_labels: [component]
+    regex: internal
+    action: drop
+- match: limited.*
+  name: limited
+  labels:
+    id: "$1"
+  max_series: 1
+- match: overflowed.*
+  name: overflowed
+  labels:
+    id: "$1"
+  max_series: 1
+  overflow_policy: overflow
+- match: delta.*
+  name: delta
+  counter_mode: delta
+`
+
+func TestExplainHandler(t *testing.T) {
+	scenarios := []struct {
+		name string
+		// line is sent in the request body, or in the query if get is set.
+		line string
+		get  bool
+		code int
+		// events are the names of the documents of the events of the line,
+		// "-" followed by the reason for dropped events, "histogram" for
+		// histogram timers or "aggregated" for other events without one.
+		events   []string
+		rejected bool
+		// overflow is set if the events are collapsed into the overflow
+		// series.
+		overflow bool
+	}{
+		{name: "counter", line: "svc.api.requests:1|c", events: []string{"svc_requests"}},
+		{name: "query", line: "svc.api.requests:1|c|@0.5", get: true, events: []string{"svc_requests"}},
+		{name: "several samples", line: "svc.api.requests:1|c:2|ms", events: []string{"svc_requests", "histogram"}},
+		{name: "raw timer", line: "raw.latency:2|ms", events: []string{"raw"}},
+		{name: "aggregated counter", line: "delta.requests:1|c", events: []string{"aggregated"}},
+		{name: "unmapped", line: "other.requests:1|g", events: []string{"other_requests"}},
+		{name: "action", line: "drop.requests:1|c", events: []string{"-action"}},
+		{name: "relabel_configs", line: "relabeled.internal:1|c", events: []string{"-relabel_configs"}},
+		{name: "template", line: "env.requests:1|c", events: []string{"-template"}},
+		{name: "negative counter", line: "svc.api.requests:-1|c", events: []string{"-negative_counter"}},
+		{name: "known series", line: "limited.aa:1|c", events: []string{"limited"}},
+		{name: "max_series", line: "limited.bb:1|c", events: []string{"-max_series"}},
+		{name: "overflow", line: "overflowed.bb:1|c", events: []string{"overflowed"}, overflow: true},
+		{name: "rejected", line: "svc.api.requests:x|c", events: []string{}, rejected: true},
+		{name: "missing line", code: http.StatusBadRequest},
+	}
+
+	mapper := &mappings.MetricMapper{}
+	if err := mapper.InitFromYAMLString(testExplainMappings); err != nil {
+		t.Fatal(err)
+	}
+	e := NewExporter(mapper, nil, "statsd", nil, 0, 1)
+	e.series.admit("limited", metrics.Labels{"id": "aa"}, 1, 0)
+	e.series.admit("overflowed", metrics.Labels{"id": "aa"}, 1, 0)
+
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/explain", strings.NewReader(s.line+"\n"))
+			if s.get {
+				req = httptest.NewRequest("GET", "/explain?line="+url.QueryEscape(s.line), nil)
+			}
+			w := httptest.NewRecorder()
+			explainHandler(e)(w, req)
+			if s.code == 0 {
+				s.code = http.StatusOK
+			}
+			if w.Code != s.code {
+				t.Fatalf("expected status %d, got %d: %s", s.code, w.Code, w.Body.String())
+			}
+			if s.code != http.StatusOK {
+				return
+			}
+
+			var response struct {
+				Line     string           `json:"line"`
+				Events   []explainedEvent `json:"events"`
+				Rejected []string         `json:"rejected"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+				t.Fatal(err)
+			}
+			if response.Line != s.line {
+				t.Errorf("expected line %q, got %q", s.line, response.Line)
+			}
+			events := []string{}
+			for _, event := range response.Events {
+				if overflow := event.SeriesLimited == string(mappings.OverflowSeries); overflow != s.overflow {
+					t.Errorf("expected overflow %v, got %q", s.overflow, event.SeriesLimited)
+				}
+				document, _ := event.Document.(map[string]interface{})
+				labels, _ := document["labels"].(map[string]interface{})
+				if s.overflow && document != nil && labels["id"] != mappings.OverflowValue {
+					t.Errorf("expected overflow labels, got %v", labels)
+				}
+				switch {
+				case event.DroppedBy != "":
+					events = append(events, "-"+event.DroppedBy)
+				case document != nil:
+					events = append(events, document["name"].(string))
+				case len(event.Buckets) != 0:
+					events = append(events, "histogram")
+				default:
+					events = append(events, "aggregated")
+				}
+			}
+			if !reflect.DeepEqual(events, s.events) {
+				t.Errorf("expected events %v, got %v", s.events, events)
+			}
+			if (len(response.Rejected) != 0) != s.rejected {
+				t.Errorf("expected rejected %v, got %v", s.rejected, response.Rejected)
+			}
+		})
+	}
+}
+
+func TestExplainDocumentSchema(t *testing.T) {
+	mapper := &mappings.MetricMapper{}
+	if err := mapper.InitFromYAMLString(testExplainMappings); err != nil {
+		t.Fatal(err)
+	}
+	schema, err := newDocumentSchema(documentSchemaConfig{Fields: map[string]string{"name": "metric"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := NewExporter(mapper, nil, "statsd", schema, 0, 1)
+
+	event, err := metrics.NewEvent("c", "svc.api.requests", 1, false, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	document, ok := e.explainEvent(event).Document.(map[string]interface{})
+	if !ok || document["metric"] != "svc_requests" || document["name"] != nil {
+		t.Errorf("expected a document named by the schema, got %v", document)
+	}
+}
@@ -1,15 +1,14 @@
 package main
 
 import (
-	"bytes"
-	"encoding/binary"
 	"fmt"
 	"github.com/golang/glog"
 	"github.com/jvosantos/statsd_exporter/metrics"
-	"hash/fnv"
 	"sort"
+	"sync"
 	"github.com/olivere/elastic"
 	"github.com/jvosantos/statsd_exporter/mappings"
+	"github.com/prometheus/client_golang/prometheus"
 	"time"
 )
 
@@ -20,11 +19,13 @@ const (
 		"consider the effects on your monitoring setup. Error: %s"
 )
 
-var (
-	hash   = fnv.New64a()
-	strBuf bytes.Buffer // Used for hashing.
-	intBuf = make([]byte, 8)
-)
+// containerShards is the number of independently locked shards series
+// containers are split into.
+const containerShards = 64
+
+// workerQueueSize is the number of event batches buffered for every mapping
+// and series worker of the exporter.
+const workerQueueSize = 64
 
 func labelsToSignature(labels map[string]string) uint64 {
 	if len(labels) == 0 {
@@ -48,13 +49,9 @@ func labelsToSignature(labels map[string]string) uint64 {
 }
 
 func hashNameAndLabels(name string, labels metrics.Labels) uint64 {
-	hash.Reset()
-	strBuf.Reset()
-	strBuf.WriteString(name)
-	hash.Write(strBuf.Bytes())
-	binary.BigEndian.PutUint64(intBuf, labelsToSignature(labels))
-	hash.Write(intBuf)
-	return hash.Sum64()
+	sum := hashAdd(hashNew(), name)
+	sum = hashAddByte(sum, separatorByte)
+	return hashAddUint64(sum, labelsToSignature(labels))
 }
 
 type MetricDocument struct {
@@ -62,284 +59,852 @@ type MetricDocument struct {
 	Name        string			`json:"name"`
 	Description string			`json:"description"`
 	Value       float64			`json:"value"`
+	Unit        string			`json:"unit,omitempty"`
 	Labels      metrics.Labels	`json:"labels"`
 	MetricType  string			`json:"metricType"`
+	SampleRate  float64			`json:"sampleRate,omitempty"`
+	// CounterMode is the counter_mode of counter documents, telling what
+	// their Value stands for.
+	CounterMode string			`json:"counterMode,omitempty"`
+	// Delta is the increase since the previous flush of counters in rate
+	// mode, whose Value is the per-second rate.
+	Delta       *float64		`json:"delta,omitempty"`
+}
+
+// HistogramDocument is the document flushed for a histogram series. Its Value
+// is the number of observations.
+type HistogramDocument struct {
+	MetricDocument
+	Sum     float64				`json:"sum"`
+	Buckets []BucketDocument	`json:"buckets"`
+}
+
+// BucketDocument holds the number of observations less than or equal to
+// UpperBound.
+type BucketDocument struct {
+	UpperBound float64	`json:"le"`
+	Count      float64	`json:"count"`
 }
 
+// series is the bookkeeping a container keeps for every series: how long
+// it may go without being updated, and when it last was.
+type series struct {
+	ttl     time.Duration
+	updated time.Time
+}
+
+func (s *series) touch(ttl time.Duration, now time.Time) {
+	s.ttl = ttl
+	s.updated = now
+}
+
+// expired reports whether the series was idle for longer than its TTL.
+func (s *series) expired(now time.Time) bool {
+	return s.ttl > 0 && now.Sub(s.updated) > s.ttl
+}
+
+// CounterContainer holds counter series by the hash of their name and labels.
+// It is safe for concurrent use.
 type CounterContainer struct {
-	Elements map[uint64]metrics.Counter
+	shards [containerShards]counterShard
+}
+
+type counterSeries struct {
+	series
+	counter metrics.Counter
+	// mode is the counter_mode of the series, and flushed its value at the
+	// previous flush.
+	mode    string
+	flushed float64
+}
+
+type counterShard struct {
+	sync.Mutex
+	elements map[uint64]*counterSeries
 }
 
 func NewCounterContainer() *CounterContainer {
-	return &CounterContainer{
-		Elements: make(map[uint64]metrics.Counter),
+	c := &CounterContainer{}
+	for i := range c.shards {
+		c.shards[i].elements = make(map[uint64]*counterSeries)
 	}
+	return c
 }
 
-func (c *CounterContainer) Get(metricName string, labels metrics.Labels, help string) (metrics.Counter, error) {
+// Add adds value to the counter of a series, creating it if needed, and
+// marks the series as updated with the given counter_mode. The counter is
+// updated with its shard locked, so that a concurrent Flush can't remove it
+// in between. A ttl of 0 keeps the series until it is flushed in delta or
+// rate mode, or forever in cumulative mode.
+func (c *CounterContainer) Add(metricName string, labels metrics.Labels, help string, ttl time.Duration, mode string, value float64) error {
 	hash := hashNameAndLabels(metricName, labels)
-	counter, ok := c.Elements[hash]
+	shard := &c.shards[hash%containerShards]
+	shard.Lock()
+	defer shard.Unlock()
+
+	s, ok := shard.elements[hash]
 	if !ok {
-		counter = metrics.NewCounter(metricName, help, labels)
+		s = &counterSeries{counter: metrics.NewCounter(metricName, help, labels)}
+
+		shard.elements[hash] = s
+	}
+	s.touch(ttl, time.Now())
+	s.mode = mode
+	s.counter.Add(value)
+	return nil
+}
+
+// counterFlush is the state of a counter series at a flush.
+type counterFlush struct {
+	counter metrics.Counter
+	mode    string
+	// delta is the increase since the previous flush.
+	delta   float64
+	updated time.Time
+}
+
+// Flush calls f on every counter with its increase since the previous
+// Flush, without holding any lock. Counters in delta and rate mode are
+// removed, since they only report increases.
+func (c *CounterContainer) Flush(f func(counterFlush)) {
+	var flushed []counterFlush
+	for i := range c.shards {
+		shard := &c.shards[i]
+		shard.Lock()
+		flushed = flushed[:0]
+		for hash, s := range shard.elements {
+			value := s.counter.Value()
+			flushed = append(flushed, counterFlush{counter: s.counter, mode: s.mode, delta: value - s.flushed, updated: s.updated})
+			s.flushed = value
+			if s.mode != string(mappings.CounterModeCumulative) {
+				delete(shard.elements, hash)
+			}
+		}
+		shard.Unlock()
 
-		c.Elements[hash] = counter
+		for _, counter := range flushed {
+			f(counter)
+		}
 	}
-	return counter, nil
 }
 
+// Expire removes the counters idle for longer than their TTL and returns
+// how many it removed.
+func (c *CounterContainer) Expire(now time.Time) int {
+	expired := 0
+	for i := range c.shards {
+		shard := &c.shards[i]
+		shard.Lock()
+		for hash, s := range shard.elements {
+			if s.expired(now) {
+				delete(shard.elements, hash)
+				expired++
+			}
+		}
+		shard.Unlock()
+	}
+	return expired
+}
+
+// Len returns the number of counters in the container.
+func (c *CounterContainer) Len() int {
+	n := 0
+	for i := range c.shards {
+		shard := &c.shards[i]
+		shard.Lock()
+		n += len(shard.elements)
+		shard.Unlock()
+	}
+	return n
+}
+
+// GaugeContainer holds gauge series by the hash of their name and labels. It
+// is safe for concurrent use.
 type GaugeContainer struct {
-	Elements map[uint64]metrics.Gauge
+	shards [containerShards]gaugeShard
+}
+
+type gaugeSeries struct {
+	series
+	gauge metrics.Gauge
+}
+
+type gaugeShard struct {
+	sync.Mutex
+	elements map[uint64]*gaugeSeries
 }
 
 func NewGaugeContainer() *GaugeContainer {
-	return &GaugeContainer{
-		Elements: make(map[uint64]metrics.Gauge),
+	c := &GaugeContainer{}
+	for i := range c.shards {
+		c.shards[i].elements = make(map[uint64]*gaugeSeries)
 	}
+	return c
 }
 
-func (c *GaugeContainer) Get(metricName string, labels metrics.Labels, help string) (metrics.Gauge, error) {
+// Update sets the gauge of a series to value, or adds value to it if
+// relative, creating it if needed, and marks the series as updated. It
+// returns the new value of the gauge. The gauge is updated with its shard
+// locked, so that a concurrent Expire can't remove it in between. A ttl of 0
+// keeps the series forever.
+func (c *GaugeContainer) Update(metricName string, labels metrics.Labels, help string, ttl time.Duration, value float64, relative bool) (float64, error) {
 	hash := hashNameAndLabels(metricName, labels)
-	gauge, ok := c.Elements[hash]
+	shard := &c.shards[hash%containerShards]
+	shard.Lock()
+	defer shard.Unlock()
+
+	s, ok := shard.elements[hash]
 	if !ok {
-		gauge = metrics.NewGauge(metricName, help, labels)
+		s = &gaugeSeries{gauge: metrics.NewGauge(metricName, help, labels)}
 
-		c.Elements[hash] = gauge
+		shard.elements[hash] = s
+	}
+	s.touch(ttl, time.Now())
+	if relative {
+		s.gauge.Add(value)
+	} else {
+		s.gauge.Set(value)
 	}
-	return gauge, nil
+	return s.gauge.Value(), nil
 }
 
+// Each calls f on every gauge in the container, with the time it was last
+// updated at. Shards are copied before f is called, so f may use the
+// container.
+func (c *GaugeContainer) Each(f func(gauge metrics.Gauge, updated time.Time)) {
+	var gauges []gaugeSeries
+	for i := range c.shards {
+		shard := &c.shards[i]
+		shard.Lock()
+		gauges = gauges[:0]
+		for _, s := range shard.elements {
+			gauges = append(gauges, *s)
+		}
+		shard.Unlock()
+
+		for _, s := range gauges {
+			f(s.gauge, s.updated)
+		}
+	}
+}
+
+// Expire removes the gauges idle for longer than their TTL and returns how
+// many it removed.
+func (c *GaugeContainer) Expire(now time.Time) int {
+	expired := 0
+	for i := range c.shards {
+		shard := &c.shards[i]
+		shard.Lock()
+		for hash, s := range shard.elements {
+			if s.expired(now) {
+				delete(shard.elements, hash)
+				expired++
+			}
+		}
+		shard.Unlock()
+	}
+	return expired
+}
+
+// Len returns the number of gauges in the container.
+func (c *GaugeContainer) Len() int {
+	n := 0
+	for i := range c.shards {
+		shard := &c.shards[i]
+		shard.Lock()
+		n += len(shard.elements)
+		shard.Unlock()
+	}
+	return n
+}
+
+// HistogramContainer holds histogram series by the hash of their name and
+// labels. It is safe for concurrent use.
 type HistogramContainer struct {
-	Elements map[uint64]metrics.Histogram
+	shards [containerShards]histogramShard
+}
+
+type histogramSeries struct {
+	series
+	histogram metrics.Histogram
+}
+
+type histogramShard struct {
+	sync.Mutex
+	elements map[uint64]*histogramSeries
 }
 
 func NewHistogramContainer() *HistogramContainer {
-	return &HistogramContainer{
-		Elements: make(map[uint64]metrics.Histogram),
+	c := &HistogramContainer{}
+	for i := range c.shards {
+		c.shards[i].elements = make(map[uint64]*histogramSeries)
 	}
+	return c
 }
 
-func (c *HistogramContainer) Get(metricName string, labels metrics.Labels, help string) (metrics.Histogram, error) {
+// Observe adds an observation of value standing for weight observations to
+// the histogram of a series, creating it if needed, and marks the series as
+// updated. The histogram is updated with its shard locked. A ttl of 0 keeps
+// the series forever.
+func (c *HistogramContainer) Observe(metricName string, labels metrics.Labels, help, unit string, buckets []float64, ttl time.Duration, value, weight float64) error {
 	hash := hashNameAndLabels(metricName, labels)
-	histogram, ok := c.Elements[hash]
+	shard := &c.shards[hash%containerShards]
+	shard.Lock()
+	defer shard.Unlock()
+
+	s, ok := shard.elements[hash]
 	if !ok {
-		histogram = metrics.NewHistogram(metricName, help, labels)
+		s = &histogramSeries{histogram: metrics.NewHistogram(metricName, help, unit, labels, buckets)}
 
-		c.Elements[hash] = histogram
+		shard.elements[hash] = s
 	}
-	return histogram, nil
+	s.touch(ttl, time.Now())
+	s.histogram.ObserveWeighted(value, weight)
+	return nil
+}
+
+// Each calls f on every histogram in the container. Shards are copied before
+// f is called, so f may use the container.
+func (c *HistogramContainer) Each(f func(metrics.Histogram)) {
+	var histograms []metrics.Histogram
+	for i := range c.shards {
+		shard := &c.shards[i]
+		shard.Lock()
+		histograms = histograms[:0]
+		for _, s := range shard.elements {
+			histograms = append(histograms, s.histogram)
+		}
+		shard.Unlock()
+
+		for _, histogram := range histograms {
+			f(histogram)
+		}
+	}
+}
+
+// Expire removes the histograms idle for longer than their TTL and returns
+// how many it removed.
+func (c *HistogramContainer) Expire(now time.Time) int {
+	expired := 0
+	for i := range c.shards {
+		shard := &c.shards[i]
+		shard.Lock()
+		for hash, s := range shard.elements {
+			if s.expired(now) {
+				delete(shard.elements, hash)
+				expired++
+			}
+		}
+		shard.Unlock()
+	}
+	return expired
+}
+
+// Len returns the number of histograms in the container.
+func (c *HistogramContainer) Len() int {
+	n := 0
+	for i := range c.shards {
+		shard := &c.shards[i]
+		shard.Lock()
+		n += len(shard.elements)
+		shard.Unlock()
+	}
+	return n
 }
 
 type Exporter struct {
 	Counters      *CounterContainer
 	Gauges        *GaugeContainer
 	Histograms    *HistogramContainer
+	series        *seriesLimiter
 	mapper        *mappings.MetricMapper
 	elasticBulkProcessor *elastic.BulkProcessor
 	elasticIndex  string
+	schema        *documentSchema
+	flushInterval time.Duration
+	workers       int
+	// lastFlush is when series were last flushed. It is only used by the
+	// goroutine running Listen.
+	lastFlush     time.Time
 }
 
-func NewExporter(mapper *mappings.MetricMapper, processor *elastic.BulkProcessor, index string) *Exporter {
+func NewExporter(mapper *mappings.MetricMapper, processor *elastic.BulkProcessor, index string, schema *documentSchema, flushInterval time.Duration, workers int) *Exporter {
+	if workers < 1 {
+		workers = 1
+	}
 	return &Exporter{
 		Counters:      NewCounterContainer(),
 		Gauges:        NewGaugeContainer(),
 		Histograms:    NewHistogramContainer(),
+		series:        newSeriesLimiter(),
 		mapper:        mapper,
 		elasticBulkProcessor: processor,
 		elasticIndex:  index,
+		schema:        schema,
+		flushInterval: flushInterval,
+		workers:       workers,
+		lastFlush:     time.Now(),
 	}
 }
 
 func (b *Exporter) Listen(hierarchicalEventsChannel <-chan metrics.Events) {
+	// Aggregated series are flushed every flushInterval, and once more when
+	// the channel is closed. A zero interval only flushes on close.
+	var tick <-chan time.Time
+	if b.flushInterval > 0 {
+		ticker := time.NewTicker(b.flushInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	// With several workers, events are routed to mapping workers by the
+	// hash of their StatsD name, and once mapped to series workers by the
+	// hash of the name and labels they are mapped to. Updates to a series
+	// from any one StatsD name are processed in the order received.
+	var mappers []chan metrics.Events
+	var updaters []chan []*mappedEvent
+	var mappersWG, updatersWG sync.WaitGroup
+	if b.workers > 1 {
+		updaters = make([]chan []*mappedEvent, b.workers)
+		for i := range updaters {
+			updaters[i] = make(chan []*mappedEvent, workerQueueSize)
+			updatersWG.Add(1)
+			go func(batches <-chan []*mappedEvent) {
+				defer updatersWG.Done()
+				for batch := range batches {
+					for _, mapped := range batch {
+						b.processMappedEvent(mapped)
+					}
+				}
+			}(updaters[i])
+		}
+		mappers = make([]chan metrics.Events, b.workers)
+		for i := range mappers {
+			mappers[i] = make(chan metrics.Events, workerQueueSize)
+			mappersWG.Add(1)
+			go func(batches <-chan metrics.Events) {
+				defer mappersWG.Done()
+				for batch := range batches {
+					b.dispatch(updaters, batch)
+				}
+			}(mappers[i])
+		}
+	}
+
 	for {
 		select {
+		case <-tick:
+			b.flush()
 		case hierarchicalEvents, ok := <-hierarchicalEventsChannel:
 			if !ok {
 				glog.V(10).Info("Channel is closed. Break out of Exporter.Listener.")
+				for _, mapper := range mappers {
+					close(mapper)
+				}
+				mappersWG.Wait()
+				for _, updater := range updaters {
+					close(updater)
+				}
+				updatersWG.Wait()
+				b.flush()
 				return
 			}
-			b.processHierarchicalEvents(hierarchicalEvents)
+			if mappers == nil {
+				b.processHierarchicalEvents(hierarchicalEvents)
+				metrics.ReleaseEvents(hierarchicalEvents)
+				continue
+			}
+			b.route(mappers, hierarchicalEvents)
 		}
 	}
 }
 
+// route splits hierarchicalEvents between mappers by the hash of their
+// StatsD name.
+func (b *Exporter) route(mappers []chan metrics.Events, hierarchicalEvents metrics.Events) {
+	batches := make([]metrics.Events, len(mappers))
+	for _, event := range hierarchicalEvents {
+		i := hashAdd(hashNew(), event.MetricName()) % uint64(len(mappers))
+		if batches[i] == nil {
+			batches[i] = metrics.NewEvents()
+		}
+		batches[i] = append(batches[i], event)
+	}
+	metrics.ReleaseEventSlice(hierarchicalEvents)
+
+	for i, batch := range batches {
+		if batch != nil {
+			mappers[i] <- batch
+		}
+	}
+}
+
+// dispatch maps hierarchicalEvents and splits them between updaters by the
+// hash of their series. The events are released, as mapped events hold
+// copies of what they need.
+func (b *Exporter) dispatch(updaters []chan []*mappedEvent, hierarchicalEvents metrics.Events) {
+	batches := make([][]*mappedEvent, len(updaters))
+	for _, event := range hierarchicalEvents {
+		mapped := b.mapEvent(event)
+		if mapped == nil || !b.limitSeries(mapped) {
+			continue
+		}
+		i := hashNameAndLabels(mapped.name, mapped.labels) % uint64(len(updaters))
+		batches[i] = append(batches[i], mapped)
+	}
+	metrics.ReleaseEvents(hierarchicalEvents)
+
+	for i, batch := range batches {
+		if len(batch) > 0 {
+			updaters[i] <- batch
+		}
+	}
+}
+
+func (b *Exporter) Describe(ch chan<- *prometheus.Desc) {
+	ch <- activeSeriesDesc
+}
+
+func (b *Exporter) Collect(ch chan<- prometheus.Metric) {
+	ch <- prometheus.MustNewConstMetric(activeSeriesDesc, prometheus.GaugeValue, float64(b.Counters.Len()), "counter")
+	ch <- prometheus.MustNewConstMetric(activeSeriesDesc, prometheus.GaugeValue, float64(b.Gauges.Len()), "gauge")
+	ch <- prometheus.MustNewConstMetric(activeSeriesDesc, prometheus.GaugeValue, float64(b.Histograms.Len()), "histogram")
+}
+
+// indexName is the daily index documents timestamped at t are written to.
+func (b *Exporter) indexName(t time.Time) string {
+	return b.elasticIndex + t.Format("-2006.01.02")
+}
+
+// indexDocument queues document, a MetricDocument or HistogramDocument, to
+// be indexed in index according to the document schema.
+func (b *Exporter) indexDocument(index string, document interface{}) {
+	b.elasticBulkProcessor.Add(elastic.NewBulkIndexRequest().Index(index).Type("doc").Doc(b.schema.document(document)))
+}
+
 func (b *Exporter) flush() {
 	glog.V(10).Info("Flushing metrics")
 
-	time.Now()
-	time.Now().Format("2006.01.02")
+	now := time.Now()
+	index := b.indexName(now)
 
-	for hash, counter := range b.Counters.Elements {
+	seriesExpired.WithLabelValues("counter").Add(float64(b.Counters.Expire(now)))
+	seriesExpired.WithLabelValues("gauge").Add(float64(b.Gauges.Expire(now)))
+	seriesExpired.WithLabelValues("histogram").Add(float64(b.Histograms.Expire(now)))
+	b.series.Expire(now)
+
+	lastFlush := b.lastFlush
+	b.lastFlush = now
+
+	// Counters in delta and rate mode only exist if they were updated since
+	// the last flush. Cumulative counters report their total on every flush
+	// until they expire.
+	interval := now.Sub(lastFlush).Seconds()
+	b.Counters.Flush(func(flushed counterFlush) {
+		counter := flushed.counter
 		glog.V(100).Info(counter.Name(), counter.Value(), counter.Labels())
-		b.elasticBulkProcessor.Add(elastic.NewBulkIndexRequest().Index(b.elasticIndex).Type("metric").Doc(MetricDocument{
-			Timestamp:	 time.Now(),
+		document := MetricDocument{
+			Timestamp:	 now,
 			Name:        counter.Name(),
 			Description: counter.Description(),
 			MetricType:  "counter",
 			Value:       counter.Value(),
 			Labels:      counter.Labels(),
-		}))
-		delete(b.Counters.Elements, hash)
+			CounterMode: flushed.mode,
+		}
+		switch flushed.mode {
+		case string(mappings.CounterModeDelta):
+			document.Value = flushed.delta
+		case string(mappings.CounterModeRate):
+			delta := flushed.delta
+			document.Delta = &delta
+			document.Value = 0
+			if interval > 0 {
+				document.Value = delta / interval
+			}
+		}
+		b.indexDocument(index, document)
+	})
+
+	// Gauges hold the state relative updates apply to, so they are kept.
+	// Every update is indexed as it happens; gauges that were not updated
+	// since the last flush report their last value again, until they
+	// expire.
+	b.Gauges.Each(func(gauge metrics.Gauge, updated time.Time) {
+		glog.V(100).Info(gauge.Name(), gauge.Value(), gauge.Labels())
+		if !updated.Before(lastFlush) {
+			return
+		}
+		b.indexDocument(index, MetricDocument{
+			Timestamp:	 now,
+			Name:        gauge.Name(),
+			Description: gauge.Description(),
+			MetricType:  "gauge",
+			Value:       gauge.Value(),
+			Labels:      gauge.Labels(),
+		})
+	})
+
+	// Histograms are cumulative, like their Prometheus counterparts, and are
+	// reported on every flush.
+	b.Histograms.Each(func(histogram metrics.Histogram) {
+		glog.V(100).Info(histogram.Name(), histogram.Count(), histogram.Labels())
+		buckets := histogram.Buckets()
+		bucketDocuments := make([]BucketDocument, len(buckets))
+		for i, bucket := range buckets {
+			bucketDocuments[i] = BucketDocument{UpperBound: bucket.UpperBound, Count: bucket.Count}
+		}
+		b.indexDocument(index, HistogramDocument{
+			MetricDocument: MetricDocument{
+				Timestamp:	 now,
+				Name:        histogram.Name(),
+				Description: histogram.Description(),
+				MetricType:  "histogram",
+				Value:       histogram.Count(),
+				Unit:        histogram.Unit(),
+				Labels:      histogram.Labels(),
+			},
+			Sum:     histogram.Sum(),
+			Buckets: bucketDocuments,
+		})
+	})
+}
+
+// mappedEvent is an event after mapping, relabeling and value transforms.
+type mappedEvent struct {
+	mapping *mappings.MetricMapping
+	present bool
+	name    string
+	help    string
+	// labels are the labels of the documents and series of the event.
+	labels metrics.Labels
+	value  float64
+	unit   string
+	// metricType is the metricType of the documents of the event.
+	metricType string
+	buckets    []float64
+	ttl        time.Duration
+	// counterMode is the counter_mode of counter events.
+	counterMode string
+	// relative is set for relative gauge updates.
+	relative   bool
+	sampleRate float64
+}
+
+// mappingLookup looks up the mapping of a metric, like
+// mappings.MetricMapper.GetMapping.
+type mappingLookup func(statsdMetric string, statsdMetricType metrics.MetricType, eventLabels metrics.Labels) (*mappings.MetricMapping, metrics.Labels, bool, error)
+
+// mapEvent applies the mapping configuration to event. It returns nil if the
+// event is dropped, by its mapping's action, by relabeling or because the
+// templates of its mapping failed.
+func (b *Exporter) mapEvent(event metrics.Event) *mappedEvent {
+	return b.mapEventWith(b.mapper.GetMapping, event)
+}
+
+// mapEventWith is mapEvent with the mapping returned by lookup.
+func (b *Exporter) mapEventWith(lookup mappingLookup, event metrics.Event) *mappedEvent {
+	// Retrieve mapping of current hierarchical event being processed and extract Labels
+	mapping, labels, present, err := lookup(event.MetricName(), event.MetricType(), event.Labels())
+	if err != nil {
+		glog.V(10).Infof("Dropping event: %v", err)
+		templateErrors.Inc()
+		return nil
+	}
+	if mapping == nil {
+		mapping = &mappings.MetricMapping{}
 	}
 
-	for hash, gauge := range b.Gauges.Elements {
-		glog.V(100).Info(gauge.Name(), gauge.Value(), gauge.Labels())
-		delete(b.Gauges.Elements, hash)
+	if mapping.Action == mappings.ActionTypeDrop {
+		return nil
 	}
 
-	for hash, timer := range b.Histograms.Elements {
-		glog.V(100).Info(timer.Name(), timer.Value(), timer.Labels())
-		delete(b.Histograms.Elements, hash)
+	mapped := &mappedEvent{
+		mapping: mapping,
+		present: present,
+		help:    mapping.HelpText,
+		ttl:     mapping.TTL,
+
+		counterMode: string(mapping.CounterMode),
+	}
+	if mapped.help == "" {
+		mapped.help = defaultHelp
 	}
+
+	// Events are recycled once processed, so the documents get their own
+	// copy of the labels.
+	mapped.labels = make(metrics.Labels, len(event.Labels())+len(labels))
+	for label, value := range event.Labels() {
+		mapped.labels[label] = value
+	}
+
+	if present {
+		mapped.name = metrics.EscapeMetricName(mapping.Name)
+		for label, value := range labels {
+			mapped.labels[label] = value
+		}
+	} else {
+		//eventsUnmapped.Inc() // self metric
+		mapped.name = metrics.EscapeMetricName(event.MetricName())
+	}
+
+	// Mappings got the default relabel configs appended to their own at
+	// load time, and the mapping returned for unmapped events only has them.
+	if !mappings.Relabel(mapped.labels, mapping.RelabelConfigs) {
+		return nil
+	}
+
+	// Values are transformed before they are aggregated.
+	mapped.value = event.Value()
+	mapped.sampleRate = event.SampleRate()
+	absolute := true
+	switch ev := event.(type) {
+	case *metrics.CounterEvent:
+		absolute = false
+		mapped.metricType = "counter"
+	case *metrics.GaugeEvent:
+		absolute = !ev.Relative()
+		mapped.relative = ev.Relative()
+		mapped.metricType = "gauge"
+	case *metrics.TimerEvent:
+		t := mapping.TimerType
+		switch t {
+		case mappings.TimerTypeDefault, mappings.TimerTypeRaw:
+			mapped.metricType = "raw_timer"
+		case mappings.TimerTypeHistogram:
+			mapped.metricType = "histogram"
+			mapped.buckets = mapping.Buckets
+		default:
+			panic(fmt.Sprintf("unknown timer type '%s'", t))
+		}
+	default:
+		glog.V(10).Infoln("Unsupported hierarchicalEvent type")
+		//eventStats.WithLabelValues("illegal").Inc() // self metric
+		return nil
+	}
+	if mapping.Value != nil {
+		mapped.value = mapping.Value.Apply(mapped.value, absolute)
+		mapped.unit = mapping.Value.Unit
+	}
+	return mapped
 }
 
+// processHierarchicalEvents maps and records events on the calling
+// goroutine.
 func (b *Exporter) processHierarchicalEvents(hierarchicalEvents metrics.Events) {
 	for _, hierarchicalEvent := range hierarchicalEvents {
-		var help string
-		metricName := ""
-		eventLabels := hierarchicalEvent.Labels()
-
-		// Retrieve mapping of current hierarchical event being processed and extract Labels
-		mapping, labels, present := b.mapper.GetMapping(hierarchicalEvent.MetricName(), hierarchicalEvent.MetricType())
-		if mapping == nil {
-			mapping = &mappings.MetricMapping{}
-		}
-
-		if mapping.Action == mappings.ActionTypeDrop {
+		mapped := b.mapEvent(hierarchicalEvent)
+		if mapped == nil || !b.limitSeries(mapped) {
 			continue
 		}
+		b.processMappedEvent(mapped)
+	}
+}
 
-		if mapping.HelpText == "" {
-			help = defaultHelp
-		} else {
-			help = mapping.HelpText
+// processMappedEvent updates the series of an event and indexes the
+// documents recorded as events arrive.
+func (b *Exporter) processMappedEvent(mapped *mappedEvent) {
+	metricName, help, eventLabels, value, unit := mapped.name, mapped.help, mapped.labels, mapped.value, mapped.unit
+	index := b.indexName(time.Now())
+	glog.Infoln("index:", index)
+
+	switch mapped.metricType {
+	case "counter":
+		// We don't accept negative values for counters. Incrementing the counter with a negative number
+		// will cause the exporter to panic. Instead we will warn and continue to the next hierarchicalEvent.
+		if value < 0.0 {
+			glog.V(10).Infof("Counter %q is: '%f' (counter must be non-negative Value)", metricName, value)
+			//eventStats.WithLabelValues("illegal_negative_counter").Inc() // self metric
+			return
 		}
-		if present {
-			metricName = metrics.EscapeMetricName(mapping.Name)
-			for label, value := range labels {
-				eventLabels[label] = value
-			}
-		} else {
-			//eventsUnmapped.Inc() // self metric
-			metricName = metrics.EscapeMetricName(hierarchicalEvent.MetricName())
-		}
-
-		index := b.elasticIndex + time.Now().Format("-2006.01.02")
-		glog.Infoln("index:", index)
-
-		switch ev := hierarchicalEvent.(type) {
-		case *metrics.CounterEvent:
-			// We don't accept negative values for counters. Incrementing the counter with a negative number
-			// will cause the exporter to panic. Instead we will warn and continue to the next hierarchicalEvent.
-			if hierarchicalEvent.Value() < 0.0 {
-				glog.V(10).Infof("Counter %q is: '%f' (counter must be non-negative Value)", metricName, hierarchicalEvent.Value())
-				//eventStats.WithLabelValues("illegal_negative_counter").Inc() // self metric
-				continue
-			}
-
-			b.elasticBulkProcessor.Add(
-				elastic.NewBulkIndexRequest().
-					Index(index).
-					Type("doc").
-					Doc(MetricDocument{
-						Timestamp:	 time.Now(),
-						Name:        metricName,
-						Description: help,
-						MetricType:  "counter",
-						Value:       hierarchicalEvent.Value(),
-						Labels:      eventLabels,
-				}))
-
-			//counter, err := b.Counters.Get(
-			//	metricName,
-			//	eventLabels,
-			//	help,
-			//)
-			//if err == nil {
-			//	counter.Add(hierarchicalEvent.Value())
-			//
-			//	//eventStats.WithLabelValues("counter").Inc() // self metric
-			//} else {
-			//	glog.V(10).Infof(regErrF, metricName, err)
-			//	//conflictingEventStats.WithLabelValues("counter").Inc() // self metric
-			//}
-
-		case *metrics.GaugeEvent:
-			gauge, err := b.Gauges.Get(
-				metricName,
-				labels,
-				help,
-			)
-
-			if err == nil {
-				if ev.Relative() {
-					gauge.Add(hierarchicalEvent.Value())
-				} else {
-					gauge.Set(hierarchicalEvent.Value())
-				}
 
-				b.elasticBulkProcessor.Add(
-					elastic.NewBulkIndexRequest().
-						Index(index).
-						Type("doc").
-						Doc(MetricDocument{
-							Timestamp:	 time.Now(),
-							Name:        metricName,
-							Description: help,
-							MetricType:  "gauge",
-							Value:       gauge.Value(),
-							Labels:      eventLabels,
-					}))
-
-				//eventStats.WithLabelValues("gauge").Inc()  // self metric
-			} else {
-				glog.V(10).Infof(regErrF, metricName, err)
-				//conflictingEventStats.WithLabelValues("gauge").Inc() // self metric
-			}
+		if mapped.counterMode == "" || mapped.counterMode == string(mappings.CounterModeRaw) {
+			b.indexDocument(index, MetricDocument{
+				Timestamp:	 time.Now(),
+				Name:        metricName,
+				Description: help,
+				MetricType:  mapped.metricType,
+				Value:       value,
+				Unit:        unit,
+				Labels:      eventLabels,
+				SampleRate:  mapped.sampleRate,
+				CounterMode: string(mappings.CounterModeRaw),
+			})
+			return
+		}
 
-		case *metrics.TimerEvent:
-			t := mappings.TimerTypeDefault
-			if mapping != nil {
-				t = mapping.TimerType
-			}
-			if t == mappings.TimerTypeDefault {
-				t = b.mapper.Defaults.TimerType
-			}
+		// Other counter modes are aggregated and indexed on flush.
+		err := b.Counters.Add(
+			metricName,
+			eventLabels,
+			help,
+			mapped.ttl,
+			mapped.counterMode,
+			value,
+		)
+		if err != nil {
+			glog.V(10).Infof(regErrF, metricName, err)
+			//conflictingEventStats.WithLabelValues("counter").Inc() // self metric
+		}
 
-			switch t {
-			case mappings.TimerTypeDefault, mappings.TimerTypeRaw:
-				b.elasticBulkProcessor.Add(
-					elastic.NewBulkIndexRequest().
-						Index(index).
-						Type("doc").
-						Doc(MetricDocument{
-							Timestamp:	 time.Now(),
-							Name:        metricName,
-							Description: help,
-							MetricType:  "raw_timer",
-							Value:       hierarchicalEvent.Value(),
-							Labels:      eventLabels,
-					}))
-
-				//histogram, err := b.Histograms.Get(
-				//	metricName,
-				//	labels,
-				//	help,
-				//)
-
-				//if err == nil {
-				//	histogram.Observe(hierarchicalEvent.Value())
-					//eventStats.WithLabelValues("timer").Inc() // self metric
-				//} else {
-				//	glog.V(10).Infof(regErrF, metricName, err)
-					//conflictingEventStats.WithLabelValues("timer").Inc() // self metric
-				//}
-			default:
-				panic(fmt.Sprintf("unknown timer type '%s'", t))
-			}
+	case "gauge":
+		// Gauges are keyed by all their labels, so relative updates from
+		// differently tagged sources don't add up. A relative update to
+		// a gauge that doesn't exist yet, or expired, starts from 0.
+		gaugeValue, err := b.Gauges.Update(
+			metricName,
+			eventLabels,
+			help,
+			mapped.ttl,
+			value,
+			mapped.relative,
+		)
+
+		if err == nil {
+			b.indexDocument(index, MetricDocument{
+				Timestamp:	 time.Now(),
+				Name:        metricName,
+				Description: help,
+				MetricType:  mapped.metricType,
+				Value:       gaugeValue,
+				Unit:        unit,
+				Labels:      eventLabels,
+			})
+
+			//eventStats.WithLabelValues("gauge").Inc()  // self metric
+		} else {
+			glog.V(10).Infof(regErrF, metricName, err)
+			//conflictingEventStats.WithLabelValues("gauge").Inc() // self metric
+		}
 
-		default:
-			glog.V(10).Infoln("Unsupported hierarchicalEvent type")
-			//eventStats.WithLabelValues("illegal").Inc() // self metric
+	case "raw_timer":
+		// A sampled timer is indexed once; its sample rate tells how
+		// many observations the document stands for.
+		b.indexDocument(index, MetricDocument{
+			Timestamp:	 time.Now(),
+			Name:        metricName,
+			Description: help,
+			MetricType:  mapped.metricType,
+			Value:       value,
+			Unit:        unit,
+			Labels:      eventLabels,
+			SampleRate:  mapped.sampleRate,
+		})
+
+	case "histogram":
+		err := b.Histograms.Observe(
+			metricName,
+			eventLabels,
+			help,
+			unit,
+			mapped.buckets,
+			mapped.ttl,
+			value,
+			1/mapped.sampleRate,
+		)
+		if err != nil {
+			glog.V(10).Infof(regErrF, metricName, err)
+			//conflictingEventStats.WithLabelValues("timer").Inc() // self metric
 		}
 	}
 }
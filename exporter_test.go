@@ -0,0 +1,436 @@
+package main
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jvosantos/statsd_exporter/mappings"
+	"github.com/jvosantos/statsd_exporter/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+const testMappings = `
+defaults:
+  timer_type: histogram
+  buckets: [1, 10]
+mappings:
+- match: "*.latency"
+  name: latency
+  labels:
+    job: "$1"
+- match: "*.*.duration"
+  name: latency
+  labels:
+    job: "$1"
+`
+
+func newTestExporter(t *testing.T, workers int) *Exporter {
+	mapper := &mappings.MetricMapper{}
+	if err := mapper.InitFromYAMLString(testMappings); err != nil {
+		t.Fatal(err)
+	}
+	return NewExporter(mapper, nil, "statsd", nil, 0, workers)
+}
+
+func timerEvents(t *testing.T, name string, values ...float64) metrics.Events {
+	events := metrics.NewEvents()
+	for _, value := range values {
+		event, err := metrics.NewEvent("ms", name, value, false, 1, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+func TestExporterRoute(t *testing.T) {
+	e := newTestExporter(t, 4)
+	mappers := make([]chan metrics.Events, 4)
+	for i := range mappers {
+		mappers[i] = make(chan metrics.Events, 1)
+	}
+
+	names := []string{"a.latency", "b.latency", "c.latency", "a.latency", "a.b.duration"}
+	events := metrics.NewEvents()
+	for _, name := range names {
+		events = append(events, timerEvents(t, name, 1)...)
+	}
+	e.route(mappers, events)
+
+	routed := 0
+	mapperOf := map[string]int{}
+	for i, mapper := range mappers {
+		close(mapper)
+		for batch := range mapper {
+			for _, event := range batch {
+				routed++
+				if j, ok := mapperOf[event.MetricName()]; ok && j != i {
+					t.Errorf("%s routed to mappers %d and %d", event.MetricName(), j, i)
+				}
+				mapperOf[event.MetricName()] = i
+			}
+		}
+	}
+	if routed != len(names) {
+		t.Fatalf("expected %d events routed, got %d", len(names), routed)
+	}
+}
+
+// TestExporterDispatch maps events on several goroutines at once, like the
+// mapping workers of Listen do, and checks that no update is lost.
+func TestExporterDispatch(t *testing.T) {
+	scenarios := []struct {
+		name  string
+		names []string
+		// series are the number of observations by job.
+		series map[string]float64
+	}{
+		{
+			name:   "one name per series",
+			names:  []string{"a.latency", "b.latency"},
+			series: map[string]float64{"a": 100, "b": 100},
+		},
+		{
+			name:   "several names per series",
+			names:  []string{"a.latency", "a.x.duration", "a.y.duration", "b.latency"},
+			series: map[string]float64{"a": 300, "b": 100},
+		},
+	}
+
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			e := newTestExporter(t, 4)
+			updaters := make([]chan []*mappedEvent, 4)
+			var updatersWG sync.WaitGroup
+			for i := range updaters {
+				updaters[i] = make(chan []*mappedEvent, workerQueueSize)
+				updatersWG.Add(1)
+				go func(batches <-chan []*mappedEvent) {
+					defer updatersWG.Done()
+					for batch := range batches {
+						for _, mapped := range batch {
+							e.processMappedEvent(mapped)
+						}
+					}
+				}(updaters[i])
+			}
+
+			var mappersWG sync.WaitGroup
+			for _, name := range s.names {
+				mappersWG.Add(1)
+				go func(name string) {
+					defer mappersWG.Done()
+					for i := 0; i < 50; i++ {
+						e.dispatch(updaters, timerEvents(t, name, 0.5, 5))
+					}
+				}(name)
+			}
+			mappersWG.Wait()
+			for _, updater := range updaters {
+				close(updater)
+			}
+			updatersWG.Wait()
+
+			series := map[string]float64{}
+			e.Histograms.Each(func(histogram metrics.Histogram) {
+				if histogram.Name() != "latency" {
+					t.Errorf("unexpected histogram %q", histogram.Name())
+				}
+				series[histogram.Labels()["job"]] += histogram.Count()
+			})
+			if len(series) != len(s.series) {
+				t.Fatalf("expected series %v, got %v", s.series, series)
+			}
+			for job, count := range s.series {
+				if series[job] != count {
+					t.Errorf("job %q: expected %v observations, got %v", job, count, series[job])
+				}
+			}
+		})
+	}
+}
+
+func TestMapEventTemplateErrors(t *testing.T) {
+	mapper := &mappings.MetricMapper{}
+	err := mapper.InitFromYAMLString(`
+mappings:
+- match: env.*
+  name: '{{ .Labels.env }}'
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := NewExporter(mapper, nil, "statsd", nil, 0, 1)
+
+	scenarios := []struct {
+		labels  metrics.Labels
+		dropped bool
+	}{
+		{labels: metrics.Labels{"env": "prod"}},
+		{labels: nil, dropped: true},
+	}
+	for _, s := range scenarios {
+		before := counterValue(t, templateErrors)
+		event, err := metrics.NewEvent("c", "env.requests", 1, false, 1, s.labels)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mapped := e.mapEvent(event)
+		if (mapped == nil) != s.dropped {
+			t.Fatalf("labels %v: expected dropped %v, got %+v", s.labels, s.dropped, mapped)
+		}
+		counted := counterValue(t, templateErrors) - before
+		if s.dropped && counted != 1 || !s.dropped && counted != 0 {
+			t.Errorf("labels %v: expected dropped %v, counted %v template errors", s.labels, s.dropped, counted)
+		}
+	}
+}
+
+func counterValue(t *testing.T, counter prometheus.Counter) float64 {
+	var m dto.Metric
+	if err := counter.Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetCounter().GetValue()
+}
+
+func TestShippedMappings(t *testing.T) {
+	mapper := &mappings.MetricMapper{}
+	if err := mapper.InitFromFile("mappings.yaml"); err != nil {
+		t.Fatal(err)
+	}
+
+	scenarios := []struct {
+		name       string
+		metricType metrics.MetricType
+		mapping    string
+		labels     metrics.Labels
+	}{
+		{
+			name:       "envoy.http.ingress.downstream_cx_destroy",
+			metricType: "counter",
+			mapping:    "downstream_cx_destroy",
+			labels:     metrics.Labels{"application": "envoy", "connection_name": "ingress"},
+		},
+		{
+			name:       "envoy.http.ingress.downstream_cx_destroy_remote",
+			metricType: "counter",
+			mapping:    "downstream_cx_destroy_remote",
+			labels:     metrics.Labels{"application": "envoy", "connection_name": "ingress"},
+		},
+		{
+			name:       "envoy.cluster.cluster_api.upstream_cx_active",
+			metricType: "gauge",
+			mapping:    "upstream_cx_active",
+			labels:     metrics.Labels{"application": "envoy", "cluster": "api"},
+		},
+		{
+			name:       "envoy.cluster.cluster_api.version",
+			metricType: "gauge",
+			mapping:    "version",
+			labels:     metrics.Labels{"application": "envoy", "cluster": "api"},
+		},
+		{
+			name:       "envoy.cluster.cluster_api.zone.eu1.eu2.upstream_rq_time",
+			metricType: "timer",
+			mapping:    "zone_upstream_rq_time",
+			labels:     metrics.Labels{"application": "envoy", "cluster": "api", "source_zone": "eu1", "destination_zone": "eu2"},
+		},
+	}
+
+	for _, s := range scenarios {
+		mapping, labels, present, err := mapper.GetMapping(s.name, s.metricType, nil)
+		if err != nil || !present {
+			t.Fatalf("%s: expected a mapping, got %v", s.name, err)
+		}
+		if mapping.Name != s.mapping || !reflect.DeepEqual(labels, s.labels) {
+			t.Errorf("%s: expected %s%v, got %s%v", s.name, s.mapping, s.labels, mapping.Name, labels)
+		}
+	}
+}
+
+func TestContainersExpire(t *testing.T) {
+	labels := metrics.Labels{"job": "a"}
+	scenarios := []struct {
+		name string
+		// update adds a series with the given ttl to the containers of e.
+		update func(e *Exporter, ttl time.Duration)
+		len    func(e *Exporter) int
+		expire func(e *Exporter, now time.Time) int
+	}{
+		{
+			name: "counter",
+			update: func(e *Exporter, ttl time.Duration) {
+				e.Counters.Add("c", labels, "", ttl, "cumulative", 1)
+			},
+			len:    func(e *Exporter) int { return e.Counters.Len() },
+			expire: func(e *Exporter, now time.Time) int { return e.Counters.Expire(now) },
+		},
+		{
+			name: "gauge",
+			update: func(e *Exporter, ttl time.Duration) {
+				e.Gauges.Update("g", labels, "", ttl, 1, false)
+			},
+			len:    func(e *Exporter) int { return e.Gauges.Len() },
+			expire: func(e *Exporter, now time.Time) int { return e.Gauges.Expire(now) },
+		},
+		{
+			name: "histogram",
+			update: func(e *Exporter, ttl time.Duration) {
+				e.Histograms.Observe("h", labels, "", "", []float64{1}, ttl, 1, 1)
+			},
+			len:    func(e *Exporter) int { return e.Histograms.Len() },
+			expire: func(e *Exporter, now time.Time) int { return e.Histograms.Expire(now) },
+		},
+	}
+
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			e := newTestExporter(t, 1)
+			s.update(e, 0)
+			if expired := s.expire(e, time.Now().Add(24*time.Hour)); expired != 0 || s.len(e) != 1 {
+				t.Fatalf("expected a series without ttl to be kept, %d expired", expired)
+			}
+
+			s.update(e, time.Minute)
+			if expired := s.expire(e, time.Now().Add(30*time.Second)); expired != 0 || s.len(e) != 1 {
+				t.Fatalf("expected a series updated within its ttl to be kept, %d expired", expired)
+			}
+			if expired := s.expire(e, time.Now().Add(2*time.Minute)); expired != 1 || s.len(e) != 0 {
+				t.Fatalf("expected an idle series to expire, %d expired, %d left", expired, s.len(e))
+			}
+		})
+	}
+}
+
+func TestExporterCollect(t *testing.T) {
+	e := newTestExporter(t, 1)
+	e.Counters.Add("c", nil, "", 0, "cumulative", 1)
+	e.Gauges.Update("g", metrics.Labels{"job": "a"}, "", 0, 1, false)
+	e.Gauges.Update("g", metrics.Labels{"job": "b"}, "", 0, 1, false)
+
+	registry := prometheus.NewPedanticRegistry()
+	registry.MustRegister(e)
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	series := map[string]float64{}
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			series[metric.GetLabel()[0].GetValue()] = metric.GetGauge().GetValue()
+		}
+	}
+	expected := map[string]float64{"counter": 1, "gauge": 2, "histogram": 0}
+	if !reflect.DeepEqual(series, expected) {
+		t.Errorf("expected active series %v, got %v", expected, series)
+	}
+}
+
+func TestGaugesUpdate(t *testing.T) {
+	type update struct {
+		labels   metrics.Labels
+		value    float64
+		relative bool
+		// expected is the value of the gauge after the update.
+		expected float64
+	}
+	x := metrics.Labels{"job": "a", "host": "x"}
+	y := metrics.Labels{"job": "a", "host": "y"}
+	scenarios := []struct {
+		name    string
+		updates []update
+	}{
+		{
+			name:    "absolute",
+			updates: []update{{x, 3, false, 3}, {x, 2, false, 2}},
+		},
+		{
+			name:    "relative",
+			updates: []update{{x, 3, false, 3}, {x, 2, true, 5}, {x, -4, true, 1}},
+		},
+		{
+			name:    "relative from nothing",
+			updates: []update{{x, -2, true, -2}},
+		},
+		{
+			name:    "relative by label set",
+			updates: []update{{x, 1, true, 1}, {y, 2, true, 2}, {x, 1, true, 2}, {y, 10, false, 10}, {x, 1, true, 3}},
+		},
+	}
+
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			e := newTestExporter(t, 1)
+			for i, u := range s.updates {
+				value, err := e.Gauges.Update("g", u.labels, "", 0, u.value, u.relative)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if value != u.expected {
+					t.Errorf("update %d: expected %v, got %v", i, u.expected, value)
+				}
+			}
+		})
+	}
+}
+
+func TestCountersFlush(t *testing.T) {
+	// Each step adds values to the series, then flushes the container.
+	type step struct {
+		add []float64
+		// flushed is the delta of the flushed series, or -1 if none was.
+		flushed float64
+		total   float64
+	}
+	scenarios := []struct {
+		mode  string
+		steps []step
+	}{
+		{
+			mode:  "delta",
+			steps: []step{{[]float64{1, 2}, 3, 3}, {nil, -1, 0}, {[]float64{4}, 4, 4}},
+		},
+		{
+			mode:  "rate",
+			steps: []step{{[]float64{1, 2}, 3, 3}, {nil, -1, 0}, {[]float64{4}, 4, 4}},
+		},
+		{
+			mode:  "cumulative",
+			steps: []step{{[]float64{1, 2}, 3, 3}, {nil, 0, 3}, {[]float64{4}, 4, 7}},
+		},
+	}
+
+	for _, s := range scenarios {
+		t.Run(s.mode, func(t *testing.T) {
+			e := newTestExporter(t, 1)
+			for i, step := range s.steps {
+				for _, value := range step.add {
+					if err := e.Counters.Add("c", metrics.Labels{"job": "a"}, "", 0, s.mode, value); err != nil {
+						t.Fatal(err)
+					}
+				}
+				var flushed []counterFlush
+				e.Counters.Flush(func(f counterFlush) {
+					flushed = append(flushed, f)
+				})
+				if step.flushed < 0 {
+					if len(flushed) != 0 {
+						t.Errorf("step %d: expected no flushed series, got %v", i, flushed)
+					}
+					continue
+				}
+				if len(flushed) != 1 {
+					t.Fatalf("step %d: expected a flushed series, got %v", i, flushed)
+				}
+				if f := flushed[0]; f.mode != s.mode || f.delta != step.flushed || f.counter.Value() != step.total {
+					t.Errorf("step %d: expected %s delta %v total %v, got %s delta %v total %v", i, s.mode, step.flushed, step.total, f.mode, f.delta, f.counter.Value())
+				}
+			}
+		})
+	}
+}
@@ -31,3 +31,12 @@ func hashAddByte(h uint64, b byte) uint64 {
 	h *= prime64
 	return h
 }
+
+// hashAddUint64 adds the big-endian bytes of v to a fnv64a hash Value,
+// returning the updated hash.
+func hashAddUint64(h uint64, v uint64) uint64 {
+	for shift := 56; shift >= 0; shift -= 8 {
+		h = hashAddByte(h, byte(v>>uint(shift)))
+	}
+	return h
+}
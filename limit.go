@@ -0,0 +1,116 @@
+package main
+
+import (
+	"github.com/jvosantos/statsd_exporter/mappings"
+	"github.com/jvosantos/statsd_exporter/metrics"
+	"sync"
+	"time"
+)
+
+// seriesLimiter tracks the label sets seen for every metric name with a
+// max_series limit. It is safe for concurrent use.
+type seriesLimiter struct {
+	shards [containerShards]limiterShard
+}
+
+type limiterShard struct {
+	sync.Mutex
+	// names maps metric names to the series of their label sets, by label
+	// signature.
+	names map[string]map[uint64]*series
+}
+
+func newSeriesLimiter() *seriesLimiter {
+	l := &seriesLimiter{}
+	for i := range l.shards {
+		l.shards[i].names = make(map[string]map[uint64]*series)
+	}
+	return l
+}
+
+// admit reports whether the series of name and labels is known or, if not,
+// whether the name has fewer than max series and the series was added.
+// Series are forgotten when idle for longer than ttl, like the series in
+// the containers.
+func (l *seriesLimiter) admit(name string, labels metrics.Labels, max int, ttl time.Duration) bool {
+	shard := &l.shards[hashAdd(hashNew(), name)%containerShards]
+	signature := labelsToSignature(labels)
+	now := time.Now()
+	shard.Lock()
+	defer shard.Unlock()
+
+	sets, ok := shard.names[name]
+	if !ok {
+		sets = make(map[uint64]*series)
+		shard.names[name] = sets
+	}
+	s, ok := sets[signature]
+	if !ok {
+		if len(sets) >= max {
+			return false
+		}
+		s = &series{}
+		sets[signature] = s
+	}
+	s.touch(ttl, now)
+	return true
+}
+
+// allows reports whether admit would admit the series of name and labels,
+// without adding or touching it.
+func (l *seriesLimiter) allows(name string, labels metrics.Labels, max int) bool {
+	shard := &l.shards[hashAdd(hashNew(), name)%containerShards]
+	signature := labelsToSignature(labels)
+	shard.Lock()
+	defer shard.Unlock()
+
+	sets := shard.names[name]
+	if _, ok := sets[signature]; ok {
+		return true
+	}
+	return len(sets) < max
+}
+
+// Expire forgets the series idle for longer than their TTL.
+func (l *seriesLimiter) Expire(now time.Time) {
+	for i := range l.shards {
+		shard := &l.shards[i]
+		shard.Lock()
+		for name, sets := range shard.names {
+			for signature, s := range sets {
+				if s.expired(now) {
+					delete(sets, signature)
+				}
+			}
+			if len(sets) == 0 {
+				delete(shard.names, name)
+			}
+		}
+		shard.Unlock()
+	}
+}
+
+// limitSeries applies the max_series limit of the event's mapping. It
+// returns false if the event is dropped; events collapsed into the overflow
+// series get their label values replaced.
+func (b *Exporter) limitSeries(mapped *mappedEvent) bool {
+	mapping := mapped.mapping
+	if mapping.MaxSeries == 0 || b.series.admit(mapped.name, mapped.labels, mapping.MaxSeries, mapped.ttl) {
+		return true
+	}
+
+	seriesLimited.WithLabelValues(mapped.name, string(mapping.OverflowPolicy)).Inc()
+	return overflowSeries(mapped)
+}
+
+// overflowSeries applies the overflow_policy of the event's mapping to an
+// event over its max_series. It returns false if the event is dropped.
+func overflowSeries(mapped *mappedEvent) bool {
+	if mapped.mapping.OverflowPolicy != mappings.OverflowSeries {
+		return false
+	}
+	for label := range mapped.labels {
+		mapped.labels[label] = mappings.OverflowValue
+	}
+	return true
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jvosantos/statsd_exporter/mappings"
+	"github.com/jvosantos/statsd_exporter/metrics"
+)
+
+func TestSeriesLimiter(t *testing.T) {
+	type step struct {
+		name  string
+		id    string
+		ttl   time.Duration
+		admit bool
+	}
+	scenarios := []struct {
+		name  string
+		steps []step
+		// expire is how long after the steps the series are expired, before
+		// probing with allows.
+		expire time.Duration
+		probe  step
+	}{
+		{
+			name:  "under max",
+			steps: []step{{"aa", "1", 0, true}, {"aa", "2", 0, true}},
+			probe: step{"aa", "3", 0, false},
+		},
+		{
+			name:  "known series over max",
+			steps: []step{{"aa", "1", 0, true}, {"aa", "2", 0, true}, {"aa", "3", 0, false}, {"aa", "1", 0, true}},
+			probe: step{"aa", "2", 0, true},
+		},
+		{
+			name:  "limit per name",
+			steps: []step{{"aa", "1", 0, true}, {"aa", "2", 0, true}, {"bb", "1", 0, true}},
+			probe: step{"bb", "2", 0, true},
+		},
+		{
+			name:   "expired series",
+			steps:  []step{{"aa", "1", time.Minute, true}, {"aa", "2", time.Minute, true}},
+			expire: time.Hour,
+			probe:  step{"aa", "3", 0, true},
+		},
+		{
+			name:   "series without ttl",
+			steps:  []step{{"aa", "1", 0, true}, {"aa", "2", time.Minute, true}},
+			expire: time.Hour,
+			probe:  step{"aa", "3", 0, true},
+		},
+		{
+			name:   "series not expired yet",
+			steps:  []step{{"aa", "1", time.Hour, true}, {"aa", "2", time.Hour, true}},
+			expire: time.Minute,
+			probe:  step{"aa", "3", 0, false},
+		},
+	}
+
+	const max = 2
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			l := newSeriesLimiter()
+			for i, step := range s.steps {
+				if admit := l.admit(step.name, metrics.Labels{"id": step.id}, max, step.ttl); admit != step.admit {
+					t.Fatalf("step %d: expected admit %v, got %v", i, step.admit, admit)
+				}
+			}
+			if s.expire != 0 {
+				l.Expire(time.Now().Add(s.expire))
+			}
+			labels := metrics.Labels{"id": s.probe.id}
+			if allows := l.allows(s.probe.name, labels, max); allows != s.probe.admit {
+				t.Errorf("expected allows %v, got %v", s.probe.admit, allows)
+			}
+			if admit := l.admit(s.probe.name, labels, max, 0); admit != s.probe.admit {
+				t.Errorf("expected admit %v, got %v", s.probe.admit, admit)
+			}
+		})
+	}
+}
+
+func TestLimitSeries(t *testing.T) {
+	scenarios := []struct {
+		name     string
+		overflow bool
+		max      int
+		ids      []string
+		// admitted are the ids of the events limitSeries keeps, in order,
+		// as the label values they are recorded with.
+		admitted []string
+	}{
+		{
+			name:     "no limit",
+			ids:      []string{"1", "2", "3"},
+			admitted: []string{"1", "2", "3"},
+		},
+		{
+			name:     "drop",
+			max:      2,
+			ids:      []string{"1", "2", "3", "1"},
+			admitted: []string{"1", "2", "1"},
+		},
+		{
+			name:     "overflow",
+			overflow: true,
+			max:      2,
+			ids:      []string{"1", "2", "3", "4", "2"},
+			admitted: []string{"1", "2", mappings.OverflowValue, mappings.OverflowValue, "2"},
+		},
+	}
+
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			e := newTestExporter(t, 1)
+			mapping := &mappings.MetricMapping{MaxSeries: s.max, OverflowPolicy: mappings.OverflowDrop}
+			if s.overflow {
+				mapping.OverflowPolicy = mappings.OverflowSeries
+			}
+			admitted := []string{}
+			for _, id := range s.ids {
+				mapped := &mappedEvent{
+					mapping: mapping,
+					name:    "limited",
+					labels:  metrics.Labels{"id": id, "host": "aa"},
+				}
+				if !e.limitSeries(mapped) {
+					continue
+				}
+				if mapped.labels["id"] == mappings.OverflowValue && mapped.labels["host"] != mappings.OverflowValue {
+					t.Errorf("expected every label to overflow, got %v", mapped.labels)
+				}
+				admitted = append(admitted, mapped.labels["id"])
+			}
+			if !reflect.DeepEqual(admitted, s.admitted) {
+				t.Errorf("expected admitted series %v, got %v", s.admitted, admitted)
+			}
+		})
+	}
+}
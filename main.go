@@ -4,25 +4,58 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"github.com/fsnotify/fsnotify"
 	"github.com/golang/glog"
-	"github.com/howeyc/fsnotify"
 	"github.com/jvosantos/statsd_exporter/mappings"
-	"github.com/jvosantos/statsd_exporter/metrics"
 	"github.com/jvosantos/statsd_exporter/statsd"
 	"github.com/olivere/elastic"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
 var (
 	statsdListenUDP     	 	= flag.String("statsd.listen-udp", "", "The UDP address on which to receive statsd metric lines. \"\" disables it.")
 	readBuffer          	 	= flag.Int("statsd.read-buffer", 0, "Size (in bytes) of the operating system's transmit read buffer associated with the UDP connection. Please make sure the kernel parameters net.core.rmem_max is set to a Value greater than the Value specified.")
+	udpReaders					= flag.Int("statsd.udp-readers", 1, "Number of goroutines reading and parsing UDP packets concurrently.")
+	udpReusePort				= flag.Bool("statsd.udp-reuseport", false, "Open one SO_REUSEPORT socket per UDP reader instead of sharing a single socket. Linux only.")
+	udpBatchSize				= flag.Int("statsd.udp-batch-size", 32, "Number of UDP packets received per recvmmsg system call on Linux. 1 disables batching.")
 	statsdListenTCP     	 	= flag.String("statsd.listen-tcp", "", "The TCP address on which to receive statsd metric lines. \"\" disables it.")
-
-	mappingConfig       	 	= flag.String("mapping-config", "mappings.yaml", "Metric mapping configuration file name.")
+	tcpMaxConnections			= flag.Int("statsd.tcp-max-connections", 0, "Maximum number of concurrently open TCP connections. Connections above the limit are closed on accept. 0 disables the limit.")
+	tcpIdleTimeout				= flag.Duration("statsd.tcp-idle-timeout", 5 * time.Minute, "Close TCP connections that have not started a new line within this duration. 0s disables it.")
+	tcpReadTimeout				= flag.Duration("statsd.tcp-read-timeout", 30 * time.Second, "Close TCP connections that take longer than this duration to complete a line. 0s disables it.")
+	tcpMaxLineLength			= flag.Int("statsd.tcp-max-line-length", 65536, "Maximum length (in bytes) of a statsd line received over TCP. Connections sending longer lines are closed.")
+	tcpKeepAlive				= flag.Bool("statsd.tcp-keepalive", true, "Enable TCP keepalive probes on accepted connections.")
+	tcpKeepAlivePeriod			= flag.Duration("statsd.tcp-keepalive-period", 0, "Interval between TCP keepalive probes. 0s keeps the operating system default.")
+	listenerLabel				= flag.String("statsd.listener-label", "", "Name of the label carrying the listener (udp or tcp) an event was received on. \"\" disables it.")
+	sourceIPLabel				= flag.String("statsd.source-ip-label", "", "Name of the label carrying the IP address of the client that sent an event. \"\" disables it.")
+	sourceHostnameLabel			= flag.String("statsd.source-hostname-label", "", "Name of the label carrying the reverse DNS name of the client that sent an event. \"\" disables it.")
+	sourceHostnameTTL			= flag.Duration("statsd.source-hostname-ttl", 10 * time.Minute, "How long reverse DNS names of clients are cached for.")
+	sourceTelemetry				= flag.Bool("statsd.source-telemetry", false, "Count the packets received from every client address in the exporter's own metrics.")
+	rateLimitConfig				= flag.String("statsd.rate-limit-config", "", "YAML file of per-source and per-metric-prefix rate limits. Traffic above the limits is dropped before parsing.")
+	eventQueueSize				= flag.Int("statsd.event-queue-size", 1024, "Number of event batches (one per UDP packet or TCP line) buffered between the listeners and the exporter.")
+	eventQueuePolicy			= flag.String("statsd.event-queue-policy", "block", "What listeners do when the event queue is full: block, drop_newest or drop_oldest. Blocking UDP readers makes the kernel drop packets instead.")
+	listenerRetryInterval		= flag.Duration("statsd.listener-retry-interval", time.Second, "Time to wait before binding a failed UDP/TCP listener again.")
+	listenerMaxRetries			= flag.Int("statsd.listener-max-retries", 5, "Number of consecutive failed restarts of a UDP/TCP listener after which the exporter exits. 0 retries forever.")
+
+	listenAddress				= flag.String("web.listen-address", ":9102", "The address on which to expose the web interface and generated Prometheus metrics.")
+	metricsEndpoint				= flag.String("web.telemetry-path", "/metrics", "Path under which to expose the exporter's own metrics.")
+
+	mappingConfig       	 	= flag.String("mapping-config", "mappings.yaml", "Metric mapping configuration file, directory of .yaml/.yml files, or glob.")
+	mappingCheckInterval		= flag.Duration("mapping-config-check-interval", 30 * time.Second, "Interval at which the mapping configuration is reloaded if the contents of its files changed, which catches changes the directory watches miss. 0s disables it.")
+	mappingCacheSize			= flag.Int("mapping-cache-size", 1000, "Number of metric name and type lookups whose matching mapping is cached. 0 disables the cache.")
+	flushInterval				= flag.Duration("exporter.flush-interval", 30 * time.Second, "Interval at which aggregated series, such as histogram timers, are written to Elasticsearch. 0s only writes them on shutdown.")
+	exporterWorkers				= flag.Int("exporter.workers", 1, "Number of goroutines mapping events, and of goroutines updating series. Events are routed to the former by StatsD name and to the latter by the series they are mapped to.")
+	snapshotPath				= flag.String("snapshot.path", "", "File the state of counters, gauges and histograms is saved to, and restored from on startup. \"\" disables snapshots.")
+	snapshotInterval			= flag.Duration("snapshot.interval", time.Minute, "Interval at which snapshots are written. They are also written on shutdown. 0s only writes them on shutdown.")
 
 	elasticHost				 	= flag.String("elasticsearch.url", "localhost:9200", "The URL endpoints of the Elasticsearch nodes. Multiple urls can be added separated by a comma. Notice that when sniffing is enabled, these URLs are used to initially sniff the cluster on startup.")
 	elasticUsername			 	= flag.String("elasticsearch.username", "", "The username to be used as basic authentication on Elasticsearch requests.")
@@ -30,41 +63,70 @@ var (
 	elasticIndex			 	= flag.String("elasticsearch.index", "statsdexporter", "The Name of the index to push metrics to. Defaults to \"statsdexporter\".")
 	elasticIndexTemplate		= flag.String("elasticsearch.template", "", "Elastic Search Index template file name. Should be in json format.")
 	elasticIndexTemplateName 	= flag.String("elasticsearch.template-name", "statsdexporter", "Index template name, defaults to index name.")
+	elasticDocumentConfig		= flag.String("elasticsearch.document-config", "", "YAML file renaming, omitting and adding fields of the documents indexed. \"\" indexes the default fields.")
 	elasticWorkers			 	= flag.Int("elasticsearch.workers", 1, "Workers is the number of concurrent workers allowed to be executed. Defaults to 1 and must be greater or equal to 1.")
 	elasticActionsThreshold	 	= flag.Int("elasticsearch.actions-threshold", 1000, "BulkActions specifies when to flush based on the number of actions currently added. Defaults to 1000 and can be set to -1 to be disabled.")
 	elasticSize				 	= flag.Int("elasticsearch.size-threshold", 5000, "Bulk Size specifies when to flush based on the size (in bytes) of the actions currently added. Defaults to 5 MB and can be set to -1 to be disabled.")
 	elasticFlushInterval	 	= flag.Duration("elasticsearch.flush-interval", 30 * time.Second, "Flush Interval specifies when to flush at the end of the given interval. Defaults to 30s and can be set to 0s to be disabled.")
 )
 
-func watchMappingConfig(fileName string, mapper *mappings.MetricMapper) {
-	watcher, err := fsnotify.NewWatcher()
-	if err != nil {
-		glog.Fatal(err)
-	}
-
-	err = watcher.WatchFlags(fileName, fsnotify.FSN_MODIFY)
-	if err != nil {
-		glog.Fatal(err)
-	}
+func serveHTTP(listenAddress, metricsEndpoint string, exporter *Exporter, reloader *mappingReloader) {
+	http.Handle(metricsEndpoint, promhttp.Handler())
+	http.Handle("/-/reload", reloadHandler(reloader))
+	http.Handle("/explain", explainHandler(exporter))
+	http.Handle("/mappings/unused", unusedMappingsHandler(exporter.mapper))
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`<html>
+			<head><title>StatsD Exporter</title></head>
+			<body>
+			<h1>StatsD Exporter</h1>
+			<p><a href="` + metricsEndpoint + `">Metrics</a></p>
+			<p><a href="/explain?line=example.metric:1%7Cc">Explain a StatsD line</a></p>
+			<p><a href="/mappings/unused">Unused mappings</a></p>
+			</body>
+			</html>`))
+	})
+	glog.Fatal(http.ListenAndServe(listenAddress, nil))
+}
 
+// runListener serves l until ctx is cancelled. When the listener fails it is
+// closed and bound again through bind, giving up and exiting the exporter
+// after listenerMaxRetries consecutive failures.
+func runListener(ctx context.Context, name string, l statsd.Listener, bind func() (statsd.Listener, error), events *statsd.EventQueue) {
+	failures := 0
 	for {
-		select {
-		case ev := <-watcher.Event:
-			glog.Infof("Config file changed (%s), attempting reload", ev)
-			err = mapper.InitFromFile(fileName)
-			if err != nil {
-				glog.Errorln("Error reloading config:", err)
-				//configLoads.WithLabelValues("failure").Inc() // self metric
-			} else {
-				glog.Infoln("Config reloaded successfully")
-				//configLoads.WithLabelValues("success").Inc() // self metric
+		if l != nil {
+			started := time.Now()
+			err := l.Listen(ctx, events)
+			l.Close()
+			if err == nil {
+				glog.V(10).Infof("Stopped statsd %s", name)
+				return
 			}
-			// Re-add the file watcher since it can get lost on some changes. E.g.
-			// saving a file with vim results in a RENAME-MODIFY-DELETE event
-			// sequence, after which the newly written file is no longer watched.
-			_ = watcher.WatchFlags(fileName, fsnotify.FSN_MODIFY)
-		case err := <-watcher.Error:
-			glog.Errorln("Error watching config:", err)
+			glog.Errorf("Statsd %s listener failed: %v", name, err)
+			if time.Since(started) > *listenerRetryInterval {
+				failures = 0
+			}
+		}
+
+		failures++
+		if *listenerMaxRetries > 0 && failures > *listenerMaxRetries {
+			glog.Fatalf("Statsd %s listener failed %d times in a row, exiting", name, failures)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(*listenerRetryInterval):
+		}
+
+		var err error
+		l, err = bind()
+		if err != nil {
+			glog.Errorf("Rebinding statsd %s listener failed: %v", name, err)
+			l = nil
+		} else {
+			glog.Infof("Restarted statsd %s", name)
 		}
 	}
 }
@@ -75,14 +137,17 @@ func watchElasticTemplateConfig(filename string, client *elastic.Client) {
 		glog.Fatal(err)
 	}
 
-	err = watcher.WatchFlags(filename, fsnotify.FSN_MODIFY)
+	err = watcher.Add(filename)
 	if err != nil {
 		glog.Fatal(err)
 	}
 
 	for {
 		select {
-		case ev := <-watcher.Event:
+		case ev := <-watcher.Events:
+			if ev.Op == fsnotify.Chmod {
+				continue
+			}
 			glog.Infof("Template file changed (%s), attempting to update template", ev)
 			err = putIndexTemplate(filename, client)
 			if err != nil {
@@ -95,8 +160,8 @@ func watchElasticTemplateConfig(filename string, client *elastic.Client) {
 			// Re-add the file watcher since it can get lost on some changes. E.g.
 			// saving a file with vim results in a RENAME-MODIFY-DELETE event
 			// sequence, after which the newly written file is no longer watched.
-			_ = watcher.WatchFlags(filename, fsnotify.FSN_MODIFY)
-		case err := <-watcher.Error:
+			_ = watcher.Add(filename)
+		case err := <-watcher.Errors:
 			glog.Errorln("Error watching template file:", err)
 		}
 	}
@@ -166,43 +231,142 @@ func putIndexTemplate(filename string, client *elastic.Client) error {
 }
 
 func main() {
+	if len(os.Args) > 1 && (os.Args[1] == "mapping-check" || os.Args[1] == "mapping-test") {
+		os.Exit(mappingCheck(os.Args[2:]))
+	}
 	flag.Parse()
 
 	if *statsdListenUDP == "" && *statsdListenTCP == "" {
 		glog.Fatalln("At least one of UDP/TCP listeners must be specified.")
 	}
 
-	glog.Infoln("Starting StatsD -> ElasticSearch Exporter")
+	glog.Infof("Starting StatsD -> ElasticSearch Exporter (version %s)", version)
 	glog.Infof("Accepting StatsD Traffic: UDP %v, TCP %v", *statsdListenUDP, *statsdListenTCP)
+	glog.Infof("Accepting Prometheus Requests on %v", *listenAddress)
 
-	events := make(chan metrics.Events, 1024)
-	defer close(events)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-	if *statsdListenUDP != "" {
-		sul := statsd.NewStatsDUDPListener(*statsdListenUDP, *readBuffer)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		glog.Infof("Received %v, shutting down", sig)
+		cancel()
+	}()
 
-		defer sul.Close()
+	events, err := statsd.NewEventQueue(*eventQueueSize, statsd.QueuePolicy(*eventQueuePolicy))
+	if err != nil {
+		glog.Fatalf("Error creating event queue: %v", err)
+	}
+	prometheus.MustRegister(events)
+	var listeners sync.WaitGroup
+
+	var sources *statsd.SourceLabeler
+	if *listenerLabel != "" || *sourceIPLabel != "" || *sourceHostnameLabel != "" || *sourceTelemetry {
+		var err error
+		sources, err = statsd.NewSourceLabeler(statsd.SourceConfig{
+			ListenerLabel: *listenerLabel,
+			IPLabel:       *sourceIPLabel,
+			HostnameLabel: *sourceHostnameLabel,
+			HostnameTTL:   *sourceHostnameTTL,
+			Telemetry:     *sourceTelemetry,
+		})
+		if err != nil {
+			glog.Fatalf("Error configuring source labels: %v", err)
+		}
+	}
+
+	var limiter *statsd.RateLimiter
+	if *rateLimitConfig != "" {
+		var err error
+		limiter, err = statsd.LoadRateLimiter(*rateLimitConfig)
+		if err != nil {
+			glog.Fatalf("Error loading rate limit config: %v", err)
+		}
+	}
+
+	if *statsdListenUDP != "" {
+		bindUDP := func() (statsd.Listener, error) {
+			return statsd.NewStatsDUDPListener(*statsdListenUDP, statsd.UDPConfig{
+				Name:       "udp",
+				Sources:    sources,
+				Limiter:    limiter,
+				ReadBuffer: *readBuffer,
+				Readers:    *udpReaders,
+				ReusePort:  *udpReusePort,
+				BatchSize:  *udpBatchSize,
+			})
+		}
+		sul, err := bindUDP()
+		if err != nil {
+			glog.Fatalf("Error starting statsd udp: %v", err)
+		}
 
-		go sul.Listen(events)
+		listeners.Add(1)
+		go func() {
+			defer listeners.Done()
+			runListener(ctx, "udp", sul, bindUDP, events)
+		}()
 		glog.V(10).Infoln("Started statsd udp")
 	}
 
 	if *statsdListenTCP != "" {
-		stl := statsd.NewStatsDTCPListener(*statsdListenTCP)
-
-		defer stl.Close()
+		bindTCP := func() (statsd.Listener, error) {
+			return statsd.NewStatsDTCPListener(*statsdListenTCP, statsd.TCPConfig{
+				Name:            "tcp",
+				Sources:         sources,
+				Limiter:         limiter,
+				MaxConnections:  *tcpMaxConnections,
+				IdleTimeout:     *tcpIdleTimeout,
+				ReadTimeout:     *tcpReadTimeout,
+				MaxLineLength:   *tcpMaxLineLength,
+				KeepAlive:       *tcpKeepAlive,
+				KeepAlivePeriod: *tcpKeepAlivePeriod,
+			})
+		}
+		stl, err := bindTCP()
+		if err != nil {
+			glog.Fatalf("Error starting statsd tcp: %v", err)
+		}
 
-		go stl.Listen(events)
+		listeners.Add(1)
+		go func() {
+			defer listeners.Done()
+			runListener(ctx, "tcp", stl, bindTCP, events)
+		}()
 		glog.V(10).Infoln("Started statsd tcp")
 	}
 
+	// The exporter drains events until every listener has stopped.
+	go func() {
+		listeners.Wait()
+		events.Close()
+	}()
+
 	mapper := &mappings.MetricMapper{}
+	mapper.InitCache(*mappingCacheSize)
+	prometheus.MustRegister(mappingHitsCollector{mapper})
+	var reloader *mappingReloader
 	if *mappingConfig != "" {
 		err := mapper.InitFromFile(*mappingConfig)
 		if err != nil {
 			glog.Fatal("Error loading config:", err)
 		}
-		go watchMappingConfig(*mappingConfig, mapper)
+		reloader = &mappingReloader{path: *mappingConfig, mapper: mapper}
+		reloader.loaded()
+		go reloader.watch(*mappingCheckInterval)
+	} else {
+		signal.Ignore(syscall.SIGHUP)
+	}
+
+	var schema *documentSchema
+	if *elasticDocumentConfig != "" {
+		var err error
+		schema, err = loadDocumentSchema(*elasticDocumentConfig)
+		if err != nil {
+			glog.Fatalf("Error loading document config: %v", err)
+		}
 	}
 
 	glog.V(100).Infoln("Creating elastic client")
@@ -218,6 +382,37 @@ func main() {
 		go watchElasticTemplateConfig(*elasticIndexTemplate, elasticClient)
 	}
 
-	exporter := NewExporter(mapper, elasticBulkProcessor, *elasticIndex)
-	exporter.Listen(events)
+	exporter := NewExporter(mapper, elasticBulkProcessor, *elasticIndex, schema, *flushInterval, *exporterWorkers)
+	prometheus.MustRegister(exporter)
+
+	if *snapshotPath != "" {
+		restored, err := exporter.RestoreSnapshot(*snapshotPath)
+		if err != nil {
+			glog.Errorf("Error restoring snapshot, starting without state: %v", err)
+		} else {
+			glog.Infof("Restored %d series from snapshot %s", restored, *snapshotPath)
+		}
+		if *snapshotInterval > 0 {
+			go func() {
+				ticker := time.NewTicker(*snapshotInterval)
+				defer ticker.Stop()
+				for {
+					select {
+					case <-ticker.C:
+						exporter.saveSnapshot(*snapshotPath)
+					case <-ctx.Done():
+						return
+					}
+				}
+			}()
+		}
+	}
+
+	go serveHTTP(*listenAddress, *metricsEndpoint, exporter, reloader)
+	exporter.Listen(events.Events())
+
+	// The last snapshot holds the state left after the final flush.
+	if *snapshotPath != "" {
+		exporter.saveSnapshot(*snapshotPath)
+	}
 }
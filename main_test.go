@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jvosantos/statsd_exporter/statsd"
+)
+
+// fakeListener returns err from Listen right away, as a listener that
+// stopped (nil) or failed.
+type fakeListener struct {
+	err    error
+	closed *int
+}
+
+func (l fakeListener) Listen(ctx context.Context, q *statsd.EventQueue) error {
+	return l.err
+}
+
+func (l fakeListener) Close() error {
+	*l.closed++
+	return nil
+}
+
+func TestRunListener(t *testing.T) {
+	*listenerRetryInterval = time.Millisecond
+	*listenerMaxRetries = 0
+	failed := errors.New("failed")
+
+	scenarios := []struct {
+		name string
+		// listens are the results of Listen on the initial listener and
+		// on every listener bound after it.
+		listens []error
+		// binds are the results of binding a listener again; nil binds
+		// the next listener of listens.
+		binds []error
+	}{
+		{
+			name:    "stopped",
+			listens: []error{nil},
+		},
+		{
+			name:    "restarted",
+			listens: []error{failed, failed, nil},
+			binds:   []error{nil, nil},
+		},
+		{
+			name:    "bind retried",
+			listens: []error{failed, nil},
+			binds:   []error{failed, failed, nil},
+		},
+	}
+
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			closed, listened, bound := 0, 0, 0
+			next := func() statsd.Listener {
+				l := fakeListener{err: s.listens[listened], closed: &closed}
+				listened++
+				return l
+			}
+			bind := func() (statsd.Listener, error) {
+				err := s.binds[bound]
+				bound++
+				if err != nil {
+					return nil, err
+				}
+				return next(), nil
+			}
+
+			runListener(context.Background(), "test", next(), bind, nil)
+			if listened != len(s.listens) || bound != len(s.binds) {
+				t.Fatalf("expected %d listeners and %d binds, got %d and %d", len(s.listens), len(s.binds), listened, bound)
+			}
+			if closed != listened {
+				t.Fatalf("expected %d listeners closed, got %d", listened, closed)
+			}
+		})
+	}
+}
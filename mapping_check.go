@@ -0,0 +1,171 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/jvosantos/statsd_exporter/mappings"
+	"github.com/jvosantos/statsd_exporter/metrics"
+	"github.com/jvosantos/statsd_exporter/statsd"
+	"gopkg.in/yaml.v2"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+)
+
+// mappingTestFile is a file of test cases for a mapping configuration.
+type mappingTestFile struct {
+	Tests []mappingTest `yaml:"tests"`
+}
+
+// mappingTest is a StatsD line and what its events are expected to be mapped
+// to. Empty expectations are not checked; labels, when given, must match the
+// labels of the events exactly.
+type mappingTest struct {
+	Line   string            `yaml:"line"`
+	Name   string            `yaml:"name"`
+	Labels map[string]string `yaml:"labels"`
+	Type   string            `yaml:"type"`
+	Action string            `yaml:"action"`
+}
+
+// mappingCheck implements the mapping-check subcommand: it reports problems
+// in a mapping configuration and runs the test cases of the files given as
+// arguments. It returns the exit code of the exporter.
+func mappingCheck(args []string) int {
+	flags := flag.NewFlagSet("mapping-check", flag.ContinueOnError)
+	config := flags.String("mapping-config", "mappings.yaml", "Metric mapping configuration file, directory of .yaml/.yml files, or glob.")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s mapping-check [-mapping-config path] [test file...]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	return checkMappings(os.Stdout, *config, flags.Args())
+}
+
+func checkMappings(out io.Writer, config string, testFiles []string) int {
+	mapper, problems, err := mappings.CheckFile(config)
+	if err != nil {
+		fmt.Fprintf(out, "ERROR %s: %v\n", config, err)
+		return 1
+	}
+
+	failed := false
+	for _, problem := range problems {
+		if problem.Warning {
+			fmt.Fprintf(out, "WARN  %s\n", problem.Message)
+		} else {
+			fmt.Fprintf(out, "ERROR %s\n", problem.Message)
+			failed = true
+		}
+	}
+
+	exporter := NewExporter(mapper, nil, "", nil, 0, 1)
+	passed, total := 0, 0
+	for _, fileName := range testFiles {
+		tests, err := loadMappingTests(fileName)
+		if err != nil {
+			fmt.Fprintf(out, "ERROR %s: %v\n", fileName, err)
+			failed = true
+			continue
+		}
+		for i, test := range tests {
+			total++
+			failures := exporter.runMappingTest(test)
+			if len(failures) == 0 {
+				passed++
+				fmt.Fprintf(out, "PASS  %s:%d %q\n", fileName, i+1, test.Line)
+				continue
+			}
+			failed = true
+			fmt.Fprintf(out, "FAIL  %s:%d %q\n", fileName, i+1, test.Line)
+			for _, failure := range failures {
+				fmt.Fprintf(out, "        %s\n", failure)
+			}
+		}
+	}
+
+	fmt.Fprintf(out, "%d mappings, %d problems, %d/%d tests passed\n", len(mapper.Mappings), len(problems), passed, total)
+	if failed {
+		return 1
+	}
+	return 0
+}
+
+func loadMappingTests(fileName string) ([]mappingTest, error) {
+	contents, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	var file mappingTestFile
+	if err := yaml.UnmarshalStrict(contents, &file); err != nil {
+		return nil, err
+	}
+	for i, test := range file.Tests {
+		switch test.Action {
+		case "", string(mappings.ActionTypeMap), string(mappings.ActionTypeDrop):
+		default:
+			return nil, fmt.Errorf("test %d: invalid action %q", i+1, test.Action)
+		}
+	}
+	return file.Tests, nil
+}
+
+// runMappingTest maps the events of the test's line and returns how they
+// differ from what the test expects.
+func (b *Exporter) runMappingTest(test mappingTest) []string {
+	events, rejected := statsd.ParseLine([]byte(test.Line))
+	if len(events) == 0 {
+		return []string{fmt.Sprintf("line has no valid events %v", rejected)}
+	}
+	defer metrics.ReleaseEvents(events)
+
+	var failures []string
+	for _, event := range events {
+		mapped := b.mapEvent(event)
+		action := string(mappings.ActionTypeMap)
+		if mapped == nil {
+			action = string(mappings.ActionTypeDrop)
+		}
+		if test.Action != "" && test.Action != action {
+			failures = append(failures, fmt.Sprintf("action: got %s, want %s", action, test.Action))
+		}
+		if mapped == nil {
+			continue
+		}
+		if test.Name != "" && test.Name != mapped.name {
+			failures = append(failures, fmt.Sprintf("name: got %s, want %s", mapped.name, test.Name))
+		}
+		if test.Type != "" && test.Type != mapped.metricType {
+			failures = append(failures, fmt.Sprintf("type: got %s, want %s", mapped.metricType, test.Type))
+		}
+		if test.Labels != nil && !sameLabels(mapped.labels, test.Labels) {
+			failures = append(failures, fmt.Sprintf("labels: got %s, want %s", formatLabels(mapped.labels), formatLabels(test.Labels)))
+		}
+	}
+	return failures
+}
+
+func sameLabels(got metrics.Labels, want map[string]string) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for label, value := range want {
+		if v, ok := got[label]; !ok || v != value {
+			return false
+		}
+	}
+	return true
+}
+
+func formatLabels(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for label, value := range labels {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", label, value))
+	}
+	sort.Strings(pairs)
+	return "{" + strings.Join(pairs, ", ") + "}"
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testCheckedMappings = `
+defaults:
+  timer_type: histogram
+mappings:
+- match: test.*.*
+  name: t_${1}
+  labels:
+    second: "$2"
+- match: drop.*
+  name: dropped
+  action: drop
+`
+
+func TestCheckMappings(t *testing.T) {
+	scenarios := []struct {
+		name  string
+		tests string
+		code  int
+		// output are lines expected in the output.
+		output []string
+	}{
+		{
+			name: "passing",
+			tests: `tests:
+- line: "test.aa.bb:1|c"
+  name: t_aa
+  labels: {second: bb}
+  type: counter
+- line: "test.aa.bb:1|ms"
+  type: histogram
+- line: "drop.aa:1|g"
+  action: drop
+`,
+			output: []string{
+				`PASS  tests.yaml:1 "test.aa.bb:1|c"`,
+				"2 mappings, 0 problems, 3/3 tests passed",
+			},
+		},
+		{
+			name: "failing",
+			tests: `tests:
+- line: "test.aa.bb:1|c"
+  name: t_bb
+  labels: {}
+- line: "drop.aa:1|g"
+  action: map
+- line: "garbage"
+`,
+			code: 1,
+			output: []string{
+				`FAIL  tests.yaml:1 "test.aa.bb:1|c"`,
+				"        name: got t_aa, want t_bb",
+				`        labels: got {second="bb"}, want {}`,
+				"        action: got drop, want map",
+				"        line has no valid events",
+				"2 mappings, 0 problems, 0/3 tests passed",
+			},
+		},
+		{
+			name:   "invalid test file",
+			tests:  "tests:\n- line: \"drop.aa:1|g\"\n  action: keep\n",
+			code:   1,
+			output: []string{"test 1: invalid action \"keep\""},
+		},
+	}
+
+	dir, err := ioutil.TempDir("", "mapping-check")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config := filepath.Join(dir, "mappings.yaml")
+	if err := ioutil.WriteFile(config, []byte(testCheckedMappings), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			tests := filepath.Join(dir, "tests.yaml")
+			if err := ioutil.WriteFile(tests, []byte(s.tests), 0644); err != nil {
+				t.Fatal(err)
+			}
+			var out bytes.Buffer
+			if code := checkMappings(&out, config, []string{tests}); code != s.code {
+				t.Errorf("expected exit code %d, got %d", s.code, code)
+			}
+			output := strings.Replace(out.String(), dir+string(filepath.Separator), "", -1)
+			for _, line := range s.output {
+				if !strings.Contains(output, line) {
+					t.Errorf("expected %q in output:\n%s", line, output)
+				}
+			}
+		})
+	}
+}
+
+// TestCheckShippedMappings makes sure the example configuration passes the
+// checks it is documented with.
+func TestCheckShippedMappings(t *testing.T) {
+	var out bytes.Buffer
+	if code := checkMappings(&out, "mappings.yaml", nil); code != 0 {
+		t.Errorf("expected exit code 0, got %d:\n%s", code, out.String())
+	}
+}
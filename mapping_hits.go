@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/jvosantos/statsd_exporter/mappings"
+	"github.com/prometheus/client_golang/prometheus"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// mappingHitsCollector exposes how often each mapping matched.
+type mappingHitsCollector struct {
+	mapper *mappings.MetricMapper
+}
+
+func (c mappingHitsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- mappingHitsDesc
+	ch <- unmappedHitsDesc
+	ch <- mappingHitsSinceDesc
+}
+
+func (c mappingHitsCollector) Collect(ch chan<- prometheus.Metric) {
+	report := c.mapper.Hits()
+	if report.Since.IsZero() {
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(mappingHitsSinceDesc, prometheus.GaugeValue, float64(report.Since.UnixNano())/1e9)
+	for _, mapping := range report.Mappings {
+		ch <- prometheus.MustNewConstMetric(mappingHitsDesc, prometheus.CounterValue, float64(mapping.Hits),
+			strconv.Itoa(mapping.Index), mapping.Match, mapping.SourceFile)
+	}
+	for prefix, hits := range report.Unmapped {
+		ch <- prometheus.MustNewConstMetric(unmappedHitsDesc, prometheus.CounterValue, float64(hits), prefix)
+	}
+}
+
+// unusedMappingsHandler serves the mappings that matched no event since the
+// configuration was loaded.
+func unusedMappingsHandler(mapper *mappings.MetricMapper) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		report := mapper.Hits()
+		unused := []mappings.MappingHits{}
+		for _, mapping := range report.Mappings {
+			if mapping.Hits == 0 {
+				unused = append(unused, mapping)
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(struct {
+			Since    time.Time              `json:"since"`
+			Mappings int                    `json:"mappings"`
+			Unused   []mappings.MappingHits `json:"unused"`
+			Unmapped map[string]uint64      `json:"unmapped"`
+		}{report.Since, len(report.Mappings), unused, report.Unmapped})
+	}
+}
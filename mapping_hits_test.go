@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/jvosantos/statsd_exporter/mappings"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const testHitMappings = `
+mappings:
+- match: aa.*
+  name: aa
+- match: bb.*
+  name: bb
+`
+
+func newHitMapper(t *testing.T, metrics ...string) *mappings.MetricMapper {
+	mapper := &mappings.MetricMapper{}
+	if err := mapper.InitFromYAMLString(testHitMappings); err != nil {
+		t.Fatal(err)
+	}
+	for _, metric := range metrics {
+		mapper.GetMapping(metric, "counter", nil)
+	}
+	return mapper
+}
+
+func TestMappingHitsCollector(t *testing.T) {
+	registry := prometheus.NewPedanticRegistry()
+	registry.MustRegister(mappingHitsCollector{newHitMapper(t, "aa.x", "aa.y", "zz.x")})
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := map[string]float64{}
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			name := family.GetName()
+			for _, label := range metric.GetLabel() {
+				name += " " + label.GetName() + "=" + label.GetValue()
+			}
+			got[name] = metric.GetCounter().GetValue() + metric.GetGauge().GetValue()
+		}
+	}
+	if got["statsd_exporter_mapping_hits_since_timestamp_seconds"] == 0 {
+		t.Errorf("expected the time hits are counted since, got %v", got)
+	}
+	delete(got, "statsd_exporter_mapping_hits_since_timestamp_seconds")
+	expected := map[string]float64{
+		"statsd_exporter_mapping_hits_total index=0 match=aa.* source_file=": 2,
+		"statsd_exporter_mapping_hits_total index=1 match=bb.* source_file=": 0,
+		"statsd_exporter_unmapped_hits_total prefix=zz":                      1,
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+}
+
+func TestUnusedMappingsHandler(t *testing.T) {
+	scenarios := []struct {
+		name    string
+		metrics []string
+		unused  []string
+	}{
+		{name: "all unused", unused: []string{"aa.*", "bb.*"}},
+		{name: "one used", metrics: []string{"bb.x", "zz.x"}, unused: []string{"aa.*"}},
+		{name: "all used", metrics: []string{"aa.x", "bb.x"}, unused: []string{}},
+	}
+
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			unusedMappingsHandler(newHitMapper(t, s.metrics...))(w, httptest.NewRequest("GET", "/mappings/unused", nil))
+			var response struct {
+				Mappings int                    `json:"mappings"`
+				Unused   []mappings.MappingHits `json:"unused"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+				t.Fatal(err)
+			}
+			unused := []string{}
+			for _, mapping := range response.Unused {
+				unused = append(unused, mapping.Match)
+			}
+			if response.Mappings != 2 || !reflect.DeepEqual(unused, s.unused) {
+				t.Errorf("expected unused %v of 2 mappings, got %v of %d", s.unused, unused, response.Mappings)
+			}
+		})
+	}
+}
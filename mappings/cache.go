@@ -0,0 +1,117 @@
+// Copyright 2013 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mappings
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/jvosantos/statsd_exporter/metrics"
+)
+
+// cacheShards is the number of independently locked LRU lists a mappingCache
+// is split into.
+const cacheShards = 16
+
+type cacheKey struct {
+	metricName string
+	metricType metrics.MetricType
+	// labelValues joins the values of the labels match_labels look at.
+	labelValues string
+}
+
+// mappingResult is a GetMapping result. Its mapping and labels are shared by
+// every lookup of the same metric and must not be modified.
+type mappingResult struct {
+	mapping *MetricMapping
+	labels  metrics.Labels
+	present bool
+	// err is set when the templates of the matching mapping failed, and
+	// mapping and labels are then nil.
+	err error
+	// index is the position of the matching mapping in the configuration.
+	index int
+}
+
+type cacheEntry struct {
+	key    cacheKey
+	result mappingResult
+}
+
+// mappingCache is a sharded LRU cache of GetMapping results. It belongs to
+// one configuration and is replaced with it on reload.
+type mappingCache struct {
+	shards [cacheShards]cacheShard
+}
+
+type cacheShard struct {
+	sync.Mutex
+	size    int
+	entries map[cacheKey]*list.Element
+	lru     *list.List
+}
+
+func newMappingCache(size int) *mappingCache {
+	c := &mappingCache{}
+	shardSize := (size + cacheShards - 1) / cacheShards
+	for i := range c.shards {
+		c.shards[i] = cacheShard{
+			size:    shardSize,
+			entries: make(map[cacheKey]*list.Element),
+			lru:     list.New(),
+		}
+	}
+	return c
+}
+
+func (c *mappingCache) shard(key cacheKey) *cacheShard {
+	// fnv32a of the metric name; the type rarely tells metrics apart.
+	h := uint32(2166136261)
+	for i := 0; i < len(key.metricName); i++ {
+		h ^= uint32(key.metricName[i])
+		h *= 16777619
+	}
+	return &c.shards[h%cacheShards]
+}
+
+func (c *mappingCache) get(key cacheKey) (mappingResult, bool) {
+	s := c.shard(key)
+	s.Lock()
+	defer s.Unlock()
+
+	element, ok := s.entries[key]
+	if !ok {
+		return mappingResult{}, false
+	}
+	s.lru.MoveToFront(element)
+	return element.Value.(*cacheEntry).result, true
+}
+
+func (c *mappingCache) add(key cacheKey, result mappingResult) {
+	s := c.shard(key)
+	s.Lock()
+	defer s.Unlock()
+
+	if element, ok := s.entries[key]; ok {
+		s.lru.MoveToFront(element)
+		element.Value.(*cacheEntry).result = result
+		return
+	}
+	if s.lru.Len() >= s.size {
+		oldest := s.lru.Back()
+		s.lru.Remove(oldest)
+		delete(s.entries, oldest.Value.(*cacheEntry).key)
+	}
+	s.entries[key] = s.lru.PushFront(&cacheEntry{key: key, result: result})
+}
@@ -0,0 +1,168 @@
+// Copyright 2013 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mappings
+
+import (
+	"fmt"
+	"regexp/syntax"
+	"strings"
+	"unicode"
+
+	"github.com/jvosantos/statsd_exporter/metrics"
+)
+
+// Problem is an issue CheckFile found in a mapping configuration. Warnings
+// are suggestions; anything else makes the configuration fail the check.
+type Problem struct {
+	Warning bool
+	Message string
+}
+
+// probeComponents replace the wildcards of a glob to build the metric names
+// used to tell whether a mapping can be reached.
+var probeComponents = []string{"zz_probe_7", "Probe-Q", "p"}
+
+var metricTypes = []metrics.MetricType{"counter", "gauge", "timer"}
+
+// CheckFile loads the configuration at path like InitFromFile, but reports
+// every conflict between mappings instead of failing on the first. It also
+// reports mappings that no metric can reach and regex mappings that could be
+// globs. The error is only set if the configuration cannot be loaded at all.
+func CheckFile(path string) (*MetricMapper, []Problem, error) {
+	n, err := newConfigLoader().load(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	m := &MetricMapper{}
+	if err := m.init(n, false); err != nil {
+		return nil, nil, err
+	}
+
+	var problems []Problem
+	for i := range m.Mappings {
+		mapping := &m.Mappings[i]
+		if err := conflict(m.Mappings, i); err != nil {
+			problems = append(problems, Problem{Message: err.Error()})
+			continue
+		}
+		glob := mapping.Match
+		if mapping.MatchType == matchTypeRegex {
+			var exact, ok bool
+			glob, exact, ok = regexAsGlob(mapping.Match, mapping.regex.NumSubexp())
+			if !ok {
+				continue
+			}
+			message := fmt.Sprintf("regex mapping %s%s could be the glob %s", mapping.Match, sourceSuffix(mapping), glob)
+			if !exact {
+				message += ", whose * also matches empty components"
+			}
+			problems = append(problems, Problem{Warning: true, Message: message})
+		}
+		if by, ok := m.shadowedBy(i, glob); ok {
+			shadow := &m.Mappings[by]
+			problems = append(problems, Problem{
+				Message: fmt.Sprintf("mapping %s%s is unreachable, metrics it matches are taken by mapping %s%s", mapping.Match, sourceSuffix(mapping), shadow.Match, sourceSuffix(shadow)),
+			})
+		}
+	}
+	return m, problems, nil
+}
+
+// shadowedBy probes the i-th mapping with names built from glob, for every
+// metric type it accepts. If every probe it matches is taken by earlier
+// mappings, it returns the first of them.
+func (m *MetricMapper) shadowedBy(i int, glob string) (int, bool) {
+	mapping := &m.Mappings[i]
+	labels := metrics.Labels{}
+	for _, matcher := range mapping.MatchLabels {
+		if matcher.regex != nil {
+			// Values matching a regex can't be made up reliably.
+			return 0, false
+		}
+		labels[matcher.Label] = matcher.Value
+	}
+	types := metricTypes
+	if mapping.MatchMetricType != "" {
+		types = []metrics.MetricType{mapping.MatchMetricType}
+	}
+
+	by := -1
+	for _, probe := range probeComponents {
+		name := strings.Replace(glob, "*", probe, -1)
+		if !mapping.regex.MatchString(name) {
+			continue
+		}
+		for _, t := range types {
+			result := m.match(name, t, labels)
+			if !result.present {
+				return 0, false
+			}
+			j := result.index
+			if j >= i {
+				return 0, false
+			}
+			if by < 0 {
+				by = j
+			}
+		}
+	}
+	return by, by >= 0
+}
+
+// regexAsGlob returns the glob a regex is equivalent to: one anchored with
+// ^ and $, made of literal components separated by escaped dots and of
+// ([^.]*) or ([^.]+) groups each spanning a whole component. As the *
+// of globs matches empty components, the glob only matches the same names
+// as the regex, and exact is only set, if all groups are ([^.]*). Other
+// regexes match names no glob does, so they get no suggestion.
+func regexAsGlob(expr string, captures int) (glob string, exact bool, ok bool) {
+	re, err := syntax.Parse(expr, syntax.Perl)
+	if err != nil || re.Op != syntax.OpConcat {
+		return "", false, false
+	}
+	nodes := re.Sub
+	if len(nodes) < 2 || nodes[0].Op != syntax.OpBeginText || nodes[len(nodes)-1].Op != syntax.OpEndText {
+		return "", false, false
+	}
+
+	var b strings.Builder
+	wildcards := 0
+	exact = true
+	for _, node := range nodes[1 : len(nodes)-1] {
+		switch {
+		case node.Op == syntax.OpLiteral && node.Flags&syntax.FoldCase == 0:
+			b.WriteString(string(node.Rune))
+		case node.Op == syntax.OpCapture && isComponentGroup(node.Sub[0]):
+			b.WriteByte('*')
+			wildcards++
+			exact = exact && node.Sub[0].Op == syntax.OpStar
+		default:
+			return "", false, false
+		}
+	}
+	if wildcards != captures || !metricLineRE.MatchString(b.String()) {
+		return "", false, false
+	}
+	return b.String(), exact, true
+}
+
+// isComponentGroup reports whether re is [^.]* or [^.]+, characters other
+// than a dot.
+func isComponentGroup(re *syntax.Regexp) bool {
+	if (re.Op != syntax.OpStar && re.Op != syntax.OpPlus) || re.Sub[0].Op != syntax.OpCharClass {
+		return false
+	}
+	class := re.Sub[0].Rune
+	return len(class) == 4 && class[0] == 0 && class[1] == '.'-1 && class[2] == '.'+1 && class[3] == unicode.MaxRune
+}
@@ -0,0 +1,132 @@
+// Copyright 2013 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mappings
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRegexAsGlob(t *testing.T) {
+	scenarios := []struct {
+		expr     string
+		captures int
+		// glob is empty if the regex has no equivalent glob.
+		glob  string
+		exact bool
+	}{
+		{expr: `^api\.([^.]+)\.requests$`, captures: 1, glob: "api.*.requests"},
+		{expr: `^api\.([^.]*)\.requests$`, captures: 1, glob: "api.*.requests", exact: true},
+		{expr: `^api\.([^.]*)\.([^.]+)$`, captures: 2, glob: "api.*.*"},
+		{expr: `^api\.requests$`, glob: "api.requests", exact: true},
+		{expr: `api\.([^.]+)\.requests$`, captures: 1},
+		{expr: `^api\.([^.]+)\.requests`, captures: 1},
+		{expr: `^api.([^.]+).requests$`, captures: 1},
+		{expr: `^api\.(.+)\.requests$`, captures: 1},
+		{expr: `^api\.(\w+)\.requests$`, captures: 1},
+		{expr: `^api\.(?:[^.]+)\.requests$`},
+		{expr: `^api\.x([^.]+)$`, captures: 1},
+		{expr: `(?i)^api\.requests$`},
+		{expr: `(?m)^api\.requests$`},
+	}
+
+	for _, s := range scenarios {
+		glob, exact, ok := regexAsGlob(s.expr, s.captures)
+		if glob != s.glob || ok != (s.glob != "") || exact != s.exact {
+			t.Errorf("%s: expected %q (exact %v), got %q (exact %v, ok %v)", s.expr, s.glob, s.exact, glob, exact, ok)
+		}
+	}
+}
+
+func TestCheckFile(t *testing.T) {
+	scenarios := []struct {
+		name     string
+		mappings string
+		// problems are prefixes of the messages of the problems found,
+		// errors led by "ERROR " and warnings by "WARN ".
+		problems []string
+	}{
+		{
+			name:     "no problems",
+			mappings: "- match: aa.*\n  name: aa\n- match: bb.*\n  name: bb\n",
+		},
+		{
+			name:     "every conflict",
+			mappings: "- match: aa.*\n  name: aa\n- match: aa.bb\n  name: bb\n- match: aa.cc\n  name: cc\n",
+			problems: []string{
+				"ERROR mapping aa.bb (",
+				"ERROR mapping aa.cc (",
+			},
+		},
+		{
+			name:     "unreachable by type",
+			mappings: "- match: aa.*\n  name: aa\n  match_metric_type: counter\n- match: aa.*\n  name: aa_any\n- match: aa.bb\n  name: bb\n  match_metric_type: gauge\n",
+			problems: []string{
+				"ERROR mapping aa.bb (",
+			},
+		},
+		{
+			name:     "regex as glob",
+			mappings: "- match: '^aa\\.([^.]*)$'\n  match_type: regex\n  name: aa\n- match: '^bb\\.([^.]+)$'\n  match_type: regex\n  name: bb\n- match: 'cc\\.(.*)'\n  match_type: regex\n  name: cc\n",
+			problems: []string{
+				"WARN regex mapping ^aa\\.([^.]*)$ (",
+				"WARN regex mapping ^bb\\.([^.]+)$ (",
+			},
+		},
+		{
+			name:     "regex shadowed by glob",
+			mappings: "- match: aa.*\n  name: aa\n- match: '^aa\\.([^.]+)$'\n  match_type: regex\n  name: bb\n",
+			problems: []string{
+				"WARN regex mapping ^aa\\.([^.]+)$ (",
+				"ERROR mapping ^aa\\.([^.]+)$ (",
+			},
+		},
+	}
+
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			dir := writeConfigFiles(t, map[string]string{"mappings.yaml": "mappings:\n" + s.mappings})
+			defer os.RemoveAll(dir)
+			mapper, problems, err := CheckFile(filepath.Join(dir, "mappings.yaml"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if mapper == nil || len(mapper.Mappings) == 0 {
+				t.Fatalf("expected the mappings to be loaded, got %v", mapper)
+			}
+			if len(problems) != len(s.problems) {
+				t.Fatalf("expected %d problems, got %+v", len(s.problems), problems)
+			}
+			for i, problem := range problems {
+				message := "ERROR " + problem.Message
+				if problem.Warning {
+					message = "WARN " + problem.Message
+				}
+				if !strings.HasPrefix(message, s.problems[i]) {
+					t.Errorf("expected problem %q, got %q", s.problems[i], message)
+				}
+			}
+		})
+	}
+}
+
+func TestCheckFileErrors(t *testing.T) {
+	dir := writeConfigFiles(t, map[string]string{"mappings.yaml": "mappings:\n- match: aa.*\n"})
+	defer os.RemoveAll(dir)
+	if _, _, err := CheckFile(filepath.Join(dir, "mappings.yaml")); err == nil {
+		t.Error("expected an error for a configuration that doesn't load")
+	}
+}
@@ -0,0 +1,48 @@
+// Copyright 2013 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mappings
+
+import "fmt"
+
+// counterMode is how counters are written to Elasticsearch.
+type counterMode string
+
+const (
+	// CounterModeRaw indexes every counter event as it arrives.
+	CounterModeRaw counterMode = "raw"
+	// CounterModeDelta indexes the increase of every series since the
+	// previous flush, if any.
+	CounterModeDelta counterMode = "delta"
+	// CounterModeCumulative indexes the total of every series on each flush.
+	CounterModeCumulative counterMode = "cumulative"
+	// CounterModeRate indexes the per-second increase of every series since
+	// the previous flush, if any, together with the increase itself.
+	CounterModeRate    counterMode = "rate"
+	CounterModeDefault counterMode = ""
+)
+
+func (m *counterMode) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var v string
+	if err := unmarshal(&v); err != nil {
+		return err
+	}
+
+	switch counterMode(v) {
+	case CounterModeRaw, CounterModeDelta, CounterModeCumulative, CounterModeRate, CounterModeDefault:
+		*m = counterMode(v)
+	default:
+		return fmt.Errorf("invalid counter mode '%s'", v)
+	}
+	return nil
+}
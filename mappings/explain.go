@@ -0,0 +1,65 @@
+// Copyright 2013 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mappings
+
+import (
+	"github.com/jvosantos/statsd_exporter/metrics"
+)
+
+// Explanation tells which mapping GetMapping applies to a metric and why.
+type Explanation struct {
+	// Index is the position of the mapping in the configuration, or -1 if
+	// no mapping matches.
+	Index      int    `json:"index"`
+	SourceFile string `json:"sourceFile,omitempty"`
+	Match      string `json:"match,omitempty"`
+	MatchType  string `json:"matchType,omitempty"`
+	// Captures are the submatches of the mapping's match, the whole metric
+	// name first.
+	Captures []string `json:"captures,omitempty"`
+	// Name and Labels are the expanded name and labels of the mapping.
+	Name   string         `json:"name,omitempty"`
+	Labels metrics.Labels `json:"labels,omitempty"`
+	Action string         `json:"action"`
+	// Error is set when the templates of the mapping failed.
+	Error string `json:"error,omitempty"`
+}
+
+// Explain looks up the mapping of a metric like GetMapping, bypassing the
+// cache, and describes the result.
+func (m *MetricMapper) Explain(statsdMetric string, statsdMetricType metrics.MetricType, eventLabels metrics.Labels) Explanation {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	result := m.match(statsdMetric, statsdMetricType, eventLabels)
+	if !result.present {
+		return Explanation{Index: -1, Action: string(ActionTypeMap)}
+	}
+	mapping := &m.Mappings[result.index]
+	explanation := Explanation{
+		Index:      result.index,
+		SourceFile: mapping.SourceFile,
+		Match:      mapping.Match,
+		MatchType:  string(mapping.MatchType),
+		Captures:   mapping.regex.FindStringSubmatch(statsdMetric),
+		Action:     string(mapping.Action),
+	}
+	if result.err != nil {
+		explanation.Error = result.err.Error()
+		return explanation
+	}
+	explanation.Name = result.mapping.Name
+	explanation.Labels = result.labels
+	return explanation
+}
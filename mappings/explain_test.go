@@ -0,0 +1,120 @@
+// Copyright 2013 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mappings
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/jvosantos/statsd_exporter/metrics"
+)
+
+const testExplainMappings = `
+mappings:
+- match: svc.*.*
+  name: svc_${2}
+  labels:
+    svc: "$1"
+- match: '^rx\.(\w+)$'
+  match_type: regex
+  name: rx
+- match: drop.*
+  name: dropped
+  action: drop
+- match: env.*
+  name: '{{ .Labels.env }}'
+`
+
+func TestExplain(t *testing.T) {
+	scenarios := []struct {
+		name     string
+		metric   string
+		labels   metrics.Labels
+		expected Explanation
+	}{
+		{
+			name:   "glob",
+			metric: "svc.api.requests",
+			expected: Explanation{
+				Match:     "svc.*.*",
+				MatchType: "glob",
+				Captures:  []string{"svc.api.requests", "api", "requests"},
+				Name:      "svc_requests",
+				Labels:    metrics.Labels{"svc": "api"},
+				Action:    "map",
+			},
+		},
+		{
+			name:   "regex",
+			metric: "rx.abc",
+			expected: Explanation{
+				Index:     1,
+				Match:     `^rx\.(\w+)$`,
+				MatchType: "regex",
+				Captures:  []string{"rx.abc", "abc"},
+				Name:      "rx",
+				Labels:    metrics.Labels{},
+				Action:    "map",
+			},
+		},
+		{
+			name:   "drop",
+			metric: "drop.abc",
+			expected: Explanation{
+				Index:     2,
+				Match:     "drop.*",
+				MatchType: "glob",
+				Captures:  []string{"drop.abc", "abc"},
+				Name:      "dropped",
+				Labels:    metrics.Labels{},
+				Action:    "drop",
+			},
+		},
+		{
+			name:   "template error",
+			metric: "env.abc",
+			expected: Explanation{
+				Index:     3,
+				Match:     "env.*",
+				MatchType: "glob",
+				Captures:  []string{"env.abc", "abc"},
+				Action:    "map",
+				Error:     `template of mapping "env.*" gave env.abc an empty name`,
+			},
+		},
+		{
+			name:     "unmapped",
+			metric:   "other.abc",
+			expected: Explanation{Index: -1, Action: "map"},
+		},
+	}
+
+	mapper := &MetricMapper{}
+	mapper.InitCache(1000)
+	if err := mapper.InitFromYAMLString(testExplainMappings); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			explanation := mapper.Explain(s.metric, "counter", s.labels)
+			if !reflect.DeepEqual(explanation, s.expected) {
+				t.Errorf("expected %+v, got %+v", s.expected, explanation)
+			}
+			mapper.LookupMapping(s.metric, "counter", s.labels)
+			if _, ok := mapper.cache.get(cacheKey{metricName: s.metric, metricType: "counter"}); ok {
+				t.Errorf("expected %s not to be cached", s.metric)
+			}
+		})
+	}
+}
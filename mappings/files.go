@@ -0,0 +1,231 @@
+// Copyright 2013 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mappings
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// configFile is the content of one mapping configuration file.
+type configFile struct {
+	Defaults *mapperConfigDefaults `yaml:"defaults"`
+	Mappings []MetricMapping       `yaml:"mappings"`
+	// Include lists further files, directories or globs to load, relative to
+	// the directory of the including file.
+	Include  []string              `yaml:"include"`
+}
+
+// configLoader merges configuration files into one configuration. A file's
+// own mappings come first, followed by those of its includes in the order
+// they are listed. Directories and globs expand to their files in lexical
+// order.
+type configLoader struct {
+	config   MetricMapper
+	defaults string
+	loaded   map[string]bool
+	// hash covers the names and contents of the files in the order they
+	// are loaded.
+	hash     hash.Hash
+}
+
+func newConfigLoader() *configLoader {
+	return &configLoader{loaded: make(map[string]bool), hash: sha256.New()}
+}
+
+// load loads the configuration at path and returns it, with the hash of
+// the files it was loaded from.
+func (l *configLoader) load(path string) (*MetricMapper, error) {
+	if err := l.loadPath(path); err != nil {
+		return nil, err
+	}
+	l.config.hash = hex.EncodeToString(l.hash.Sum(nil))
+	return &l.config, nil
+}
+
+// expandConfigPath returns the configuration files path refers to: the file
+// itself, the .yaml and .yml files of a directory, or the matches of a glob.
+func expandConfigPath(path string) ([]string, error) {
+	if info, err := os.Stat(path); err == nil {
+		if !info.IsDir() {
+			return []string{path}, nil
+		}
+		var files []string
+		for _, pattern := range []string{"*.yaml", "*.yml"} {
+			matches, err := filepath.Glob(filepath.Join(path, pattern))
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, matches...)
+		}
+		sort.Strings(files)
+		return files, nil
+	} else if !strings.ContainsAny(path, "*?[") {
+		return nil, err
+	}
+
+	files, err := filepath.Glob(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no mapping configuration files match %s", path)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+func (l *configLoader) loadPath(path string) error {
+	files, err := expandConfigPath(path)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if err := l.loadFile(file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *configLoader) loadFile(fileName string) error {
+	key, err := filepath.Abs(fileName)
+	if err != nil {
+		return err
+	}
+	if l.loaded[key] {
+		return fmt.Errorf("%s: mapping configuration file loaded more than once", fileName)
+	}
+	l.loaded[key] = true
+	l.config.files = append(l.config.files, fileName)
+
+	content, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return err
+	}
+	l.hash.Write([]byte(fileName))
+	l.hash.Write([]byte{0})
+	l.hash.Write(content)
+	l.hash.Write([]byte{0})
+	var file configFile
+	if err := yaml.Unmarshal(content, &file); err != nil {
+		return fmt.Errorf("%s: %v", fileName, err)
+	}
+
+	if file.Defaults != nil {
+		if l.defaults != "" {
+			return fmt.Errorf("%s: defaults are already set in %s", fileName, l.defaults)
+		}
+		l.defaults = fileName
+		l.config.Defaults = *file.Defaults
+	}
+	for i := range file.Mappings {
+		file.Mappings[i].SourceFile = fileName
+	}
+	l.config.Mappings = append(l.config.Mappings, file.Mappings...)
+
+	for _, include := range file.Include {
+		if !filepath.IsAbs(include) {
+			include = filepath.Join(filepath.Dir(fileName), include)
+		}
+		if err := l.loadPath(include); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkConflicts returns an error for every mapping that duplicates, or is
+// shadowed by, an earlier one. A glob mapping is shadowed when an earlier
+// glob matches every name it matches, with no stricter metric type or label
+// constraints. Regex mappings are only compared for duplicates.
+func checkConflicts(mappings []MetricMapping) []error {
+	var conflicts []error
+	for j := range mappings {
+		if err := conflict(mappings, j); err != nil {
+			conflicts = append(conflicts, err)
+		}
+	}
+	return conflicts
+}
+
+// conflict returns an error if the j-th mapping duplicates or is shadowed by
+// an earlier one.
+func conflict(mappings []MetricMapping, j int) error {
+	later := &mappings[j]
+	for i := 0; i < j; i++ {
+		earlier := &mappings[i]
+		if !sameConstraints(earlier, later) {
+			continue
+		}
+		if earlier.MatchType == later.MatchType && earlier.Match == later.Match {
+			return fmt.Errorf("mapping %s%s duplicates mapping %s%s", later.Match, sourceSuffix(later), earlier.Match, sourceSuffix(earlier))
+		}
+		if earlier.MatchType == matchTypeGlob && later.MatchType == matchTypeGlob && globCovers(earlier.Match, later.Match) {
+			return fmt.Errorf("mapping %s%s is shadowed by mapping %s%s", later.Match, sourceSuffix(later), earlier.Match, sourceSuffix(earlier))
+		}
+	}
+	return nil
+}
+
+// sameConstraints reports whether every event of later's metric type and
+// labels also satisfies earlier's constraints.
+func sameConstraints(earlier, later *MetricMapping) bool {
+	if earlier.MatchMetricType != "" && earlier.MatchMetricType != later.MatchMetricType {
+		return false
+	}
+	if len(earlier.MatchLabels) == 0 {
+		return true
+	}
+	if len(earlier.MatchLabels) != len(later.MatchLabels) {
+		return false
+	}
+	for k := range earlier.MatchLabels {
+		a, b := earlier.MatchLabels[k], later.MatchLabels[k]
+		if a.Label != b.Label || a.Value != b.Value || a.Regex != b.Regex {
+			return false
+		}
+	}
+	return true
+}
+
+// globCovers reports whether glob a matches every name glob b matches.
+func globCovers(a, b string) bool {
+	ac, bc := strings.Split(a, "."), strings.Split(b, ".")
+	if len(ac) != len(bc) {
+		return false
+	}
+	for k := range ac {
+		if ac[k] != "*" && ac[k] != bc[k] {
+			return false
+		}
+	}
+	return true
+}
+
+func sourceSuffix(m *MetricMapping) string {
+	if m.SourceFile == "" {
+		return ""
+	}
+	return " (" + m.SourceFile + ")"
+}
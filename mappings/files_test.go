@@ -0,0 +1,209 @@
+// Copyright 2013 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mappings
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeConfigFiles writes files, by path relative to a new temporary
+// directory, and returns the directory.
+func writeConfigFiles(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "mappings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestInitFromFile(t *testing.T) {
+	files := map[string]string{
+		"conf.d/10-main.yaml": "defaults:\n  timer_type: histogram\nmappings:\n- match: aa.*\n  name: aa\ninclude:\n- ../extra/*.yml\n",
+		"conf.d/20-team.yml":  "mappings:\n- match: bb.*\n  name: bb\n",
+		"conf.d/README.md":    "not a configuration file",
+		"extra/x.yml":         "mappings:\n- match: cc.*\n  name: cc\n",
+		"single.yaml":         "mappings:\n- match: dd.*\n  name: dd\n",
+	}
+	scenarios := []struct {
+		name string
+		path string
+		// mappings are the names of the loaded mappings, followed by the
+		// base name of their file.
+		mappings []string
+		files    int
+	}{
+		{
+			name:     "file",
+			path:     "single.yaml",
+			mappings: []string{"dd@single.yaml"},
+			files:    1,
+		},
+		{
+			name:     "directory with includes",
+			path:     "conf.d",
+			mappings: []string{"aa@10-main.yaml", "cc@x.yml", "bb@20-team.yml"},
+			files:    3,
+		},
+		{
+			name:     "glob",
+			path:     "conf.d/*-team.yml",
+			mappings: []string{"bb@20-team.yml"},
+			files:    1,
+		},
+	}
+
+	dir := writeConfigFiles(t, files)
+	defer os.RemoveAll(dir)
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			mapper := &MetricMapper{}
+			if err := mapper.InitFromFile(filepath.Join(dir, s.path)); err != nil {
+				t.Fatal(err)
+			}
+			var mappings []string
+			for _, mapping := range mapper.Mappings {
+				mappings = append(mappings, mapping.Name+"@"+filepath.Base(mapping.SourceFile))
+			}
+			if !reflect.DeepEqual(mappings, s.mappings) {
+				t.Errorf("expected mappings %v, got %v", s.mappings, mappings)
+			}
+			if len(mapper.Files()) != s.files {
+				t.Errorf("expected %d files, got %v", s.files, mapper.Files())
+			}
+		})
+	}
+}
+
+func TestInitFromFileErrors(t *testing.T) {
+	scenarios := []struct {
+		name  string
+		files map[string]string
+		err   string
+	}{
+		{
+			name: "defaults twice",
+			files: map[string]string{
+				"conf.d/a.yaml": "defaults:\n  timer_type: histogram\n",
+				"conf.d/b.yaml": "defaults:\n  timer_type: raw\n",
+			},
+			err: "defaults are already set",
+		},
+		{
+			name: "file loaded twice",
+			files: map[string]string{
+				"conf.d/a.yaml": "include: [b.yaml]\n",
+				"conf.d/b.yaml": "mappings:\n- match: bb.*\n  name: bb\n",
+			},
+			err: "loaded more than once",
+		},
+		{
+			name: "shadowed glob",
+			files: map[string]string{
+				"conf.d/a.yaml": "mappings:\n- match: aa.*\n  name: aa\n",
+				"conf.d/b.yaml": "mappings:\n- match: aa.xx\n  name: xx\n",
+			},
+			err: "mapping aa.xx (",
+		},
+		{
+			name: "duplicate regex",
+			files: map[string]string{
+				"conf.d/a.yaml": "mappings:\n- match: 'x(.*)'\n  match_type: regex\n  name: x\n- match: 'x(.*)'\n  match_type: regex\n  name: y\n",
+			},
+			err: "duplicates mapping x(.*)",
+		},
+		{
+			name: "invalid mapping",
+			files: map[string]string{
+				"conf.d/a.yaml": "mappings:\n- match: aa.*\n",
+			},
+			err: "a.yaml: line 0",
+		},
+		{
+			name: "missing include",
+			files: map[string]string{
+				"conf.d/a.yaml": "include: [missing/*.yaml]\n",
+			},
+			err: "no mapping configuration files match",
+		},
+	}
+
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			dir := writeConfigFiles(t, s.files)
+			defer os.RemoveAll(dir)
+			err := (&MetricMapper{}).InitFromFile(filepath.Join(dir, "conf.d"))
+			if err == nil || !strings.Contains(err.Error(), s.err) {
+				t.Fatalf("expected error containing %q, got %v", s.err, err)
+			}
+		})
+	}
+}
+
+func TestCheckConflicts(t *testing.T) {
+	scenarios := []struct {
+		name     string
+		mappings string
+		conflict bool
+	}{
+		{
+			name:     "shadowed",
+			mappings: "- match: aa.*.cc\n  name: a\n- match: aa.bb.cc\n  name: b\n",
+			conflict: true,
+		},
+		{
+			name:     "more specific first",
+			mappings: "- match: aa.bb.cc\n  name: b\n- match: aa.*.cc\n  name: a\n",
+		},
+		{
+			name:     "different lengths",
+			mappings: "- match: aa.*\n  name: a\n- match: aa.bb.cc\n  name: b\n",
+		},
+		{
+			name:     "stricter metric type",
+			mappings: "- match: aa.*\n  name: a\n  match_metric_type: gauge\n- match: aa.bb\n  name: b\n",
+		},
+		{
+			name:     "same metric type",
+			mappings: "- match: aa.*\n  name: a\n  match_metric_type: gauge\n- match: aa.bb\n  name: b\n  match_metric_type: gauge\n",
+			conflict: true,
+		},
+		{
+			name:     "stricter labels",
+			mappings: "- match: aa.*\n  name: a\n  match_labels:\n  - label: env\n    value: prod\n- match: aa.bb\n  name: b\n",
+		},
+	}
+
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			err := (&MetricMapper{}).InitFromYAMLString("mappings:\n" + s.mappings)
+			if (err != nil) != s.conflict {
+				t.Fatalf("expected conflict %v, got %v", s.conflict, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright 2013 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mappings
+
+import (
+	"sort"
+	"strings"
+)
+
+// globNode is a state of the glob matcher. Every transition consumes one
+// dot-separated component of a metric name.
+type globNode struct {
+	children map[string]*globNode
+	wildcard *globNode
+	// mappings holds the indexes of the glob mappings accepting names that
+	// end in this state.
+	mappings []int
+}
+
+// globMatcher finds the glob mappings matching a metric name with one walk
+// over its components, instead of trying their regexes one by one.
+type globMatcher struct {
+	root globNode
+}
+
+func (g *globMatcher) add(match string, index int) {
+	node := &g.root
+	for _, component := range strings.Split(match, ".") {
+		if component == "*" {
+			if node.wildcard == nil {
+				node.wildcard = &globNode{}
+			}
+			node = node.wildcard
+			continue
+		}
+		if node.children == nil {
+			node.children = make(map[string]*globNode)
+		}
+		next, ok := node.children[component]
+		if !ok {
+			next = &globNode{}
+			node.children[component] = next
+		}
+		node = next
+	}
+	node.mappings = append(node.mappings, index)
+}
+
+// match returns the indexes of the glob mappings matching name, in
+// configuration order.
+func (g *globMatcher) match(name string) []int {
+	var matches []int
+	g.root.walk(name, &matches)
+	if len(matches) > 1 {
+		sort.Ints(matches)
+	}
+	return matches
+}
+
+func (n *globNode) walk(name string, matches *[]int) {
+	component, rest := name, ""
+	last := true
+	if i := strings.IndexByte(name, '.'); i >= 0 {
+		component, rest = name[:i], name[i+1:]
+		last = false
+	}
+
+	if next, ok := n.children[component]; ok {
+		next.accept(rest, last, matches)
+	}
+	if n.wildcard != nil {
+		n.wildcard.accept(rest, last, matches)
+	}
+}
+
+func (n *globNode) accept(rest string, last bool, matches *[]int) {
+	if last {
+		*matches = append(*matches, n.mappings...)
+	} else {
+		n.walk(rest, matches)
+	}
+}
@@ -0,0 +1,120 @@
+// Copyright 2013 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mappings
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxUnmappedPrefixes bounds the number of prefixes unmapped metrics are
+// counted by. Metrics with further prefixes are counted under
+// OtherUnmappedPrefix.
+const maxUnmappedPrefixes = 1000
+
+// OtherUnmappedPrefix counts unmapped metrics once maxUnmappedPrefixes
+// prefixes are known.
+const OtherUnmappedPrefix = "__other__"
+
+// hitCounters count the GetMapping results of one configuration, and are
+// replaced with it on reload.
+type hitCounters struct {
+	since    time.Time
+	mappings []uint64
+	// unmapped maps the first component of unmapped metric names to a
+	// *uint64 count.
+	unmapped sync.Map
+	prefixes int64
+}
+
+func newHitCounters(mappings int) *hitCounters {
+	return &hitCounters{since: time.Now(), mappings: make([]uint64, mappings)}
+}
+
+func (h *hitCounters) hit(result mappingResult, statsdMetric string) {
+	if h == nil {
+		// No configuration has been loaded.
+		return
+	}
+	if result.present {
+		atomic.AddUint64(&h.mappings[result.index], 1)
+		return
+	}
+
+	prefix := statsdMetric
+	if i := strings.IndexByte(statsdMetric, '.'); i >= 0 {
+		prefix = statsdMetric[:i]
+	}
+	count, ok := h.unmapped.Load(prefix)
+	if !ok {
+		if atomic.AddInt64(&h.prefixes, 1) > maxUnmappedPrefixes {
+			atomic.AddInt64(&h.prefixes, -1)
+			prefix = OtherUnmappedPrefix
+		}
+		count, _ = h.unmapped.LoadOrStore(prefix, new(uint64))
+	}
+	atomic.AddUint64(count.(*uint64), 1)
+}
+
+// MappingHits is the number of metrics a mapping matched.
+type MappingHits struct {
+	Index      int    `json:"index"`
+	Match      string `json:"match"`
+	SourceFile string `json:"sourceFile,omitempty"`
+	Name       string `json:"name"`
+	Hits       uint64 `json:"hits"`
+}
+
+// HitReport counts the metrics GetMapping looked up since the current
+// configuration was loaded.
+type HitReport struct {
+	Since    time.Time
+	Mappings []MappingHits
+	// Unmapped counts the metrics no mapping matched by the first
+	// dot-separated component of their name.
+	Unmapped map[string]uint64
+}
+
+// Hits returns how often every mapping matched since the current
+// configuration was loaded.
+func (m *MetricMapper) Hits() HitReport {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	report := HitReport{
+		Mappings: make([]MappingHits, len(m.Mappings)),
+		Unmapped: map[string]uint64{},
+	}
+	if m.hits == nil {
+		return report
+	}
+	report.Since = m.hits.since
+	for i := range m.Mappings {
+		mapping := &m.Mappings[i]
+		report.Mappings[i] = MappingHits{
+			Index:      i,
+			Match:      mapping.Match,
+			SourceFile: mapping.SourceFile,
+			Name:       mapping.Name,
+			Hits:       atomic.LoadUint64(&m.hits.mappings[i]),
+		}
+	}
+	m.hits.unmapped.Range(func(prefix, count interface{}) bool {
+		report.Unmapped[prefix.(string)] = atomic.LoadUint64(count.(*uint64))
+		return true
+	})
+	return report
+}
@@ -0,0 +1,141 @@
+// Copyright 2013 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mappings
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+const testHitMappings = `
+mappings:
+- match: aa.*
+  name: aa
+- match: bb.*
+  name: bb
+- match: env.*
+  name: '{{ .Labels.env }}'
+`
+
+func TestHits(t *testing.T) {
+	scenarios := []struct {
+		name     string
+		metrics  []string
+		hits     []uint64
+		unmapped map[string]uint64
+	}{
+		{
+			name:     "none",
+			hits:     []uint64{0, 0, 0},
+			unmapped: map[string]uint64{},
+		},
+		{
+			name:     "mapped",
+			metrics:  []string{"aa.x", "aa.y", "aa.x", "bb.x"},
+			hits:     []uint64{3, 1, 0},
+			unmapped: map[string]uint64{},
+		},
+		{
+			name:     "template error",
+			metrics:  []string{"env.x"},
+			hits:     []uint64{0, 0, 1},
+			unmapped: map[string]uint64{},
+		},
+		{
+			name:     "unmapped",
+			metrics:  []string{"zz.x", "zz.y.z", "plain", "aa"},
+			hits:     []uint64{0, 0, 0},
+			unmapped: map[string]uint64{"zz": 2, "plain": 1, "aa": 1},
+		},
+	}
+
+	for _, cacheSize := range []int{0, 1000} {
+		for _, s := range scenarios {
+			mapper := &MetricMapper{}
+			mapper.InitCache(cacheSize)
+			if err := mapper.InitFromYAMLString(testHitMappings); err != nil {
+				t.Fatal(err)
+			}
+			for _, metric := range s.metrics {
+				mapper.GetMapping(metric, "counter", nil)
+				// Neither explaining nor looking up a metric counts.
+				mapper.LookupMapping(metric, "counter", nil)
+				mapper.Explain(metric, "counter", nil)
+			}
+
+			report := mapper.Hits()
+			if report.Since.IsZero() {
+				t.Errorf("cache %d, %s: expected the time hits are counted since", cacheSize, s.name)
+			}
+			var hits []uint64
+			for i, mapping := range report.Mappings {
+				if mapping.Index != i {
+					t.Errorf("cache %d, %s: expected index %d, got %d", cacheSize, s.name, i, mapping.Index)
+				}
+				hits = append(hits, mapping.Hits)
+			}
+			if !reflect.DeepEqual(hits, s.hits) {
+				t.Errorf("cache %d, %s: expected hits %v, got %v", cacheSize, s.name, s.hits, hits)
+			}
+			if !reflect.DeepEqual(report.Unmapped, s.unmapped) {
+				t.Errorf("cache %d, %s: expected unmapped %v, got %v", cacheSize, s.name, s.unmapped, report.Unmapped)
+			}
+		}
+	}
+}
+
+func TestHitsReset(t *testing.T) {
+	mapper := &MetricMapper{}
+	mapper.GetMapping("aa.x", "counter", nil)
+	if report := mapper.Hits(); !report.Since.IsZero() || len(report.Mappings) != 0 {
+		t.Fatalf("expected no hits before loading a configuration, got %+v", report)
+	}
+
+	if err := mapper.InitFromYAMLString(testHitMappings); err != nil {
+		t.Fatal(err)
+	}
+	mapper.GetMapping("aa.x", "counter", nil)
+	mapper.GetMapping("zz.x", "counter", nil)
+	since := mapper.Hits().Since
+	if err := mapper.InitFromYAMLString(testHitMappings); err != nil {
+		t.Fatal(err)
+	}
+	report := mapper.Hits()
+	if report.Mappings[0].Hits != 0 || len(report.Unmapped) != 0 {
+		t.Errorf("expected hits to be reset, got %+v", report)
+	}
+	if report.Since.Before(since) {
+		t.Errorf("expected hits since %v or later, got %v", since, report.Since)
+	}
+}
+
+func TestUnmappedPrefixes(t *testing.T) {
+	mapper := &MetricMapper{}
+	if err := mapper.InitFromYAMLString(testHitMappings); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < maxUnmappedPrefixes+10; i++ {
+		mapper.GetMapping(fmt.Sprintf("p%d.x", i), "counter", nil)
+	}
+	mapper.GetMapping("p0.y", "counter", nil)
+
+	report := mapper.Hits()
+	if len(report.Unmapped) != maxUnmappedPrefixes+1 {
+		t.Errorf("expected %d prefixes, got %d", maxUnmappedPrefixes+1, len(report.Unmapped))
+	}
+	if report.Unmapped[OtherUnmappedPrefix] != 10 || report.Unmapped["p0"] != 2 {
+		t.Errorf("expected 10 hits under %s and 2 under p0, got %d and %d", OtherUnmappedPrefix, report.Unmapped[OtherUnmappedPrefix], report.Unmapped["p0"])
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright 2013 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mappings
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/jvosantos/statsd_exporter/metrics"
+)
+
+// LabelMatcher restricts a mapping to events whose label Label equals Value,
+// or matches Regex if one is given. The regex is anchored at both ends. A
+// missing label has the empty value.
+type LabelMatcher struct {
+	Label string `yaml:"label"`
+	Value string `yaml:"value"`
+	Regex string `yaml:"regex"`
+
+	regex *regexp.Regexp
+}
+
+func (l *LabelMatcher) compile() error {
+	if !labelNameRE.MatchString(l.Label) {
+		return fmt.Errorf("invalid match_labels label: %q", l.Label)
+	}
+	if l.Regex == "" {
+		return nil
+	}
+	if l.Value != "" {
+		return fmt.Errorf("match_labels %s sets both a value and a regex", l.Label)
+	}
+	regex, err := regexp.Compile("^(?:" + l.Regex + ")$")
+	if err != nil {
+		return fmt.Errorf("invalid match_labels regex %s: %v", l.Regex, err)
+	}
+	l.regex = regex
+	return nil
+}
+
+func (l *LabelMatcher) matches(labels metrics.Labels) bool {
+	if l.regex != nil {
+		return l.regex.MatchString(labels[l.Label])
+	}
+	return labels[l.Label] == l.Value
+}
+
+// matchesLabels reports whether labels satisfy every label matcher of m.
+func (m *MetricMapping) matchesLabels(labels metrics.Labels) bool {
+	for i := range m.MatchLabels {
+		if !m.MatchLabels[i].matches(labels) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,88 @@
+// Copyright 2013 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mappings
+
+import (
+	"testing"
+
+	"github.com/jvosantos/statsd_exporter/metrics"
+)
+
+const testMatchLabels = `
+mappings:
+- match: http.*
+  name: http_${1}_prod
+  match_labels:
+  - label: env
+    value: prod
+- match: '^http\.(.*)$'
+  match_type: regex
+  name: http_${1}_web
+  match_labels:
+  - label: host
+    regex: web-\d+
+  - label: env
+    value: ""
+- match: http.*
+  name: http_$1
+`
+
+func TestMatchLabels(t *testing.T) {
+	scenarios := []struct {
+		name    string
+		labels  metrics.Labels
+		mapping string
+	}{
+		{name: "value", labels: metrics.Labels{"env": "prod"}, mapping: "http_requests_prod"},
+		{name: "other value", labels: metrics.Labels{"env": "dev"}, mapping: "http_requests"},
+		{name: "regex and missing label", labels: metrics.Labels{"host": "web-1"}, mapping: "http_requests_web"},
+		{name: "regex is anchored", labels: metrics.Labels{"host": "web-1a"}, mapping: "http_requests"},
+		{name: "not every matcher", labels: metrics.Labels{"host": "web-1", "env": "dev"}, mapping: "http_requests"},
+		{name: "no labels", mapping: "http_requests"},
+	}
+
+	// With a cache, lookups that only differ by label values must not share
+	// results.
+	for _, cacheSize := range []int{0, 1000} {
+		mapper := &MetricMapper{}
+		mapper.InitCache(cacheSize)
+		if err := mapper.InitFromYAMLString(testMatchLabels); err != nil {
+			t.Fatal(err)
+		}
+		for _, s := range scenarios {
+			mapping, _, present, _ := mapper.GetMapping("http.requests", "counter", s.labels)
+			if !present || mapping.Name != s.mapping {
+				t.Errorf("cache %d, %s: expected mapping %q, got %v", cacheSize, s.name, s.mapping, mapping)
+			}
+		}
+	}
+}
+
+func TestMatchLabelsErrors(t *testing.T) {
+	scenarios := []struct {
+		name     string
+		matchers string
+	}{
+		{name: "invalid label", matchers: "  - label: a-b\n    value: x\n"},
+		{name: "value and regex", matchers: "  - label: env\n    value: x\n    regex: x\n"},
+		{name: "invalid regex", matchers: "  - label: env\n    regex: (\n"},
+	}
+
+	for _, s := range scenarios {
+		mapper := &MetricMapper{}
+		if err := mapper.InitFromYAMLString("mappings:\n- match: aa.*\n  name: aa\n  match_labels:\n" + s.matchers); err == nil {
+			t.Errorf("%s: expected an error", s.name)
+		}
+	}
+}
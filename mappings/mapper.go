@@ -2,10 +2,12 @@ package mappings
 
 import (
 	"fmt"
-	"io/ioutil"
 	"regexp"
+	"sort"
 	"strings"
 	"sync"
+	"text/template"
+	"time"
 
 	"gopkg.in/yaml.v2"
 	"github.com/jvosantos/statsd_exporter/metrics"
@@ -23,13 +25,40 @@ var (
 
 type mapperConfigDefaults struct {
 	TimerType timerType `yaml:"timer_type"`
+	Buckets   []float64 `yaml:"buckets"`
 	MatchType matchType `yaml:"match_type"`
+	RelabelConfigs []*RelabelConfig `yaml:"relabel_configs"`
+	TTL       time.Duration `yaml:"ttl"`
+	MaxSeries int       `yaml:"max_series"`
+	OverflowPolicy overflowPolicy `yaml:"overflow_policy"`
+	CounterMode counterMode `yaml:"counter_mode"`
 }
 
 type MetricMapper struct {
 	Defaults mapperConfigDefaults `yaml:"defaults"`
 	Mappings []MetricMapping      `yaml:"mappings"`
-	mutex    sync.Mutex
+
+	// mutex guards the configuration, which is replaced as a whole on
+	// reload together with the matchers and the cache built for it.
+	mutex       sync.RWMutex
+	globs       *globMatcher
+	regexes     []int
+	// matchLabels are the names of the labels used by any mapping's
+	// match_labels, whose values are part of the cache key.
+	matchLabels []string
+	// allLabels is set when templates refer to event labels, making every
+	// label part of the cache key.
+	allLabels   bool
+	cache       *mappingCache
+	cacheSize   int
+	hits        *hitCounters
+	// files are the configuration files the mappings were loaded from, and
+	// hash the hash of their contents.
+	files       []string
+	hash        string
+	// unmapped carries the defaults that apply to metrics no mapping
+	// matches.
+	unmapped    *MetricMapping
 }
 
 type MetricMapping struct {
@@ -38,10 +67,27 @@ type MetricMapping struct {
 	regex           *regexp.Regexp
 	Labels          metrics.Labels 	    `yaml:"labels"`
 	TimerType       timerType           `yaml:"timer_type"`
+	Buckets         []float64           `yaml:"buckets"`
 	MatchType       matchType           `yaml:"match_type"`
 	HelpText        string              `yaml:"help"`
 	Action          actionType          `yaml:"action"`
 	MatchMetricType metrics.MetricType  `yaml:"match_metric_type"`
+	MatchLabels     []LabelMatcher      `yaml:"match_labels"`
+	RelabelConfigs  []*RelabelConfig    `yaml:"relabel_configs"`
+	Value           *ValueTransform     `yaml:"value"`
+	// TTL is how long the aggregated series of the mapping are kept without
+	// being updated. 0 keeps them forever.
+	TTL             time.Duration       `yaml:"ttl"`
+	// MaxSeries limits the number of label sets of each metric name the
+	// mapping produces. 0 disables the limit.
+	MaxSeries       int                 `yaml:"max_series"`
+	OverflowPolicy  overflowPolicy      `yaml:"overflow_policy"`
+	CounterMode     counterMode         `yaml:"counter_mode"`
+	// SourceFile is the configuration file the mapping was loaded from.
+	SourceFile      string              `yaml:"-"`
+
+	nameTemplate   *template.Template
+	labelTemplates map[string]*template.Template
 }
 
 func (m *MetricMapper) InitFromYAMLString(fileContents string) error {
@@ -50,112 +96,459 @@ func (m *MetricMapper) InitFromYAMLString(fileContents string) error {
 	if err := yaml.Unmarshal([]byte(fileContents), &n); err != nil {
 		return err
 	}
+	return m.init(&n, true)
+}
 
+// init validates the configuration in n and makes it the current one. Unless
+// strict is false, mappings conflicting with each other are an error.
+func (m *MetricMapper) init(n *MetricMapper, strict bool) error {
 	if n.Defaults.MatchType == matchTypeDefault {
 		n.Defaults.MatchType = matchTypeGlob
 	}
 
+	if n.Defaults.Buckets == nil {
+		n.Defaults.Buckets = metrics.DefBuckets
+	}
+	if err := checkBuckets(n.Defaults.Buckets); err != nil {
+		return fmt.Errorf("defaults: %v", err)
+	}
+	if n.Defaults.TTL < 0 {
+		return fmt.Errorf("defaults: negative ttl %s", n.Defaults.TTL)
+	}
+	if n.Defaults.MaxSeries < 0 {
+		return fmt.Errorf("defaults: negative max_series %d", n.Defaults.MaxSeries)
+	}
+	if n.Defaults.OverflowPolicy == OverflowDefault {
+		n.Defaults.OverflowPolicy = OverflowDrop
+	}
+	if n.Defaults.CounterMode == CounterModeDefault {
+		n.Defaults.CounterMode = CounterModeRaw
+	}
+	for _, c := range n.Defaults.RelabelConfigs {
+		if err := c.compile(); err != nil {
+			return fmt.Errorf("defaults: %v", err)
+		}
+	}
+
+	n.globs = &globMatcher{}
+	matchLabelNames := map[string]bool{}
 	for i := range n.Mappings {
 		glog.V(100).Infoln("parsing mapping", n.Mappings[i].Name)
-		currentMapping := &n.Mappings[i]
-
-		// check that label is correct
-		for k := range currentMapping.Labels {
-			if !labelNameRE.MatchString(k) {
-				return fmt.Errorf("invalid label key: %s", k)
+		if err := n.initMapping(i, matchLabelNames); err != nil {
+			if file := n.Mappings[i].SourceFile; file != "" {
+				return fmt.Errorf("%s: %v", file, err)
 			}
+			return err
 		}
+	}
+	if conflicts := checkConflicts(n.Mappings); strict && len(conflicts) > 0 {
+		return conflicts[0]
+	}
+	n.unmapped = &MetricMapping{
+		Action:         ActionTypeMap,
+		TimerType:      n.Defaults.TimerType,
+		Buckets:        n.Defaults.Buckets,
+		RelabelConfigs: n.Defaults.RelabelConfigs,
+		TTL:            n.Defaults.TTL,
+		MaxSeries:      n.Defaults.MaxSeries,
+		OverflowPolicy: n.Defaults.OverflowPolicy,
+		CounterMode:    n.Defaults.CounterMode,
+	}
 
-		if currentMapping.Name == "" {
-			return fmt.Errorf("line %d: metric mapping didn't set a metric name", i)
-		}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
 
-		if !metricNameRE.MatchString(currentMapping.Name) {
-			return fmt.Errorf("metric name '%s' doesn't match regex '%s'", currentMapping.Name, metricNameRE)
-		}
+	m.Defaults = n.Defaults
+	m.Mappings = n.Mappings
+	m.globs = n.globs
+	m.regexes = n.regexes
+	m.matchLabels = n.matchLabels
+	m.allLabels = n.allLabels
+	m.files = n.files
+	m.hash = n.hash
+	m.unmapped = n.unmapped
+	m.hits = newHitCounters(len(n.Mappings))
+	m.cache = nil
+	if m.cacheSize > 0 {
+		m.cache = newMappingCache(m.cacheSize)
+	}
 
-		if currentMapping.MatchType == "" {
-			currentMapping.MatchType = n.Defaults.MatchType
-		}
+	//mappingsCount.Set(float64(len(n.Mappings))) // self metric
 
-		if currentMapping.Action == "" {
-			currentMapping.Action = ActionTypeMap
+	return nil
+}
+
+// initMapping validates the i-th mapping, filling in defaults and compiling
+// its matchers and templates.
+func (n *MetricMapper) initMapping(i int, matchLabelNames map[string]bool) error {
+	currentMapping := &n.Mappings[i]
+
+	// check that label is correct
+	for k := range currentMapping.Labels {
+		if !labelNameRE.MatchString(k) {
+			return fmt.Errorf("invalid label key: %s", k)
 		}
+	}
 
-		if currentMapping.MatchType == matchTypeGlob {
-			if !metricLineRE.MatchString(currentMapping.Match) {
-				return fmt.Errorf("invalid match: %s", currentMapping.Match)
-			}
-			// Translate the glob-style metric match line into a proper regex that we
-			// can use to match metrics later on.
-			metricRe := strings.Replace(currentMapping.Match, ".", "\\.", -1)
-			metricRe = strings.Replace(metricRe, "*", "([^.]*)", -1)
-			if regex, err := regexp.Compile("^" + metricRe + "$"); err != nil {
-				return fmt.Errorf("invalid match %s. cannot compile regex in mapping: %v", currentMapping.Match, err)
-			} else {
-				currentMapping.regex = regex
-			}
+	if currentMapping.Name == "" {
+		return fmt.Errorf("line %d: metric mapping didn't set a metric name", i)
+	}
+
+	if !isTemplate(currentMapping.Name) && !metricNameRE.MatchString(currentMapping.Name) {
+		return fmt.Errorf("metric name '%s' doesn't match regex '%s'", currentMapping.Name, metricNameRE)
+	}
+
+	if currentMapping.MatchType == "" {
+		currentMapping.MatchType = n.Defaults.MatchType
+	}
+
+	if currentMapping.Action == "" {
+		currentMapping.Action = ActionTypeMap
+	}
+
+	if currentMapping.MatchType == matchTypeGlob {
+		if !metricLineRE.MatchString(currentMapping.Match) {
+			return fmt.Errorf("invalid match: %s", currentMapping.Match)
+		}
+		// Translate the glob-style metric match line into a proper regex that we
+		// can use to match metrics later on.
+		metricRe := strings.Replace(currentMapping.Match, ".", "\\.", -1)
+		metricRe = strings.Replace(metricRe, "*", "([^.]*)", -1)
+		if regex, err := regexp.Compile("^" + metricRe + "$"); err != nil {
+			return fmt.Errorf("invalid match %s. cannot compile regex in mapping: %v", currentMapping.Match, err)
 		} else {
-			if regex, err := regexp.Compile(currentMapping.Match); err != nil {
-				return fmt.Errorf("invalid regex %s in mapping: %v", currentMapping.Match, err)
-			} else {
-				currentMapping.regex = regex
-			}
+			currentMapping.regex = regex
+		}
+		n.globs.add(currentMapping.Match, i)
+	} else {
+		if regex, err := regexp.Compile(currentMapping.Match); err != nil {
+			return fmt.Errorf("invalid regex %s in mapping: %v", currentMapping.Match, err)
+		} else {
+			currentMapping.regex = regex
 		}
+		n.regexes = append(n.regexes, i)
+	}
 
-		if currentMapping.TimerType == "" {
-			currentMapping.TimerType = n.Defaults.TimerType
+	captures := currentMapping.regex.NumSubexp()
+	if isTemplate(currentMapping.Name) {
+		t, err := compileTemplate(currentMapping.Name, captures)
+		if err != nil {
+			return fmt.Errorf("mapping %s: name: %v", currentMapping.Match, err)
 		}
+		currentMapping.nameTemplate = t
+		n.allLabels = n.allLabels || usesLabels(t)
+	}
+	for label, valueExpr := range currentMapping.Labels {
+		if !isTemplate(valueExpr) {
+			continue
+		}
+		t, err := compileTemplate(valueExpr, captures)
+		if err != nil {
+			return fmt.Errorf("mapping %s: label %s: %v", currentMapping.Match, label, err)
+		}
+		if currentMapping.labelTemplates == nil {
+			currentMapping.labelTemplates = make(map[string]*template.Template)
+		}
+		currentMapping.labelTemplates[label] = t
+		n.allLabels = n.allLabels || usesLabels(t)
 	}
 
-	m.mutex.Lock()
-	defer m.mutex.Unlock()
+	if currentMapping.TimerType == "" {
+		currentMapping.TimerType = n.Defaults.TimerType
+	}
 
-	m.Defaults = n.Defaults
-	m.Mappings = n.Mappings
+	if len(currentMapping.Buckets) == 0 {
+		currentMapping.Buckets = n.Defaults.Buckets
+	}
+	if err := checkBuckets(currentMapping.Buckets); err != nil {
+		return fmt.Errorf("mapping %s: %v", currentMapping.Match, err)
+	}
 
-	//mappingsCount.Set(float64(len(n.Mappings))) // self metric
+	if currentMapping.TTL < 0 {
+		return fmt.Errorf("mapping %s: negative ttl %s", currentMapping.Match, currentMapping.TTL)
+	}
+	if currentMapping.TTL == 0 {
+		currentMapping.TTL = n.Defaults.TTL
+	}
+
+	if currentMapping.MaxSeries < 0 {
+		return fmt.Errorf("mapping %s: negative max_series %d", currentMapping.Match, currentMapping.MaxSeries)
+	}
+	if currentMapping.MaxSeries == 0 {
+		currentMapping.MaxSeries = n.Defaults.MaxSeries
+	}
+	if currentMapping.OverflowPolicy == OverflowDefault {
+		currentMapping.OverflowPolicy = n.Defaults.OverflowPolicy
+	}
+	if currentMapping.CounterMode == CounterModeDefault {
+		currentMapping.CounterMode = n.Defaults.CounterMode
+	}
+
+	for j := range currentMapping.MatchLabels {
+		matcher := &currentMapping.MatchLabels[j]
+		if err := matcher.compile(); err != nil {
+			return fmt.Errorf("mapping %s: %v", currentMapping.Match, err)
+		}
+		if !matchLabelNames[matcher.Label] {
+			matchLabelNames[matcher.Label] = true
+			n.matchLabels = append(n.matchLabels, matcher.Label)
+		}
+	}
+
+	if currentMapping.Value != nil {
+		if err := currentMapping.Value.compile(); err != nil {
+			return fmt.Errorf("mapping %s: %v", currentMapping.Match, err)
+		}
+		currentMapping.Buckets = currentMapping.Value.buckets(currentMapping.Buckets)
+	}
 
+	// The default relabel configs apply after the mapping's own, so that
+	// mappings can't lose them by adding some.
+	for _, c := range currentMapping.RelabelConfigs {
+		if err := c.compile(); err != nil {
+			return fmt.Errorf("mapping %s: %v", currentMapping.Match, err)
+		}
+	}
+	if len(n.Defaults.RelabelConfigs) > 0 {
+		configs := make([]*RelabelConfig, 0, len(currentMapping.RelabelConfigs)+len(n.Defaults.RelabelConfigs))
+		configs = append(configs, currentMapping.RelabelConfigs...)
+		currentMapping.RelabelConfigs = append(configs, n.Defaults.RelabelConfigs...)
+	}
+	return nil
+}
+
+func checkBuckets(buckets []float64) error {
+	for i := 1; i < len(buckets); i++ {
+		if buckets[i] <= buckets[i-1] {
+			return fmt.Errorf("histogram buckets must be in increasing order: %v", buckets)
+		}
+	}
 	return nil
 }
 
-func (m *MetricMapper) InitFromFile(fileName string) error {
-	mappingStr, err := ioutil.ReadFile(fileName)
+// InitFromFile loads the configuration from path, which is a file, a
+// directory of .yaml and .yml files or a glob, together with the files they
+// include.
+func (m *MetricMapper) InitFromFile(path string) error {
+	_, err := m.ReloadFromFile(path, true)
+	return err
+}
+
+// ReloadFromFile loads the configuration at path like InitFromFile. Unless
+// force is set, the current configuration is only replaced if the names or
+// contents of the files it was loaded from changed. It reports whether the
+// configuration was replaced.
+func (m *MetricMapper) ReloadFromFile(path string, force bool) (bool, error) {
+	n, err := newConfigLoader().load(path)
 	if err != nil {
-		return err
+		return false, err
 	}
-	return m.InitFromYAMLString(string(mappingStr))
+	if !force {
+		m.mutex.RLock()
+		unchanged := n.hash == m.hash
+		m.mutex.RUnlock()
+		if unchanged {
+			return false, nil
+		}
+	}
+	if err := m.init(n, true); err != nil {
+		return false, err
+	}
+	return true, nil
 }
 
-func (m *MetricMapper) GetMapping(statsdMetric string, statsdMetricType metrics.MetricType) (*MetricMapping, metrics.Labels, bool) {
+// MappingCount returns the number of mappings of the current configuration.
+func (m *MetricMapper) MappingCount() int {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	return len(m.Mappings)
+}
+
+// Files returns the configuration files the current configuration was
+// loaded from.
+func (m *MetricMapper) Files() []string {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	return m.files
+}
+
+// InitCache caches the results of up to size GetMapping calls, which is
+// worthwhile when metric names repeat. A size of 0 disables the cache.
+func (m *MetricMapper) InitCache(size int) {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
 
-	for _, mapping := range m.Mappings {
-		matches := mapping.regex.FindStringSubmatchIndex(statsdMetric)
-		if len(matches) == 0 {
-			continue
+	m.cacheSize = size
+	m.cache = nil
+	if size > 0 {
+		m.cache = newMappingCache(size)
+	}
+}
+
+// GetDefaults returns the defaults of the current configuration.
+func (m *MetricMapper) GetDefaults() mapperConfigDefaults {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	return m.Defaults
+}
+
+// GetMapping returns the first mapping matching statsdMetric and the labels
+// it assigns. eventLabels are the labels parsed with the event, which
+// match_labels are evaluated against. If no mapping matches, it returns a
+// mapping carrying the defaults and false, so a metric is handled with a
+// single configuration even while it is being reloaded. If the templates of
+// the matching mapping fail, it returns the error and the event should be
+// dropped. The mapping and labels may be shared with other callers and must
+// not be modified.
+func (m *MetricMapper) GetMapping(statsdMetric string, statsdMetricType metrics.MetricType, eventLabels metrics.Labels) (*MetricMapping, metrics.Labels, bool, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	if m.cache == nil {
+		result := m.match(statsdMetric, statsdMetricType, eventLabels)
+		m.hits.hit(result, statsdMetric)
+		return result.mapping, result.labels, result.present, result.err
+	}
+
+	key := cacheKey{metricName: statsdMetric, metricType: statsdMetricType}
+	if m.allLabels {
+		names := make([]string, 0, len(eventLabels))
+		for label := range eventLabels {
+			names = append(names, label)
+		}
+		sort.Strings(names)
+		var values strings.Builder
+		for _, label := range names {
+			values.WriteString(label)
+			values.WriteByte(0xfe)
+			values.WriteString(eventLabels[label])
+			values.WriteByte(0xff)
+		}
+		key.labelValues = values.String()
+	} else if len(m.matchLabels) > 0 {
+		var values strings.Builder
+		for _, label := range m.matchLabels {
+			values.WriteString(eventLabels[label])
+			values.WriteByte(0xff)
+		}
+		key.labelValues = values.String()
+	}
+	result, ok := m.cache.get(key)
+	if !ok {
+		result = m.match(statsdMetric, statsdMetricType, eventLabels)
+		m.cache.add(key, result)
+	}
+	m.hits.hit(result, statsdMetric)
+	return result.mapping, result.labels, result.present, result.err
+}
+
+// LookupMapping returns the mapping of a metric like GetMapping, without
+// using the cache or counting a hit, so that looking at how a metric would be
+// mapped doesn't change the mapper's state.
+func (m *MetricMapper) LookupMapping(statsdMetric string, statsdMetricType metrics.MetricType, eventLabels metrics.Labels) (*MetricMapping, metrics.Labels, bool, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	result := m.match(statsdMetric, statsdMetricType, eventLabels)
+	return result.mapping, result.labels, result.present, result.err
+}
+
+// match finds the first mapping matching statsdMetric. Glob mappings are
+// looked up in the glob matcher; regex mappings are only tried when they come
+// before the first matching glob mapping.
+func (m *MetricMapper) match(statsdMetric string, statsdMetricType metrics.MetricType, eventLabels metrics.Labels) mappingResult {
+	glob := -1
+	if m.globs != nil {
+		for _, i := range m.globs.match(statsdMetric) {
+			mapping := &m.Mappings[i]
+			if mt := mapping.MatchMetricType; (mt == "" || mt == statsdMetricType) && mapping.matchesLabels(eventLabels) {
+				glob = i
+				break
+			}
+		}
+	}
+
+	for _, i := range m.regexes {
+		if glob >= 0 && i > glob {
+			break
+		}
+		if result, ok := m.expand(i, statsdMetric, statsdMetricType, eventLabels); ok {
+			return result
 		}
+	}
 
+	if glob >= 0 {
+		if result, ok := m.expand(glob, statsdMetric, statsdMetricType, eventLabels); ok {
+			return result
+		}
+	}
+	return mappingResult{mapping: m.unmapped}
+}
+
+// expand applies the i-th mapping to statsdMetric, filling in the captures
+// of its match in the metric name and labels.
+func (m *MetricMapper) expand(i int, statsdMetric string, statsdMetricType metrics.MetricType, eventLabels metrics.Labels) (mappingResult, bool) {
+	mapping := m.Mappings[i]
+	matches := mapping.regex.FindStringSubmatchIndex(statsdMetric)
+	if len(matches) == 0 {
+		return mappingResult{}, false
+	}
+
+	if mt := mapping.MatchMetricType; mt != "" && mt != statsdMetricType {
+		return mappingResult{}, false
+	}
+
+	if !mapping.matchesLabels(eventLabels) {
+		return mappingResult{}, false
+	}
+
+	var data *templateData
+	if mapping.nameTemplate != nil || mapping.labelTemplates != nil {
+		data = &templateData{
+			Name:       statsdMetric,
+			MetricType: statsdMetricType,
+			Labels:     eventLabels,
+			Captures:   make([]string, len(matches)/2),
+		}
+		for j := range data.Captures {
+			if matches[2*j] >= 0 {
+				data.Captures[j] = statsdMetric[matches[2*j]:matches[2*j+1]]
+			}
+		}
+	}
+
+	var err error
+	if mapping.nameTemplate != nil {
+		mapping.Name, err = executeTemplate(mapping.nameTemplate, data)
+		if err == nil && mapping.Name == "" {
+			err = fmt.Errorf("template of mapping %q gave %s an empty name", mapping.Match, statsdMetric)
+		}
+		if err != nil {
+			return mappingResult{present: true, index: i, err: err}, true
+		}
+	} else {
 		mapping.Name = string(mapping.regex.ExpandString(
 			[]byte{},
 			mapping.Name,
 			statsdMetric,
 			matches,
 		))
+	}
 
-		if mt := mapping.MatchMetricType; mt != "" && mt != statsdMetricType {
+	labels := metrics.Labels{}
+	for label, valueExpr := range mapping.Labels {
+		if t, ok := mapping.labelTemplates[label]; ok {
+			if labels[label], err = executeTemplate(t, data); err != nil {
+				return mappingResult{present: true, index: i, err: err}, true
+			}
 			continue
 		}
-
-		labels := metrics.Labels{}
-		for label, valueExpr := range mapping.Labels {
-			value := mapping.regex.ExpandString([]byte{}, valueExpr, statsdMetric, matches)
-			labels[label] = string(value)
-		}
-
-		return &mapping, labels, true
+		value := mapping.regex.ExpandString([]byte{}, valueExpr, statsdMetric, matches)
+		labels[label] = string(value)
 	}
 
-	return nil, nil, false
+	return mappingResult{mapping: &mapping, labels: labels, present: true, index: i}, true
 }
@@ -0,0 +1,429 @@
+// Copyright 2013 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mappings
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jvosantos/statsd_exporter/metrics"
+)
+
+const testMappings = `
+mappings:
+- match: aa.*.cc
+  name: first_$1
+  match_metric_type: gauge
+- match: aa\.(xx|yy)\.cc
+  match_type: regex
+  name: regex_$1
+- match: aa.*.cc
+  name: second_$1
+  labels:
+    ll: "$1"
+- match: aa.*.*
+  name: third
+- match: '.*\.dd$'
+  match_type: regex
+  name: anyd
+- match: bb.*
+  name: b_$1
+- match: bb.*.dd
+  name: unreachable
+`
+
+func TestGetMapping(t *testing.T) {
+	scenarios := []struct {
+		name       string
+		metricName string
+		metricType metrics.MetricType
+		mapping    string
+		labels     metrics.Labels
+	}{
+		{
+			name:       "glob with metric type",
+			metricName: "aa.xx.cc",
+			metricType: "gauge",
+			mapping:    "first_xx",
+			labels:     metrics.Labels{},
+		},
+		{
+			name:       "regex before later glob",
+			metricName: "aa.xx.cc",
+			metricType: "counter",
+			mapping:    "regex_xx",
+			labels:     metrics.Labels{},
+		},
+		{
+			name:       "glob before later regex",
+			metricName: "aa.zz.cc",
+			metricType: "counter",
+			mapping:    "second_zz",
+			labels:     metrics.Labels{"ll": "zz"},
+		},
+		{
+			name:       "less specific glob",
+			metricName: "aa.zz.dd",
+			metricType: "counter",
+			mapping:    "third",
+			labels:     metrics.Labels{},
+		},
+		{
+			name:       "regex after globs",
+			metricName: "cc.zz.dd",
+			metricType: "timer",
+			mapping:    "anyd",
+			labels:     metrics.Labels{},
+		},
+		{
+			name:       "empty glob component",
+			metricName: "bb.",
+			metricType: "counter",
+			mapping:    "b_",
+			labels:     metrics.Labels{},
+		},
+		{
+			name:       "regex before later glob of more components",
+			metricName: "bb.zz.dd",
+			metricType: "counter",
+			mapping:    "anyd",
+			labels:     metrics.Labels{},
+		},
+		{
+			name:       "unmapped",
+			metricName: "bb.zz.ee",
+			metricType: "counter",
+		},
+	}
+
+	// Lookups are repeated with and without a cache, which is small enough
+	// that entries get evicted.
+	for _, cacheSize := range []int{0, 1, 1000} {
+		mapper := &MetricMapper{}
+		mapper.InitCache(cacheSize)
+		if err := mapper.InitFromYAMLString(testMappings); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 2; i++ {
+			for _, s := range scenarios {
+				mapping, labels, present, _ := mapper.GetMapping(s.metricName, s.metricType, nil)
+				if present != (s.mapping != "") {
+					t.Fatalf("cache %d, %s: expected present %v, got %v", cacheSize, s.name, s.mapping != "", present)
+				}
+				if !present {
+					continue
+				}
+				if mapping.Name != s.mapping {
+					t.Errorf("cache %d, %s: expected mapping %q, got %q", cacheSize, s.name, s.mapping, mapping.Name)
+				}
+				if !reflect.DeepEqual(labels, s.labels) {
+					t.Errorf("cache %d, %s: expected labels %v, got %v", cacheSize, s.name, s.labels, labels)
+				}
+			}
+		}
+	}
+}
+
+func TestMappingCache(t *testing.T) {
+	c := newMappingCache(cacheShards)
+	a := cacheKey{metricName: "a", metricType: "counter"}
+	aGauge := cacheKey{metricName: "a", metricType: "gauge"}
+	c.add(a, mappingResult{present: true})
+	if result, ok := c.get(a); !ok || !result.present {
+		t.Fatalf("expected cached result, got %v, %v", result, ok)
+	}
+
+	// Each shard holds a single entry, and both keys are in the same
+	// shard, so adding the second evicts the first.
+	c.add(aGauge, mappingResult{})
+	if _, ok := c.get(a); ok {
+		t.Fatal("expected evicted result")
+	}
+	if _, ok := c.get(aGauge); !ok {
+		t.Fatal("expected cached result")
+	}
+}
+
+func TestInitFromYAMLStringReplacesCache(t *testing.T) {
+	mapper := &MetricMapper{}
+	mapper.InitCache(10)
+	if err := mapper.InitFromYAMLString("mappings:\n- match: aa.*\n  name: old\n"); err != nil {
+		t.Fatal(err)
+	}
+	if mapping, _, _, _ := mapper.GetMapping("aa.bb", "counter", nil); mapping.Name != "old" {
+		t.Fatalf("expected mapping old, got %q", mapping.Name)
+	}
+	if err := mapper.InitFromYAMLString("mappings:\n- match: aa.*\n  name: new\n"); err != nil {
+		t.Fatal(err)
+	}
+	if mapping, _, _, _ := mapper.GetMapping("aa.bb", "counter", nil); mapping.Name != "new" {
+		t.Fatalf("expected mapping new, got %q", mapping.Name)
+	}
+}
+
+func TestReloadFromFile(t *testing.T) {
+	const (
+		one = "mappings:\n- match: aa.*\n  name: aa\n"
+		two = "mappings:\n- match: aa.*\n  name: aa\n- match: bb.*\n  name: bb\n"
+	)
+	scenarios := []struct {
+		name string
+		// files are written to the configuration directory before reloading.
+		files    map[string]string
+		force    bool
+		changed  bool
+		err      bool
+		mappings int
+	}{
+		{name: "unchanged", mappings: 1},
+		{name: "forced", force: true, changed: true, mappings: 1},
+		{name: "rewritten", files: map[string]string{"a.yaml": one}, mappings: 1},
+		{name: "changed", files: map[string]string{"a.yaml": two}, changed: true, mappings: 2},
+		{name: "renamed", files: map[string]string{"a.yaml": "", "b.yaml": one}, changed: true, mappings: 1},
+		{name: "added", files: map[string]string{"b.yaml": "mappings:\n- match: bb.*\n  name: bb\n"}, changed: true, mappings: 2},
+		{name: "invalid", files: map[string]string{"a.yaml": "mappings:\n- match: aa.*\n"}, err: true, mappings: 1},
+	}
+
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			dir := writeConfigFiles(t, map[string]string{"a.yaml": one})
+			defer os.RemoveAll(dir)
+			mapper := &MetricMapper{}
+			if err := mapper.InitFromFile(dir); err != nil {
+				t.Fatal(err)
+			}
+			for name, content := range s.files {
+				path := filepath.Join(dir, name)
+				if content == "" {
+					os.Remove(path)
+					continue
+				}
+				if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			changed, err := mapper.ReloadFromFile(dir, s.force)
+			if (err != nil) != s.err {
+				t.Fatalf("expected error %v, got %v", s.err, err)
+			}
+			if changed != s.changed {
+				t.Errorf("expected changed %v, got %v", s.changed, changed)
+			}
+			if mapper.MappingCount() != s.mappings {
+				t.Errorf("expected %d mappings, got %d", s.mappings, mapper.MappingCount())
+			}
+		})
+	}
+}
+
+func TestTTL(t *testing.T) {
+	scenarios := []struct {
+		name     string
+		config   string
+		err      bool
+		mapped   time.Duration
+		unmapped time.Duration
+	}{
+		{
+			name:   "none",
+			config: "mappings:\n- match: aa.*\n  name: aa\n",
+		},
+		{
+			name:   "mapping",
+			config: "mappings:\n- match: aa.*\n  name: aa\n  ttl: 1m\n",
+			mapped: time.Minute,
+		},
+		{
+			name:     "defaults",
+			config:   "defaults:\n  ttl: 1h\nmappings:\n- match: aa.*\n  name: aa\n",
+			mapped:   time.Hour,
+			unmapped: time.Hour,
+		},
+		{
+			name:     "mapping overrides defaults",
+			config:   "defaults:\n  ttl: 1h\nmappings:\n- match: aa.*\n  name: aa\n  ttl: 30s\n",
+			mapped:   30 * time.Second,
+			unmapped: time.Hour,
+		},
+		{
+			name:   "negative",
+			config: "mappings:\n- match: aa.*\n  name: aa\n  ttl: -1m\n",
+			err:    true,
+		},
+		{
+			name:   "negative defaults",
+			config: "defaults:\n  ttl: -1m\nmappings: []\n",
+			err:    true,
+		},
+	}
+
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			mapper := &MetricMapper{}
+			err := mapper.InitFromYAMLString(s.config)
+			if (err != nil) != s.err {
+				t.Fatalf("expected error %v, got %v", s.err, err)
+			}
+			if err != nil {
+				return
+			}
+			mapped, _, _, _ := mapper.GetMapping("aa.bb", "counter", nil)
+			unmapped, _, _, _ := mapper.GetMapping("zz.bb", "counter", nil)
+			if mapped.TTL != s.mapped || unmapped.TTL != s.unmapped {
+				t.Errorf("expected ttls %v and %v, got %v and %v", s.mapped, s.unmapped, mapped.TTL, unmapped.TTL)
+			}
+		})
+	}
+}
+
+func TestMaxSeries(t *testing.T) {
+	scenarios := []struct {
+		name           string
+		config         string
+		err            bool
+		mapped         int
+		mappedPolicy   overflowPolicy
+		unmapped       int
+		unmappedPolicy overflowPolicy
+	}{
+		{
+			name:           "none",
+			config:         "mappings:\n- match: aa.*\n  name: aa\n",
+			mappedPolicy:   OverflowDrop,
+			unmappedPolicy: OverflowDrop,
+		},
+		{
+			name:           "mapping",
+			config:         "mappings:\n- match: aa.*\n  name: aa\n  max_series: 10\n  overflow_policy: overflow\n",
+			mapped:         10,
+			mappedPolicy:   OverflowSeries,
+			unmappedPolicy: OverflowDrop,
+		},
+		{
+			name:           "defaults",
+			config:         "defaults:\n  max_series: 100\n  overflow_policy: overflow\nmappings:\n- match: aa.*\n  name: aa\n",
+			mapped:         100,
+			mappedPolicy:   OverflowSeries,
+			unmapped:       100,
+			unmappedPolicy: OverflowSeries,
+		},
+		{
+			name:           "mapping overrides defaults",
+			config:         "defaults:\n  max_series: 100\n  overflow_policy: overflow\nmappings:\n- match: aa.*\n  name: aa\n  max_series: 10\n  overflow_policy: drop\n",
+			mapped:         10,
+			mappedPolicy:   OverflowDrop,
+			unmapped:       100,
+			unmappedPolicy: OverflowSeries,
+		},
+		{
+			name:   "negative",
+			config: "mappings:\n- match: aa.*\n  name: aa\n  max_series: -1\n",
+			err:    true,
+		},
+		{
+			name:   "negative defaults",
+			config: "defaults:\n  max_series: -1\nmappings: []\n",
+			err:    true,
+		},
+		{
+			name:   "invalid policy",
+			config: "mappings:\n- match: aa.*\n  name: aa\n  overflow_policy: keep\n",
+			err:    true,
+		},
+	}
+
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			mapper := &MetricMapper{}
+			err := mapper.InitFromYAMLString(s.config)
+			if (err != nil) != s.err {
+				t.Fatalf("expected error %v, got %v", s.err, err)
+			}
+			if err != nil {
+				return
+			}
+			mapped, _, _, _ := mapper.GetMapping("aa.bb", "counter", nil)
+			if mapped.MaxSeries != s.mapped || mapped.OverflowPolicy != s.mappedPolicy {
+				t.Errorf("expected mapping limit %d %s, got %d %s", s.mapped, s.mappedPolicy, mapped.MaxSeries, mapped.OverflowPolicy)
+			}
+			unmapped, _, _, _ := mapper.GetMapping("zz.bb", "counter", nil)
+			if unmapped.MaxSeries != s.unmapped || unmapped.OverflowPolicy != s.unmappedPolicy {
+				t.Errorf("expected unmapped limit %d %s, got %d %s", s.unmapped, s.unmappedPolicy, unmapped.MaxSeries, unmapped.OverflowPolicy)
+			}
+		})
+	}
+}
+
+func TestCounterMode(t *testing.T) {
+	scenarios := []struct {
+		name     string
+		config   string
+		err      bool
+		mapped   counterMode
+		unmapped counterMode
+	}{
+		{
+			name:     "none",
+			config:   "mappings:\n- match: aa.*\n  name: aa\n",
+			mapped:   CounterModeRaw,
+			unmapped: CounterModeRaw,
+		},
+		{
+			name:     "mapping",
+			config:   "mappings:\n- match: aa.*\n  name: aa\n  counter_mode: rate\n",
+			mapped:   CounterModeRate,
+			unmapped: CounterModeRaw,
+		},
+		{
+			name:     "defaults",
+			config:   "defaults:\n  counter_mode: delta\nmappings:\n- match: aa.*\n  name: aa\n",
+			mapped:   CounterModeDelta,
+			unmapped: CounterModeDelta,
+		},
+		{
+			name:     "mapping overrides defaults",
+			config:   "defaults:\n  counter_mode: delta\nmappings:\n- match: aa.*\n  name: aa\n  counter_mode: cumulative\n",
+			mapped:   CounterModeCumulative,
+			unmapped: CounterModeDelta,
+		},
+		{
+			name:   "invalid",
+			config: "mappings:\n- match: aa.*\n  name: aa\n  counter_mode: sum\n",
+			err:    true,
+		},
+	}
+
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			mapper := &MetricMapper{}
+			err := mapper.InitFromYAMLString(s.config)
+			if (err != nil) != s.err {
+				t.Fatalf("expected error %v, got %v", s.err, err)
+			}
+			if err != nil {
+				return
+			}
+			mapped, _, _, _ := mapper.GetMapping("aa.bb", "counter", nil)
+			unmapped, _, _, _ := mapper.GetMapping("zz.bb", "counter", nil)
+			if mapped.CounterMode != s.mapped || unmapped.CounterMode != s.unmapped {
+				t.Errorf("expected counter modes %s and %s, got %s and %s", s.mapped, s.unmapped, mapped.CounterMode, unmapped.CounterMode)
+			}
+		})
+	}
+}
@@ -0,0 +1,49 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mappings
+
+import "fmt"
+
+// overflowPolicy is what happens to the new series of a metric that already
+// has max_series series.
+type overflowPolicy string
+
+const (
+	// OverflowDrop drops the events of new series.
+	OverflowDrop overflowPolicy = "drop"
+	// OverflowSeries collapses new series into one, whose label values are
+	// all OverflowValue.
+	OverflowSeries overflowPolicy = "overflow"
+	OverflowDefault overflowPolicy = ""
+)
+
+// OverflowValue is the value of every label of the series new series are
+// collapsed into by OverflowSeries.
+const OverflowValue = "__overflow__"
+
+func (p *overflowPolicy) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var v string
+
+	if err := unmarshal(&v); err != nil {
+		return err
+	}
+
+	switch overflowPolicy(v) {
+	case OverflowDrop, OverflowSeries, OverflowDefault:
+		*p = overflowPolicy(v)
+	default:
+		return fmt.Errorf("invalid overflow policy %q", v)
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+// Copyright 2013 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mappings
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/jvosantos/statsd_exporter/metrics"
+)
+
+type relabelAction string
+
+const (
+	RelabelReplace   relabelAction = "replace"
+	RelabelKeep      relabelAction = "keep"
+	RelabelDrop      relabelAction = "drop"
+	RelabelHashMod   relabelAction = "hashmod"
+	RelabelLabelMap  relabelAction = "labelmap"
+	RelabelLabelDrop relabelAction = "labeldrop"
+	RelabelLabelKeep relabelAction = "labelkeep"
+)
+
+func (a *relabelAction) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var v string
+	if err := unmarshal(&v); err != nil {
+		return err
+	}
+
+	switch act := relabelAction(strings.ToLower(v)); act {
+	case RelabelReplace, RelabelKeep, RelabelDrop, RelabelHashMod, RelabelLabelMap, RelabelLabelDrop, RelabelLabelKeep:
+		*a = act
+	default:
+		return fmt.Errorf("invalid relabel action %q", v)
+	}
+	return nil
+}
+
+// RelabelConfig rewrites the labels of an event, or drops it, like a
+// Prometheus relabel_config. The values of SourceLabels are joined with
+// Separator and matched against Regex, which is anchored at both ends.
+type RelabelConfig struct {
+	SourceLabels []string      `yaml:"source_labels"`
+	Separator    string        `yaml:"separator"`
+	Regex        string        `yaml:"regex"`
+	Modulus      uint64        `yaml:"modulus"`
+	TargetLabel  string        `yaml:"target_label"`
+	Replacement  string        `yaml:"replacement"`
+	Action       relabelAction `yaml:"action"`
+
+	regex *regexp.Regexp
+}
+
+func (c *RelabelConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain RelabelConfig
+	*c = RelabelConfig{
+		Separator:   ";",
+		Regex:       "(.*)",
+		Replacement: "$1",
+		Action:      RelabelReplace,
+	}
+	return unmarshal((*plain)(c))
+}
+
+// compile validates c and compiles its regex.
+func (c *RelabelConfig) compile() error {
+	regex, err := regexp.Compile("^(?:" + c.Regex + ")$")
+	if err != nil {
+		return fmt.Errorf("invalid relabel regex %s: %v", c.Regex, err)
+	}
+	c.regex = regex
+
+	switch c.Action {
+	case RelabelReplace:
+		if c.TargetLabel == "" {
+			return fmt.Errorf("relabel action %s requires a target_label", c.Action)
+		}
+		if !strings.Contains(c.TargetLabel, "$") && !labelNameRE.MatchString(c.TargetLabel) {
+			return fmt.Errorf("invalid relabel target_label %s", c.TargetLabel)
+		}
+	case RelabelHashMod:
+		if !labelNameRE.MatchString(c.TargetLabel) {
+			return fmt.Errorf("invalid relabel target_label %q", c.TargetLabel)
+		}
+		if c.Modulus == 0 {
+			return fmt.Errorf("relabel action hashmod requires a positive modulus")
+		}
+	case RelabelKeep, RelabelDrop:
+		if len(c.SourceLabels) == 0 {
+			return fmt.Errorf("relabel action %s requires source_labels", c.Action)
+		}
+	case RelabelLabelDrop, RelabelLabelKeep:
+		if len(c.SourceLabels) != 0 || c.TargetLabel != "" {
+			return fmt.Errorf("relabel action %s takes neither source_labels nor a target_label", c.Action)
+		}
+	}
+	return nil
+}
+
+// Relabel applies configs to labels in order, modifying them in place. It
+// returns false if the event they belong to must be dropped.
+func Relabel(labels metrics.Labels, configs []*RelabelConfig) bool {
+	for _, c := range configs {
+		if !c.apply(labels) {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *RelabelConfig) apply(labels metrics.Labels) bool {
+	values := make([]string, len(c.SourceLabels))
+	for i, name := range c.SourceLabels {
+		values[i] = labels[name]
+	}
+	value := strings.Join(values, c.Separator)
+
+	switch c.Action {
+	case RelabelKeep:
+		return c.regex.MatchString(value)
+	case RelabelDrop:
+		return !c.regex.MatchString(value)
+	case RelabelReplace:
+		matches := c.regex.FindStringSubmatchIndex(value)
+		if matches == nil {
+			break
+		}
+		target := string(c.regex.ExpandString(nil, c.TargetLabel, value, matches))
+		if !labelNameRE.MatchString(target) {
+			break
+		}
+		if result := string(c.regex.ExpandString(nil, c.Replacement, value, matches)); result != "" {
+			labels[target] = result
+		} else {
+			delete(labels, target)
+		}
+	case RelabelHashMod:
+		sum := md5.Sum([]byte(value))
+		labels[c.TargetLabel] = fmt.Sprint(binary.BigEndian.Uint64(sum[8:]) % c.Modulus)
+	case RelabelLabelMap:
+		mapped := make(metrics.Labels)
+		for name, v := range labels {
+			if matches := c.regex.FindStringSubmatchIndex(name); matches != nil {
+				mapped[string(c.regex.ExpandString(nil, c.Replacement, name, matches))] = v
+			}
+		}
+		for name, v := range mapped {
+			labels[name] = v
+		}
+	case RelabelLabelDrop:
+		for name := range labels {
+			if c.regex.MatchString(name) {
+				delete(labels, name)
+			}
+		}
+	case RelabelLabelKeep:
+		for name := range labels {
+			if !c.regex.MatchString(name) {
+				delete(labels, name)
+			}
+		}
+	}
+	return true
+}
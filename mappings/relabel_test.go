@@ -0,0 +1,207 @@
+// Copyright 2013 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mappings
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/jvosantos/statsd_exporter/metrics"
+	"gopkg.in/yaml.v2"
+)
+
+func TestRelabel(t *testing.T) {
+	scenarios := []struct {
+		name    string
+		configs string
+		labels  metrics.Labels
+		// expected is nil if the event is dropped.
+		expected metrics.Labels
+	}{
+		{
+			name:     "replace",
+			configs:  "- source_labels: [svc, env]\n  regex: (\\w+);(\\w+)\n  target_label: dest\n  replacement: ${2}_$1\n",
+			labels:   metrics.Labels{"svc": "web", "env": "prod"},
+			expected: metrics.Labels{"svc": "web", "env": "prod", "dest": "prod_web"},
+		},
+		{
+			name:     "replace without match",
+			configs:  "- source_labels: [svc]\n  regex: db\n  target_label: dest\n",
+			labels:   metrics.Labels{"svc": "web"},
+			expected: metrics.Labels{"svc": "web"},
+		},
+		{
+			name:     "replace with empty value",
+			configs:  "- source_labels: [missing]\n  target_label: svc\n",
+			labels:   metrics.Labels{"svc": "web"},
+			expected: metrics.Labels{},
+		},
+		{
+			name:     "keep",
+			configs:  "- source_labels: [env]\n  action: keep\n  regex: prod\n",
+			labels:   metrics.Labels{"env": "prod"},
+			expected: metrics.Labels{"env": "prod"},
+		},
+		{
+			name:    "keep drops",
+			configs: "- source_labels: [env]\n  action: keep\n  regex: prod\n",
+			labels:  metrics.Labels{"env": "production"},
+		},
+		{
+			name:    "drop",
+			configs: "- source_labels: [env]\n  action: drop\n  regex: test\n",
+			labels:  metrics.Labels{"env": "test"},
+		},
+		{
+			name:     "hashmod",
+			configs:  "- source_labels: [svc]\n  action: hashmod\n  modulus: 1\n  target_label: shard\n",
+			labels:   metrics.Labels{"svc": "web"},
+			expected: metrics.Labels{"svc": "web", "shard": "0"},
+		},
+		{
+			name:     "labelmap",
+			configs:  "- action: labelmap\n  regex: tag_(.*)\n",
+			labels:   metrics.Labels{"tag_env": "prod", "svc": "web"},
+			expected: metrics.Labels{"tag_env": "prod", "env": "prod", "svc": "web"},
+		},
+		{
+			name:     "labeldrop",
+			configs:  "- action: labeldrop\n  regex: debug_.*\n",
+			labels:   metrics.Labels{"debug_id": "1", "svc": "web"},
+			expected: metrics.Labels{"svc": "web"},
+		},
+		{
+			name:     "labelkeep",
+			configs:  "- action: labelkeep\n  regex: svc|env\n",
+			labels:   metrics.Labels{"debug_id": "1", "svc": "web", "env": "prod"},
+			expected: metrics.Labels{"svc": "web", "env": "prod"},
+		},
+		{
+			name:     "in order",
+			configs:  "- action: labelmap\n  regex: tag_(.*)\n- action: labeldrop\n  regex: tag_.*\n- source_labels: [env]\n  action: drop\n  regex: test\n",
+			labels:   metrics.Labels{"tag_env": "prod"},
+			expected: metrics.Labels{"env": "prod"},
+		},
+	}
+
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			var configs []*RelabelConfig
+			if err := yaml.Unmarshal([]byte(s.configs), &configs); err != nil {
+				t.Fatal(err)
+			}
+			for _, c := range configs {
+				if err := c.compile(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			kept := Relabel(s.labels, configs)
+			if kept != (s.expected != nil) {
+				t.Fatalf("expected kept %v, got %v", s.expected != nil, kept)
+			}
+			if kept && !reflect.DeepEqual(s.labels, s.expected) {
+				t.Fatalf("expected labels %v, got %v", s.expected, s.labels)
+			}
+		})
+	}
+}
+
+func TestRelabelConfigErrors(t *testing.T) {
+	scenarios := []struct {
+		name    string
+		configs string
+	}{
+		{name: "invalid action", configs: "- action: rename\n  target_label: a\n"},
+		{name: "invalid regex", configs: "- regex: (\n  target_label: a\n"},
+		{name: "replace without target_label", configs: "- source_labels: [a]\n"},
+		{name: "invalid target_label", configs: "- target_label: a-b\n"},
+		{name: "hashmod without modulus", configs: "- action: hashmod\n  target_label: shard\n"},
+		{name: "keep without source_labels", configs: "- action: keep\n"},
+		{name: "labeldrop with target_label", configs: "- action: labeldrop\n  target_label: a\n"},
+	}
+
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			mapper := &MetricMapper{}
+			config := "mappings:\n- match: aa.*\n  name: aa\n  relabel_configs:\n" + indent(s.configs)
+			if err := mapper.InitFromYAMLString(config); err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
+
+// TestDefaultRelabelConfigs checks that the default relabel configs apply to
+// unmapped metrics, and to mapped ones after the configs of their mapping.
+func TestDefaultRelabelConfigs(t *testing.T) {
+	mapper := &MetricMapper{}
+	err := mapper.InitFromYAMLString(`
+defaults:
+  relabel_configs:
+  - action: labeldrop
+    regex: debug_.*
+mappings:
+- match: aa.*
+  name: aa
+- match: bb.*
+  name: bb
+  relabel_configs:
+  - source_labels: [svc]
+    target_label: debug_svc
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	scenarios := []struct {
+		metricName string
+		labels     metrics.Labels
+		expected   metrics.Labels
+	}{
+		{
+			metricName: "aa.xx",
+			labels:     metrics.Labels{"debug_id": "1", "svc": "web"},
+			expected:   metrics.Labels{"svc": "web"},
+		},
+		{
+			metricName: "bb.xx",
+			labels:     metrics.Labels{"debug_id": "1", "svc": "web"},
+			expected:   metrics.Labels{"svc": "web"},
+		},
+	}
+	for _, s := range scenarios {
+		mapping, _, _, _ := mapper.GetMapping(s.metricName, "counter", nil)
+		if !Relabel(s.labels, mapping.RelabelConfigs) || !reflect.DeepEqual(s.labels, s.expected) {
+			t.Errorf("%s: expected labels %v, got %v", s.metricName, s.expected, s.labels)
+		}
+	}
+
+	labels := metrics.Labels{"debug_id": "1", "svc": "web"}
+	if !Relabel(labels, mapper.GetDefaults().RelabelConfigs) || !reflect.DeepEqual(labels, metrics.Labels{"svc": "web"}) {
+		t.Errorf("unmapped: expected labels %v, got %v", metrics.Labels{"svc": "web"}, labels)
+	}
+}
+
+func indent(s string) string {
+	var indented []byte
+	start := true
+	for i := 0; i < len(s); i++ {
+		if start {
+			indented = append(indented, "  "...)
+		}
+		indented = append(indented, s[i])
+		start = s[i] == '\n'
+	}
+	return string(indented)
+}
@@ -0,0 +1,144 @@
+// Copyright 2013 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mappings
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"text/template"
+	"text/template/parse"
+
+	"github.com/jvosantos/statsd_exporter/metrics"
+)
+
+// templateFuncs are the functions available in name and label templates.
+// Functions taking a string take it last, so that it can be piped in.
+var templateFuncs = template.FuncMap{
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+	"replace": func(old, new, s string) string {
+		return strings.Replace(s, old, new, -1)
+	},
+	"trimPrefix": func(prefix, s string) string {
+		return strings.TrimPrefix(s, prefix)
+	},
+	"trimSuffix": func(suffix, s string) string {
+		return strings.TrimSuffix(s, suffix)
+	},
+	"default": func(def, s string) string {
+		if s == "" {
+			return def
+		}
+		return s
+	},
+}
+
+// templateData is what name and label templates are executed on. The
+// captures of the match are also available as the variables $0, $1, ...
+type templateData struct {
+	Name       string
+	MetricType metrics.MetricType
+	Labels     metrics.Labels
+	Captures   []string
+}
+
+// isTemplate reports whether a mapping name or label value is a template
+// rather than a plain $n expansion.
+func isTemplate(text string) bool {
+	return strings.Contains(text, "{{")
+}
+
+// compileTemplate parses text for a match with the given number of capture
+// groups, and executes it once to catch errors early.
+func compileTemplate(text string, captures int) (*template.Template, error) {
+	var variables strings.Builder
+	for i := 0; i <= captures; i++ {
+		fmt.Fprintf(&variables, "{{$%d := index .Captures %d}}", i, i)
+	}
+
+	t, err := template.New("").Option("missingkey=zero").Funcs(templateFuncs).Parse(variables.String() + text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid template %q: %v", text, err)
+	}
+	data := templateData{Labels: metrics.Labels{}, Captures: make([]string, captures+1)}
+	if err := t.Execute(ioutil.Discard, data); err != nil {
+		return nil, fmt.Errorf("invalid template %q: %v", text, err)
+	}
+	return t, nil
+}
+
+// usesLabels reports whether t may read the labels of events: through a
+// .Labels or $.Labels field, or by handing the whole data, . or $, to a
+// function such as index, to a template or to the output.
+func usesLabels(t *template.Template) bool {
+	return t.Tree != nil && nodeUsesLabels(t.Tree.Root)
+}
+
+func nodeUsesLabels(node parse.Node) bool {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return false
+		}
+		for _, node := range n.Nodes {
+			if nodeUsesLabels(node) {
+				return true
+			}
+		}
+	case *parse.ActionNode:
+		return nodeUsesLabels(n.Pipe)
+	case *parse.PipeNode:
+		if n == nil {
+			return false
+		}
+		for _, cmd := range n.Cmds {
+			if nodeUsesLabels(cmd) {
+				return true
+			}
+		}
+	case *parse.CommandNode:
+		for _, arg := range n.Args {
+			if nodeUsesLabels(arg) {
+				return true
+			}
+		}
+	case *parse.IfNode:
+		return nodeUsesLabels(n.Pipe) || nodeUsesLabels(n.List) || nodeUsesLabels(n.ElseList)
+	case *parse.RangeNode:
+		return nodeUsesLabels(n.Pipe) || nodeUsesLabels(n.List) || nodeUsesLabels(n.ElseList)
+	case *parse.WithNode:
+		return nodeUsesLabels(n.Pipe) || nodeUsesLabels(n.List) || nodeUsesLabels(n.ElseList)
+	case *parse.ChainNode:
+		return nodeUsesLabels(n.Node)
+	case *parse.FieldNode:
+		return n.Ident[0] == "Labels"
+	case *parse.VariableNode:
+		return n.Ident[0] == "$" && (len(n.Ident) == 1 || n.Ident[1] == "Labels")
+	case *parse.DotNode, *parse.TemplateNode:
+		return true
+	}
+	return false
+}
+
+// executeTemplate executes t on data. Templates checked at load time can
+// still fail on the names and labels of actual events, e.g. indexing past the
+// captures of an optional group.
+func executeTemplate(t *template.Template, data *templateData) (string, error) {
+	var b strings.Builder
+	if err := t.Execute(&b, data); err != nil {
+		return "", fmt.Errorf("executing template for %s: %v", data.Name, err)
+	}
+	return b.String(), nil
+}
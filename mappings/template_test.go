@@ -0,0 +1,156 @@
+// Copyright 2013 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mappings
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/jvosantos/statsd_exporter/metrics"
+)
+
+const testTemplates = `
+mappings:
+- match: svc.*.*
+  name: '{{ .Labels.env | default "prod" }}_{{ lower $2 }}'
+  labels:
+    kind: '{{ .MetricType }}'
+    svc: '{{ $1 | trimPrefix "app_" | replace "_" "-" | upper }}'
+    plain: "$1"
+- match: env.*
+  name: '{{ .Labels.env }}'
+- match: opt.*
+  name: opt
+  labels:
+    extra: '{{ if .Labels.env }}{{ index .Captures 9 }}{{ end }}'
+`
+
+func TestTemplates(t *testing.T) {
+	scenarios := []struct {
+		name        string
+		metricName  string
+		eventLabels metrics.Labels
+		mapping     string
+		labels      metrics.Labels
+		err         bool
+	}{
+		{
+			name:       "functions and captures",
+			metricName: "svc.app_foo_bar.Latency",
+			mapping:    "prod_latency",
+			labels:     metrics.Labels{"kind": "timer", "svc": "FOO-BAR", "plain": "app_foo_bar"},
+		},
+		{
+			name:        "event labels",
+			metricName:  "svc.app_foo_bar.Latency",
+			eventLabels: metrics.Labels{"env": "dev"},
+			mapping:     "dev_latency",
+			labels:      metrics.Labels{"kind": "timer", "svc": "FOO-BAR", "plain": "app_foo_bar"},
+		},
+		{
+			name:        "label name",
+			metricName:  "env.x",
+			eventLabels: metrics.Labels{"env": "dev"},
+			mapping:     "dev",
+			labels:      metrics.Labels{},
+		},
+		{
+			name:       "empty name",
+			metricName: "env.x",
+			err:        true,
+		},
+		{
+			name:       "label template",
+			metricName: "opt.x",
+			mapping:    "opt",
+			labels:     metrics.Labels{"extra": ""},
+		},
+		{
+			name:        "label template fails",
+			metricName:  "opt.x",
+			eventLabels: metrics.Labels{"env": "dev"},
+			err:         true,
+		},
+	}
+
+	// Results are cached per label set when templates read labels.
+	for _, cacheSize := range []int{0, 1000} {
+		mapper := &MetricMapper{}
+		mapper.InitCache(cacheSize)
+		if err := mapper.InitFromYAMLString(testTemplates); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 2; i++ {
+			for _, s := range scenarios {
+				mapping, labels, present, err := mapper.GetMapping(s.metricName, "timer", s.eventLabels)
+				if !present {
+					t.Fatalf("cache %d, %s: expected a mapping", cacheSize, s.name)
+				}
+				if (err != nil) != s.err {
+					t.Fatalf("cache %d, %s: unexpected error %v", cacheSize, s.name, err)
+				}
+				if err != nil {
+					continue
+				}
+				if mapping.Name != s.mapping || !reflect.DeepEqual(labels, s.labels) {
+					t.Errorf("cache %d, %s: expected %s%v, got %s%v", cacheSize, s.name, s.mapping, s.labels, mapping.Name, labels)
+				}
+			}
+		}
+	}
+}
+
+func TestTemplateErrors(t *testing.T) {
+	scenarios := []string{
+		"'{{ nope $1 }}'",
+		"'{{ $3 }}'",
+		"'{{ lower }}'",
+		"'{{ .Foo }}'",
+		"'{{ lower'",
+	}
+
+	for _, name := range scenarios {
+		mapper := &MetricMapper{}
+		if err := mapper.InitFromYAMLString("mappings:\n- match: svc.*.*\n  name: " + name + "\n"); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestUsesLabels(t *testing.T) {
+	scenarios := []struct {
+		text       string
+		usesLabels bool
+	}{
+		{text: `{{ $1 | upper }}`},
+		{text: `{{ .Name }}_{{ .Captures }}`},
+		{text: `{{ range .Captures }}{{ end }}`},
+		{text: `{{ .Labels.env }}`, usesLabels: true},
+		{text: `{{ printf "%v" . | upper }}`, usesLabels: true},
+		{text: `{{ with $.Labels }}{{ .env }}{{ end }}`, usesLabels: true},
+		{text: `{{ $ }}`, usesLabels: true},
+		{text: `{{ if eq $1 "x" }}{{ default "a" (index $.Labels "env") }}{{ end }}`, usesLabels: true},
+		{text: `{{ $x := . }}{{ $x.Name }}`, usesLabels: true},
+	}
+
+	for _, s := range scenarios {
+		tmpl, err := compileTemplate(s.text, 1)
+		if err != nil {
+			t.Fatalf("%s: %v", s.text, err)
+		}
+		if got := usesLabels(tmpl); got != s.usesLabels {
+			t.Errorf("%s: expected %v, got %v", s.text, s.usesLabels, got)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright 2013 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mappings
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+type unit struct {
+	dimension string
+	factor    float64
+}
+
+// units are the units conversions can convert between, with their size in
+// the base unit of their dimension.
+var units = map[string]unit{
+	"ns":    {"time", 1e-9},
+	"us":    {"time", 1e-6},
+	"ms":    {"time", 1e-3},
+	"s":     {"time", 1},
+	"m":     {"time", 60},
+	"h":     {"time", 3600},
+	"bytes": {"size", 1},
+	"kb":    {"size", 1e3},
+	"mb":    {"size", 1e6},
+	"gb":    {"size", 1e9},
+	"kib":   {"size", 1 << 10},
+	"mib":   {"size", 1 << 20},
+	"gib":   {"size", 1 << 30},
+}
+
+// ValueTransform rewrites event values. Values are converted, multiplied by
+// Scale, shifted by Offset and finally rounded to Round decimal places.
+// Histogram buckets are given in the unit of the values before the
+// transform, and are converted, scaled and shifted along with them.
+type ValueTransform struct {
+	// Conversion converts between two units of the same dimension, such as
+	// ms_to_s or bytes_to_kib.
+	Conversion string   `yaml:"conversion"`
+	Scale      float64  `yaml:"scale"`
+	Offset     float64  `yaml:"offset"`
+	Round      *int     `yaml:"round"`
+	// Unit is recorded in the documents of the metric. It defaults to the
+	// target unit of Conversion.
+	Unit       string   `yaml:"unit"`
+
+	factor float64
+}
+
+func (v *ValueTransform) compile() error {
+	v.factor = 1
+	if v.Conversion != "" {
+		parts := strings.Split(v.Conversion, "_to_")
+		if len(parts) != 2 {
+			return fmt.Errorf("invalid value conversion %q", v.Conversion)
+		}
+		from, ok := units[parts[0]]
+		if !ok {
+			return fmt.Errorf("value conversion %q: unknown unit %q", v.Conversion, parts[0])
+		}
+		to, ok := units[parts[1]]
+		if !ok {
+			return fmt.Errorf("value conversion %q: unknown unit %q", v.Conversion, parts[1])
+		}
+		if from.dimension != to.dimension {
+			return fmt.Errorf("value conversion %q converts %s to %s", v.Conversion, from.dimension, to.dimension)
+		}
+		v.factor = from.factor / to.factor
+		if v.Unit == "" {
+			v.Unit = parts[1]
+		}
+	}
+	if v.Scale != 0 {
+		v.factor *= v.Scale
+	}
+	if v.Round != nil && (*v.Round < 0 || *v.Round > 15) {
+		return fmt.Errorf("value round must be between 0 and 15 decimal places")
+	}
+	return nil
+}
+
+// Apply transforms value. Offset and rounding only apply to absolute values,
+// not to counter increments and relative gauge updates, which would
+// otherwise be shifted and accumulate rounding errors on every update.
+func (v *ValueTransform) Apply(value float64, absolute bool) float64 {
+	value *= v.factor
+	if !absolute {
+		return value
+	}
+	value += v.Offset
+	if v.Round != nil {
+		p := math.Pow10(*v.Round)
+		value = math.Round(value*p) / p
+	}
+	return value
+}
+
+// buckets returns the histogram bucket bounds for the transformed values,
+// in increasing order even for negative scales. They aren't rounded, which
+// could merge neighbouring buckets.
+func (v *ValueTransform) buckets(buckets []float64) []float64 {
+	transformed := make([]float64, len(buckets))
+	for i, bound := range buckets {
+		if v.factor < 0 {
+			i = len(buckets) - 1 - i
+		}
+		transformed[i] = bound*v.factor + v.Offset
+	}
+	return transformed
+}
@@ -0,0 +1,121 @@
+// Copyright 2013 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mappings
+
+import (
+	"math"
+	"reflect"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestValueTransform(t *testing.T) {
+	scenarios := []struct {
+		name      string
+		transform string
+		value     float64
+		absolute  bool
+		expected  float64
+		unit      string
+	}{
+		{name: "conversion", transform: "conversion: ms_to_s", value: 1500, absolute: true, expected: 1.5, unit: "s"},
+		{name: "binary size", transform: "conversion: bytes_to_kib", value: 2048, absolute: true, expected: 2, unit: "kib"},
+		{name: "explicit unit", transform: "conversion: ms_to_s\nunit: seconds", value: 500, absolute: true, expected: 0.5, unit: "seconds"},
+		{name: "scale and offset", transform: "scale: 2\noffset: -1", value: 3, absolute: true, expected: 5},
+		{name: "round", transform: "conversion: us_to_ms\nround: 1", value: 1234, absolute: true, expected: 1.2, unit: "ms"},
+		{name: "round to integer", transform: "round: 0", value: 2.5, absolute: true, expected: 3},
+		{name: "relative without offset", transform: "scale: 2\noffset: 10", value: 3, expected: 6},
+		{name: "relative without rounding", transform: "scale: 0.1\nround: 0", value: 3, expected: 0.3},
+	}
+
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			var v ValueTransform
+			if err := yaml.Unmarshal([]byte(s.transform), &v); err != nil {
+				t.Fatal(err)
+			}
+			if err := v.compile(); err != nil {
+				t.Fatal(err)
+			}
+			if got := v.Apply(s.value, s.absolute); math.Abs(got-s.expected) > 1e-9 {
+				t.Errorf("expected %v, got %v", s.expected, got)
+			}
+			if v.Unit != s.unit {
+				t.Errorf("expected unit %q, got %q", s.unit, v.Unit)
+			}
+		})
+	}
+}
+
+func TestValueTransformErrors(t *testing.T) {
+	scenarios := []string{
+		"conversion: ms",
+		"conversion: ms_to_parsecs",
+		"conversion: ms_to_bytes",
+		"round: 16",
+		"round: -1",
+	}
+
+	for _, transform := range scenarios {
+		var v ValueTransform
+		if err := yaml.Unmarshal([]byte(transform), &v); err != nil {
+			t.Fatal(err)
+		}
+		if err := v.compile(); err == nil {
+			t.Errorf("%q: expected an error", transform)
+		}
+	}
+}
+
+func TestValueTransformBuckets(t *testing.T) {
+	scenarios := []struct {
+		name     string
+		mapping  string
+		defaults string
+		expected []float64
+	}{
+		{
+			name:     "converted defaults",
+			defaults: "  buckets: [100, 1000]\n",
+			mapping:  "  value:\n    conversion: ms_to_s\n",
+			expected: []float64{0.1, 1},
+		},
+		{
+			name:     "converted buckets",
+			mapping:  "  buckets: [1, 2]\n  value:\n    scale: 10\n    offset: 1\n",
+			expected: []float64{11, 21},
+		},
+		{
+			name:     "negative scale",
+			mapping:  "  buckets: [1, 2]\n  value:\n    scale: -1\n",
+			expected: []float64{-2, -1},
+		},
+	}
+
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			config := "defaults:\n  timer_type: histogram\n" + s.defaults +
+				"mappings:\n- match: aa.*\n  name: aa\n" + s.mapping
+			mapper := &MetricMapper{}
+			if err := mapper.InitFromYAMLString(config); err != nil {
+				t.Fatal(err)
+			}
+			mapping, _, _, _ := mapper.GetMapping("aa.bb", "timer", nil)
+			if !reflect.DeepEqual(mapping.Buckets, s.expected) {
+				t.Fatalf("expected buckets %v, got %v", s.expected, mapping.Buckets)
+			}
+		})
+	}
+}
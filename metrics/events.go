@@ -2,6 +2,7 @@ package metrics
 
 import (
 	"fmt"
+	"sync"
 	"time"
 )
 
@@ -14,32 +15,63 @@ type Event interface {
 	Value() float64
 	Labels() Labels
 	MetricType() MetricType
+	// SampleRate is the rate the event was sampled at by the client. The
+	// event stands for 1/SampleRate occurrences; counter values are already
+	// scaled accordingly.
+	SampleRate() float64
 }
 
-func NewEvent(statType, metric string, value float64, relative bool, labels Labels) (Event, error) {
+// Events and label sets are recycled through these pools. Whoever consumes
+// events hands them back with ReleaseEvents once done with them.
+var (
+	counterEventPool = sync.Pool{New: func() interface{} { return &CounterEvent{} }}
+	gaugeEventPool   = sync.Pool{New: func() interface{} { return &GaugeEvent{} }}
+	timerEventPool   = sync.Pool{New: func() interface{} { return &TimerEvent{} }}
+	labelsPool       = sync.Pool{New: func() interface{} { return Labels{} }}
+
+	// Event slices are pooled through pointers, as putting a slice itself in
+	// a pool allocates. emptyEventsPool recycles the pointers of the slices
+	// taken out of eventsPool.
+	eventsPool      = sync.Pool{New: func() interface{} { return new(Events) }}
+	emptyEventsPool = sync.Pool{New: func() interface{} { return new(Events) }}
+)
+
+// maxPooledEvents is the capacity above which released event slices are left
+// to the garbage collector instead of being pooled.
+const maxPooledEvents = 1024
+
+func NewEvent(statType, metric string, value float64, relative bool, sampleRate float64, labels Labels) (Event, error) {
 	switch statType {
 	case "c":
-		return &CounterEvent{
+		event := counterEventPool.Get().(*CounterEvent)
+		*event = CounterEvent{
 			timestamp:  time.Now(),
 			metricName: metric,
 			value:      float64(value),
+			sampleRate: sampleRate,
 			labels:     labels,
-		}, nil
+		}
+		return event, nil
 	case "g":
-		return &GaugeEvent{
+		event := gaugeEventPool.Get().(*GaugeEvent)
+		*event = GaugeEvent{
 			timestamp:  time.Now(),
 			metricName: metric,
 			value:      float64(value),
 			relative:   relative,
 			labels:     labels,
-		}, nil
+		}
+		return event, nil
 	case "ms", "h":
-		return &TimerEvent{
+		event := timerEventPool.Get().(*TimerEvent)
+		*event = TimerEvent{
 			timestamp:  time.Now(),
 			metricName: metric,
 			value:      float64(value),
+			sampleRate: sampleRate,
 			labels:     labels,
-		}, nil
+		}
+		return event, nil
 	case "s":
 		return nil, fmt.Errorf("no support for StatsD sets")
 	default:
@@ -47,21 +79,91 @@ func NewEvent(statType, metric string, value float64, relative bool, labels Labe
 	}
 }
 
+// NewLabels returns an empty label set, reusing one released along with an
+// event when possible.
+func NewLabels() Labels {
+	return labelsPool.Get().(Labels)
+}
+
+// NewEvents returns an empty slice of events, reusing one released with
+// ReleaseEvents when possible.
+func NewEvents() Events {
+	p := eventsPool.Get().(*Events)
+	events := *p
+	*p = nil
+	emptyEventsPool.Put(p)
+	return events[:0]
+}
+
+// ReleaseEvents returns events, the slice holding them and their label sets
+// to the pools used by NewEvent, NewEvents and NewLabels. None of them may be
+// used after being released.
+func ReleaseEvents(events Events) {
+	defer releaseEventSlice(events)
+	for _, event := range events {
+		switch ev := event.(type) {
+		case *CounterEvent:
+			releaseLabels(ev.labels)
+			*ev = CounterEvent{}
+			counterEventPool.Put(ev)
+		case *GaugeEvent:
+			releaseLabels(ev.labels)
+			*ev = GaugeEvent{}
+			gaugeEventPool.Put(ev)
+		case *TimerEvent:
+			releaseLabels(ev.labels)
+			*ev = TimerEvent{}
+			timerEventPool.Put(ev)
+		}
+	}
+}
+
+// ReleaseEventSlice returns the slice holding events to the pool used by
+// NewEvents, leaving the events themselves in use, such as after they were
+// moved to other slices.
+func ReleaseEventSlice(events Events) {
+	releaseEventSlice(events)
+}
+
+func releaseEventSlice(events Events) {
+	if cap(events) == 0 || cap(events) > maxPooledEvents {
+		return
+	}
+	for i := range events {
+		events[i] = nil
+	}
+	p := emptyEventsPool.Get().(*Events)
+	*p = events[:0]
+	eventsPool.Put(p)
+}
+
+func releaseLabels(labels Labels) {
+	if labels == nil {
+		return
+	}
+	for name := range labels {
+		delete(labels, name)
+	}
+	labelsPool.Put(labels)
+}
+
 type CounterEvent struct {
 	timestamp  time.Time
 	metricName string
 	value      float64
+	sampleRate float64
 	labels     Labels
 }
 
 func NewCounterEvent(metricName string, value float64, labels Labels) CounterEvent {
-	return CounterEvent{metricName:metricName, value:value, labels:labels}
+	return CounterEvent{metricName:metricName, value:value, sampleRate:1, labels:labels}
 }
 func (c *CounterEvent) MetricName() string        { return c.metricName }
 func (c *CounterEvent) Value() float64            { return c.value }
 func (c *CounterEvent) Labels() Labels 			  { return c.labels }
 func (c *CounterEvent) MetricType() MetricType    { return metricTypeCounter }
 func (c *CounterEvent) Timestamp() time.Time	  { return c.timestamp }
+func (c *CounterEvent) SampleRate() float64       { return c.sampleRate }
 
 type GaugeEvent struct {
 	timestamp  time.Time
@@ -80,19 +182,22 @@ func (g *GaugeEvent) Labels() Labels			{ return g.labels }
 func (g *GaugeEvent) MetricType() MetricType    { return metricTypeGauge }
 func (g *GaugeEvent) Relative() bool 			{ return g.relative }
 func (g *GaugeEvent) Timestamp() time.Time	    { return g.timestamp }
+func (g *GaugeEvent) SampleRate() float64       { return 1 }
 
 type TimerEvent struct {
 	timestamp  time.Time
 	metricName string
 	value      float64
+	sampleRate float64
 	labels     Labels
 }
 
 func NewTimerEvent(metricName string, value float64, labels Labels) TimerEvent {
-	return TimerEvent{metricName:metricName, value:value, labels:labels}
+	return TimerEvent{metricName:metricName, value:value, sampleRate:1, labels:labels}
 }
 func (t *TimerEvent) MetricName() string        { return t.metricName }
 func (t *TimerEvent) Value() float64            { return t.value }
 func (t *TimerEvent) Labels() Labels 			{ return t.labels }
 func (t *TimerEvent) MetricType() MetricType    { return metricTypeTimer }
 func (t *TimerEvent) Timestamp() time.Time	    { return t.timestamp }
+func (t *TimerEvent) SampleRate() float64       { return t.sampleRate }
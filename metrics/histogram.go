@@ -1,25 +1,65 @@
 package metrics
 
+import (
+	"math"
+	"sort"
+	"sync"
+)
+
+// DefBuckets are the default histogram buckets, in milliseconds as StatsD
+// timers are.
+var DefBuckets = []float64{5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000}
+
 type histogram struct {
-	valBits []float64
+	mutex       sync.Mutex
+	upperBounds []float64
+	counts      []float64
+	count       float64
+	sum         float64
 
 	labels Labels
 	name string
 	description string
+	unit string
+}
+
+// Bucket is the number of observations less than or equal to UpperBound.
+type Bucket struct {
+	UpperBound float64
+	Count      float64
 }
 
 type Histogram interface {
-	// Set sets the Gauge to an arbitrary value.
+	// Observe adds a single observation to the Histogram.
 	Observe(float64)
+	// ObserveWeighted adds an observation standing for weight observations of
+	// the same value, such as a sampled timer.
+	ObserveWeighted(value, weight float64)
 
 	Name() string
-	Value() []float64
+	Count() float64
+	Sum() float64
+	// Buckets returns the cumulative bucket counts, excluding the implicit
+	// +Inf bucket whose count is Count.
+	Buckets() []Bucket
 	Description() string
+	// Unit is the unit of the observed values, if known.
+	Unit() string
 	Labels() Labels
 }
 
-func NewHistogram(name, description string, labels Labels) Histogram {
-	result := &histogram{name: name, description: description, labels: labels}
+func NewHistogram(name, description, unit string, labels Labels, buckets []float64) Histogram {
+	if len(buckets) == 0 {
+		buckets = DefBuckets
+	}
+	result := &histogram{
+		name:        name,
+		description: description,
+		unit:        unit,
+		labels:      labels,
+		upperBounds: buckets,
+		counts:      make([]float64, len(buckets)),
+	}
 	return result
 }
 
@@ -27,18 +67,82 @@ func (h *histogram) Name() string {
 	return h.name
 }
 
-func (h *histogram) Value() []float64 {
-	return h.valBits
+func (h *histogram) Count() float64 {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.count
+}
+
+func (h *histogram) Sum() float64 {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.sum
+}
+
+func (h *histogram) Buckets() []Bucket {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	buckets := make([]Bucket, len(h.upperBounds))
+	cumulative := 0.0
+	for i, upperBound := range h.upperBounds {
+		cumulative += h.counts[i]
+		buckets[i] = Bucket{UpperBound: upperBound, Count: cumulative}
+	}
+	return buckets
 }
 
 func (h *histogram) Description() string {
 	return h.description
 }
 
+func (h *histogram) Unit() string {
+	return h.unit
+}
+
 func (h *histogram) Labels() Labels {
 	return h.labels
 }
 
 func (h *histogram) Observe(val float64) {
-	h.valBits = append(h.valBits, val)
+	h.ObserveWeighted(val, 1)
+}
+
+func (h *histogram) ObserveWeighted(val, weight float64) {
+	if math.IsNaN(val) || weight <= 0 {
+		return
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	// Values above the largest upper bound only count towards +Inf.
+	if i := sort.SearchFloat64s(h.upperBounds, val); i < len(h.upperBounds) {
+		h.counts[i] += weight
+	}
+	h.count += weight
+	h.sum += val * weight
+}
+
+// RestoreHistogram returns a histogram holding the observations described by
+// the cumulative bucket counts, count and sum of another histogram, such as
+// one saved before a restart.
+func RestoreHistogram(name, description, unit string, labels Labels, buckets []Bucket, count, sum float64) Histogram {
+	h := &histogram{
+		name:        name,
+		description: description,
+		unit:        unit,
+		labels:      labels,
+		upperBounds: make([]float64, len(buckets)),
+		counts:      make([]float64, len(buckets)),
+		count:       count,
+		sum:         sum,
+	}
+	previous := 0.0
+	for i, bucket := range buckets {
+		h.upperBounds[i] = bucket.UpperBound
+		h.counts[i] = bucket.Count - previous
+		previous = bucket.Count
+	}
+	return h
 }
@@ -0,0 +1,68 @@
+package metrics
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestHistogramObserveWeighted(t *testing.T) {
+	type observation struct {
+		value, weight float64
+	}
+	scenarios := []struct {
+		name         string
+		observations []observation
+		count, sum   float64
+		buckets      []Bucket
+	}{
+		{
+			name:         "unweighted",
+			observations: []observation{{1, 1}, {5, 1}, {20, 1}},
+			count:        3,
+			sum:          26,
+			buckets:      []Bucket{{1, 1}, {10, 2}},
+		},
+		{
+			name:         "sampled",
+			observations: []observation{{1, 10}, {5, 4}},
+			count:        14,
+			sum:          30,
+			buckets:      []Bucket{{1, 10}, {10, 14}},
+		},
+		{
+			name:         "above largest bucket",
+			observations: []observation{{100, 2}},
+			count:        2,
+			sum:          200,
+			buckets:      []Bucket{{1, 0}, {10, 0}},
+		},
+		{
+			name:         "ignored",
+			observations: []observation{{math.NaN(), 1}, {1, 0}, {1, -1}},
+			buckets:      []Bucket{{1, 0}, {10, 0}},
+		},
+	}
+
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			h := NewHistogram("h", "", "", nil, []float64{1, 10})
+			for _, o := range s.observations {
+				h.ObserveWeighted(o.value, o.weight)
+			}
+			if h.Count() != s.count || h.Sum() != s.sum {
+				t.Fatalf("expected count %v and sum %v, got %v and %v", s.count, s.sum, h.Count(), h.Sum())
+			}
+			if buckets := h.Buckets(); !reflect.DeepEqual(buckets, s.buckets) {
+				t.Fatalf("expected buckets %v, got %v", s.buckets, buckets)
+			}
+		})
+	}
+}
+
+func TestNewHistogramDefaultBuckets(t *testing.T) {
+	h := NewHistogram("h", "", "", nil, nil)
+	if len(h.Buckets()) != len(DefBuckets) {
+		t.Fatalf("expected %d default buckets, got %v", len(DefBuckets), h.Buckets())
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/fsnotify/fsnotify"
+	"github.com/jvosantos/statsd_exporter/mappings"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// mappingReloader reloads the mapping configuration at path into mapper.
+// Reloads are serialized; a configuration that fails to load leaves the
+// current one in place.
+type mappingReloader struct {
+	path   string
+	mapper *mappings.MetricMapper
+	mutex  sync.Mutex
+}
+
+// reload loads the configuration again. Unless force is set, it is only
+// replaced if the contents of its files changed.
+func (r *mappingReloader) reload(trigger string, force bool) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	changed, err := r.mapper.ReloadFromFile(r.path, force)
+	if err != nil {
+		glog.Errorf("Error reloading config on %s: %v", trigger, err)
+		configLoads.WithLabelValues("failure").Inc()
+		configLastReloadSuccessful.Set(0)
+		return err
+	}
+	if !changed {
+		glog.V(10).Infof("Config unchanged on %s", trigger)
+		return nil
+	}
+	glog.Infof("Config reloaded successfully on %s", trigger)
+	r.loaded()
+	return nil
+}
+
+// loaded records a successful load of the configuration.
+func (r *mappingReloader) loaded() {
+	configLoads.WithLabelValues("success").Inc()
+	configLastReloadSuccessful.Set(1)
+	configLastReloadSuccess.SetToCurrentTime()
+	mappingsCount.Set(float64(r.mapper.MappingCount()))
+}
+
+// watch reloads the configuration on SIGHUP, whenever files are created,
+// modified, renamed or removed in the directories of the files it was loaded
+// from and, every interval, if the contents of its files changed. Watching
+// the directories rather than the files catches files replaced by renaming,
+// symlinks swapped by Kubernetes ConfigMap updates and files added to
+// configuration directories; as reloads are skipped when the contents of
+// the files didn't change, unrelated changes in the directories are cheap.
+// The interval catches changes the watches still miss, such as files of
+// directories only included by a glob that matched nothing in them. An
+// interval of 0 disables it.
+func (r *mappingReloader) watch(interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		glog.Fatal(err)
+	}
+
+	watched := map[string]bool{}
+	watchDirs := func() {
+		dirs := map[string]bool{}
+		if info, err := os.Stat(r.path); err == nil && info.IsDir() {
+			dirs[r.path] = true
+		} else {
+			dirs[filepath.Dir(r.path)] = true
+		}
+		for _, fileName := range r.mapper.Files() {
+			dirs[filepath.Dir(fileName)] = true
+		}
+		for dir := range dirs {
+			if watched[dir] {
+				continue
+			}
+			if err := watcher.Add(dir); err != nil {
+				glog.Errorf("Error watching config directory %s: %v", dir, err)
+				delete(dirs, dir)
+			}
+		}
+		for dir := range watched {
+			if !dirs[dir] {
+				_ = watcher.Remove(dir)
+			}
+		}
+		watched = dirs
+	}
+	watchDirs()
+
+	for {
+		select {
+		case <-hup:
+			r.reload("SIGHUP", true)
+		case ev := <-watcher.Events:
+			glog.V(1).Infof("Config directory changed (%s), attempting reload", ev)
+			r.reload("file change", false)
+		case <-tick:
+			r.reload("check", false)
+		case err := <-watcher.Errors:
+			glog.Errorln("Error watching config:", err)
+			continue
+		}
+		watchDirs()
+	}
+}
+
+// reloadHandler reloads the configuration on POST requests.
+func reloadHandler(r *mappingReloader) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "reloading requires a POST request", http.StatusMethodNotAllowed)
+			return
+		}
+		if r == nil {
+			http.Error(w, "no mapping configuration to reload", http.StatusBadRequest)
+			return
+		}
+		if err := r.reload("HTTP request", true); err != nil {
+			http.Error(w, fmt.Sprintf("failed to reload config: %v", err), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintln(w, "Config reloaded successfully")
+	}
+}
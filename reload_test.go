@@ -0,0 +1,141 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jvosantos/statsd_exporter/mappings"
+)
+
+const testReloadMappings = "mappings:\n- match: aa.*\n  name: aa\n"
+
+func newTestReloader(t *testing.T, fileName string) *mappingReloader {
+	if err := ioutil.WriteFile(fileName, []byte(testReloadMappings), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mapper := &mappings.MetricMapper{}
+	if err := mapper.InitFromFile(fileName); err != nil {
+		t.Fatal(err)
+	}
+	return &mappingReloader{path: fileName, mapper: mapper}
+}
+
+func TestReloadHandler(t *testing.T) {
+	scenarios := []struct {
+		name   string
+		method string
+		// config replaces the configuration file unless empty.
+		config   string
+		noConfig bool
+		code     int
+		mappings int
+	}{
+		{name: "get", method: "GET", code: http.StatusMethodNotAllowed, mappings: 1},
+		{name: "unchanged", method: "POST", code: http.StatusOK, mappings: 1},
+		{name: "changed", method: "POST", config: testReloadMappings + "- match: bb.*\n  name: bb\n", code: http.StatusOK, mappings: 2},
+		{name: "invalid", method: "POST", config: "mappings:\n- match: aa.*\n", code: http.StatusInternalServerError, mappings: 1},
+		{name: "no configuration", method: "POST", noConfig: true, code: http.StatusBadRequest},
+	}
+
+	dir, err := ioutil.TempDir("", "reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			fileName := filepath.Join(dir, "mappings.yaml")
+			r := newTestReloader(t, fileName)
+			if s.config != "" {
+				if err := ioutil.WriteFile(fileName, []byte(s.config), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			handler := reloadHandler(r)
+			if s.noConfig {
+				handler = reloadHandler(nil)
+			}
+
+			w := httptest.NewRecorder()
+			handler(w, httptest.NewRequest(s.method, "/-/reload", nil))
+			if w.Code != s.code {
+				t.Errorf("expected status %d, got %d: %s", s.code, w.Code, w.Body.String())
+			}
+			if !s.noConfig && r.mapper.MappingCount() != s.mappings {
+				t.Errorf("expected %d mappings, got %d", s.mappings, r.mapper.MappingCount())
+			}
+		})
+	}
+}
+
+// TestWatch changes configuration files the ways editors and deployments do,
+// which the watches of their directories must all catch.
+func TestWatch(t *testing.T) {
+	const two = testReloadMappings + "- match: bb.*\n  name: bb\n"
+	scenarios := []struct {
+		name string
+		// path is the configuration path, relative to the directory.
+		path   string
+		change func(dir string) error
+	}{
+		{
+			name: "written",
+			path: "mappings.yaml",
+			change: func(dir string) error {
+				return ioutil.WriteFile(filepath.Join(dir, "mappings.yaml"), []byte(two), 0644)
+			},
+		},
+		{
+			name: "renamed over",
+			path: "mappings.yaml",
+			change: func(dir string) error {
+				tmp := filepath.Join(dir, ".mappings.yaml.tmp")
+				if err := ioutil.WriteFile(tmp, []byte(two), 0644); err != nil {
+					return err
+				}
+				return os.Rename(tmp, filepath.Join(dir, "mappings.yaml"))
+			},
+		},
+		{
+			name: "added to directory",
+			path: ".",
+			change: func(dir string) error {
+				return ioutil.WriteFile(filepath.Join(dir, "more.yaml"), []byte("mappings:\n- match: bb.*\n  name: bb\n"), 0644)
+			},
+		},
+	}
+
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "watch")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			r := newTestReloader(t, filepath.Join(dir, "mappings.yaml"))
+			r.path = filepath.Join(dir, s.path)
+			if err := r.mapper.InitFromFile(r.path); err != nil {
+				t.Fatal(err)
+			}
+
+			// The watcher is left running, as it is in the exporter.
+			go r.watch(0)
+			time.Sleep(100 * time.Millisecond)
+			if err := s.change(dir); err != nil {
+				t.Fatal(err)
+			}
+			deadline := time.Now().Add(5 * time.Second)
+			for r.mapper.MappingCount() != 2 && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+			if r.mapper.MappingCount() != 2 {
+				t.Errorf("expected the configuration to be reloaded with 2 mappings, got %d", r.mapper.MappingCount())
+			}
+		})
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/jvosantos/statsd_exporter/metrics"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// snapshotMutex serializes writing snapshots, so an older state never
+// replaces a newer one.
+var snapshotMutex sync.Mutex
+
+// snapshotFile is the content of a snapshot file. Checksum is the SHA-256
+// of State, which is restored only if it matches.
+type snapshotFile struct {
+	Checksum string          `json:"checksum"`
+	State    json.RawMessage `json:"state"`
+}
+
+// snapshotState is the state of the exporter's series at Time.
+type snapshotState struct {
+	Time       time.Time           `json:"time"`
+	Counters   []seriesSnapshot    `json:"counters"`
+	Gauges     []seriesSnapshot    `json:"gauges"`
+	Histograms []histogramSnapshot `json:"histograms"`
+}
+
+type seriesSnapshot struct {
+	Name        string         `json:"name"`
+	Description string         `json:"description"`
+	Labels      metrics.Labels `json:"labels"`
+	Value       float64        `json:"value"`
+	TTL         time.Duration  `json:"ttl"`
+	Updated     time.Time      `json:"updated"`
+	// Mode and Flushed are the counter_mode of a counter and its value at
+	// the last flush.
+	Mode    string  `json:"mode,omitempty"`
+	Flushed float64 `json:"flushed,omitempty"`
+}
+
+func (s *seriesSnapshot) series() series {
+	return series{ttl: s.TTL, updated: s.Updated}
+}
+
+// histogramSnapshot is a histogram series, whose Value is its count.
+type histogramSnapshot struct {
+	seriesSnapshot
+	Unit    string           `json:"unit,omitempty"`
+	Sum     float64          `json:"sum"`
+	Buckets []BucketDocument `json:"buckets"`
+}
+
+// WriteSnapshot saves the state of every series to fileName. The file is
+// replaced atomically, so a crash while writing leaves the previous
+// snapshot in place.
+func (b *Exporter) WriteSnapshot(fileName string) error {
+	state := snapshotState{Time: time.Now()}
+	for i := range b.Counters.shards {
+		shard := &b.Counters.shards[i]
+		shard.Lock()
+		for _, s := range shard.elements {
+			state.Counters = append(state.Counters, seriesSnapshot{
+				Name:        s.counter.Name(),
+				Description: s.counter.Description(),
+				Labels:      s.counter.Labels(),
+				Value:       s.counter.Value(),
+				TTL:         s.ttl,
+				Updated:     s.updated,
+				Mode:        s.mode,
+				Flushed:     s.flushed,
+			})
+		}
+		shard.Unlock()
+	}
+	for i := range b.Gauges.shards {
+		shard := &b.Gauges.shards[i]
+		shard.Lock()
+		for _, s := range shard.elements {
+			state.Gauges = append(state.Gauges, seriesSnapshot{
+				Name:        s.gauge.Name(),
+				Description: s.gauge.Description(),
+				Labels:      s.gauge.Labels(),
+				Value:       s.gauge.Value(),
+				TTL:         s.ttl,
+				Updated:     s.updated,
+			})
+		}
+		shard.Unlock()
+	}
+	for i := range b.Histograms.shards {
+		shard := &b.Histograms.shards[i]
+		shard.Lock()
+		for _, s := range shard.elements {
+			h := s.histogram
+			buckets := h.Buckets()
+			bucketDocuments := make([]BucketDocument, len(buckets))
+			for j, bucket := range buckets {
+				bucketDocuments[j] = BucketDocument{UpperBound: bucket.UpperBound, Count: bucket.Count}
+			}
+			state.Histograms = append(state.Histograms, histogramSnapshot{
+				seriesSnapshot: seriesSnapshot{
+					Name:        h.Name(),
+					Description: h.Description(),
+					Labels:      h.Labels(),
+					Value:       h.Count(),
+					TTL:         s.ttl,
+					Updated:     s.updated,
+				},
+				Unit:    h.Unit(),
+				Sum:     h.Sum(),
+				Buckets: bucketDocuments,
+			})
+		}
+		shard.Unlock()
+	}
+
+	raw, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(raw)
+	content, err := json.Marshal(snapshotFile{Checksum: hex.EncodeToString(sum[:]), State: raw})
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(fileName), filepath.Base(fileName)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), fileName)
+}
+
+// saveSnapshot writes a snapshot to fileName, logging and counting the
+// outcome.
+func (b *Exporter) saveSnapshot(fileName string) {
+	snapshotMutex.Lock()
+	defer snapshotMutex.Unlock()
+
+	if err := b.WriteSnapshot(fileName); err != nil {
+		glog.Errorf("Error writing snapshot %s: %v", fileName, err)
+		snapshotWrites.WithLabelValues("failure").Inc()
+		return
+	}
+	glog.V(10).Infof("Wrote snapshot %s", fileName)
+	snapshotWrites.WithLabelValues("success").Inc()
+	snapshotLastSuccess.SetToCurrentTime()
+}
+
+// RestoreSnapshot loads the series saved in fileName by WriteSnapshot,
+// skipping those that expired since. It returns the number of series
+// restored; a missing file restores none.
+func (b *Exporter) RestoreSnapshot(fileName string) (int, error) {
+	content, err := ioutil.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	var file snapshotFile
+	if err := json.Unmarshal(content, &file); err != nil {
+		return 0, fmt.Errorf("%s: %v", fileName, err)
+	}
+	sum := sha256.Sum256(file.State)
+	if hex.EncodeToString(sum[:]) != file.Checksum {
+		return 0, fmt.Errorf("%s: checksum mismatch, the snapshot is corrupt", fileName)
+	}
+	var state snapshotState
+	if err := json.Unmarshal(file.State, &state); err != nil {
+		return 0, fmt.Errorf("%s: %v", fileName, err)
+	}
+
+	now := time.Now()
+	restored := 0
+	for _, s := range state.Counters {
+		series := s.series()
+		if series.expired(now) || s.Value < 0 {
+			continue
+		}
+		counter := metrics.NewCounter(s.Name, s.Description, s.Labels)
+		counter.Add(s.Value)
+		hash := hashNameAndLabels(s.Name, s.Labels)
+		shard := &b.Counters.shards[hash%containerShards]
+		shard.Lock()
+		shard.elements[hash] = &counterSeries{series: series, counter: counter, mode: s.Mode, flushed: s.Flushed}
+		shard.Unlock()
+		restored++
+	}
+	for _, s := range state.Gauges {
+		series := s.series()
+		if series.expired(now) {
+			continue
+		}
+		gauge := metrics.NewGauge(s.Name, s.Description, s.Labels)
+		gauge.Set(s.Value)
+		hash := hashNameAndLabels(s.Name, s.Labels)
+		shard := &b.Gauges.shards[hash%containerShards]
+		shard.Lock()
+		shard.elements[hash] = &gaugeSeries{series: series, gauge: gauge}
+		shard.Unlock()
+		restored++
+	}
+	for _, s := range state.Histograms {
+		series := s.series()
+		if series.expired(now) {
+			continue
+		}
+		buckets := make([]metrics.Bucket, len(s.Buckets))
+		for i, bucket := range s.Buckets {
+			buckets[i] = metrics.Bucket{UpperBound: bucket.UpperBound, Count: bucket.Count}
+		}
+		histogram := metrics.RestoreHistogram(s.Name, s.Description, s.Unit, s.Labels, buckets, s.Value, s.Sum)
+		hash := hashNameAndLabels(s.Name, s.Labels)
+		shard := &b.Histograms.shards[hash%containerShards]
+		shard.Lock()
+		shard.elements[hash] = &histogramSeries{series: series, histogram: histogram}
+		shard.Unlock()
+		restored++
+	}
+	return restored, nil
+}
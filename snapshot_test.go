@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jvosantos/statsd_exporter/metrics"
+)
+
+// seriesValues returns the values of the series of e, by kind, name and
+// labels, with histograms as their count, sum and cumulative bucket counts.
+func seriesValues(e *Exporter) map[string][]float64 {
+	values := map[string][]float64{}
+	for i := range e.Counters.shards {
+		for _, s := range e.Counters.shards[i].elements {
+			values["counter "+s.counter.Name()+fmt.Sprint(s.counter.Labels())] = []float64{s.counter.Value()}
+		}
+	}
+	for i := range e.Gauges.shards {
+		for _, s := range e.Gauges.shards[i].elements {
+			values["gauge "+s.gauge.Name()+fmt.Sprint(s.gauge.Labels())] = []float64{s.gauge.Value()}
+		}
+	}
+	for i := range e.Histograms.shards {
+		for _, s := range e.Histograms.shards[i].elements {
+			h := s.histogram
+			value := []float64{h.Count(), h.Sum()}
+			for _, bucket := range h.Buckets() {
+				value = append(value, bucket.UpperBound, bucket.Count)
+			}
+			values["histogram "+h.Name()+fmt.Sprint(h.Labels())] = value
+		}
+	}
+	return values
+}
+
+func TestSnapshot(t *testing.T) {
+	a := metrics.Labels{"job": "a"}
+	b := metrics.Labels{"job": "b"}
+	scenarios := []struct {
+		name string
+		// update adds series to the exporter the snapshot is taken of.
+		update   func(e *Exporter)
+		restored int
+		expected map[string][]float64
+	}{
+		{
+			name:     "empty",
+			update:   func(e *Exporter) {},
+			expected: map[string][]float64{},
+		},
+		{
+			name: "series",
+			update: func(e *Exporter) {
+				e.Counters.Add("c", a, "", 0, "cumulative", 3)
+				e.Gauges.Update("g", a, "", 0, 2, false)
+				e.Gauges.Update("g", b, "", 0, -1, false)
+				e.Histograms.Observe("h", a, "", "ms", []float64{1, 10}, 0, 5, 1)
+				e.Histograms.Observe("h", a, "", "ms", []float64{1, 10}, 0, 20, 2)
+			},
+			restored: 4,
+			expected: map[string][]float64{
+				"counter c" + fmt.Sprint(a):   {3},
+				"gauge g" + fmt.Sprint(a):     {2},
+				"gauge g" + fmt.Sprint(b):     {-1},
+				"histogram h" + fmt.Sprint(a): {3, 45, 1, 0, 10, 1},
+			},
+		},
+		{
+			name: "expired series",
+			update: func(e *Exporter) {
+				e.Counters.Add("c", a, "", time.Nanosecond, "cumulative", 3)
+				e.Gauges.Update("g", a, "", time.Nanosecond, 2, false)
+				e.Gauges.Update("g", b, "", time.Hour, 1, false)
+				e.Histograms.Observe("h", a, "", "", []float64{1}, time.Nanosecond, 5, 1)
+			},
+			restored: 1,
+			expected: map[string][]float64{
+				"gauge g" + fmt.Sprint(b): {1},
+			},
+		},
+	}
+
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "snapshot")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			path := filepath.Join(dir, "snapshot.json")
+
+			e := newTestExporter(t, 1)
+			s.update(e)
+			if err := e.WriteSnapshot(path); err != nil {
+				t.Fatal(err)
+			}
+			time.Sleep(time.Millisecond)
+
+			restored := newTestExporter(t, 1)
+			n, err := restored.RestoreSnapshot(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != s.restored {
+				t.Errorf("expected %d series restored, got %d", s.restored, n)
+			}
+			if values := seriesValues(restored); !reflect.DeepEqual(values, s.expected) {
+				t.Errorf("expected series %v, got %v", s.expected, values)
+			}
+		})
+	}
+}
+
+func TestRestoreSnapshotErrors(t *testing.T) {
+	scenarios := []struct {
+		name string
+		// content is written to the snapshot file, unless it is missing.
+		content string
+		missing bool
+		err     string
+	}{
+		{name: "missing file", missing: true},
+		{name: "invalid file", content: "{", err: "unexpected end of JSON input"},
+		{name: "checksum mismatch", content: `{"checksum": "00", "state": {}}`, err: "checksum mismatch"},
+		{
+			name:    "invalid state",
+			content: `{"checksum": "4f53cda18c2baa0c0354bb5f9a3ecbe5ed12ab4d8e11ba873c2f11161202b945", "state": []}`,
+			err:     "cannot unmarshal array",
+		},
+	}
+
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "snapshot")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			path := filepath.Join(dir, "snapshot.json")
+			if !s.missing {
+				if err := ioutil.WriteFile(path, []byte(s.content), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			n, err := newTestExporter(t, 1).RestoreSnapshot(path)
+			if n != 0 {
+				t.Errorf("expected no series restored, got %d", n)
+			}
+			if s.err == "" {
+				if err != nil {
+					t.Errorf("expected no error, got %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), s.err) {
+				t.Errorf("expected error containing %q, got %v", s.err, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,293 @@
+package statsd
+
+import (
+	"bytes"
+	"net/netip"
+	"strconv"
+	"unicode/utf8"
+	"unsafe"
+
+	"github.com/golang/glog"
+	"github.com/jvosantos/statsd_exporter/metrics"
+)
+
+// maxInternedStrings bounds the number of strings remembered by a parser. A
+// full table is emptied, so a stream of unique names cannot grow it forever.
+const maxInternedStrings = 4096
+
+var (
+	dogStatsDTag = []byte("|#")
+
+	// statTypes interns the stat types understood by metrics.NewEvent.
+	statTypes = map[string]string{"c": "c", "g": "g", "ms": "ms", "h": "h", "s": "s"}
+)
+
+// parser turns StatsD lines into events without allocating for the parts of
+// a line it has seen before. Metric names, tag names and tag values are
+// interned, events are taken from the pools in the metrics package and
+// sampled events carry their sample rate instead of being repeated.
+//
+// A parser is not safe for concurrent use; every reader owns one.
+type parser struct {
+	strings    map[string]string
+	labelNames map[string]string
+
+	// The source labels of the lines being parsed, see setSource.
+	listener     string
+	sources      *SourceLabeler
+	sourceLabels metrics.Labels
+	clients      map[netip.Addr]*client
+
+	// A dry run parser doesn't count what it parses in the telemetry, but
+	// collects the reasons samples and tags are rejected for.
+	dryRun   bool
+	rejected []string
+}
+
+// newParser returns a parser for lines received by the named listener.
+// sources may be nil if no source labels are wanted.
+func newParser(listener string, sources *SourceLabeler) *parser {
+	p := &parser{
+		strings:      make(map[string]string),
+		labelNames:   make(map[string]string),
+		listener:     listener,
+		sources:      sources,
+		sourceLabels: make(metrics.Labels),
+		clients:      make(map[netip.Addr]*client),
+	}
+	if sources != nil && sources.config.ListenerLabel != "" {
+		p.sourceLabels[sources.config.ListenerLabel] = listener
+	}
+	return p
+}
+
+// ParseLine returns the events of a single StatsD line, without source
+// labels, and the reasons any of its samples or tags were rejected for. It is
+// meant for tools and is not counted in the telemetry; listeners parse lines
+// with their own parser.
+func ParseLine(line []byte) (metrics.Events, []string) {
+	p := newParser("", nil)
+	p.dryRun = true
+	events := p.lineToEvents(line, nil)
+	return events, p.rejected
+}
+
+// lineToEvents appends the events parsed from line to events.
+func (p *parser) lineToEvents(line []byte, events metrics.Events) metrics.Events {
+	if glog.V(100) {
+		glog.Infof("%s", line)
+	}
+
+	if len(line) == 0 {
+		return events
+	}
+
+	colon := bytes.IndexByte(line, ':')
+	if colon <= 0 || !utf8.Valid(line) {
+		p.reject("malformed_line")
+		glog.V(10).Infof("Bad line from StatsD: %s", line)
+		return events
+	}
+	metric := p.intern(line[:colon])
+	samples := line[colon+1:]
+
+	// using datadog extensions, disable multi-metrics
+	multiMetrics := !bytes.Contains(samples, dogStatsDTag)
+	for {
+		sample, next := samples, -1
+		if multiMetrics {
+			next = bytes.IndexByte(samples, ':')
+		}
+		if next >= 0 {
+			sample = samples[:next]
+		}
+		events = p.sampleToEvents(line, metric, sample, events)
+		if next < 0 {
+			return events
+		}
+		samples = samples[next+1:]
+	}
+}
+
+func (p *parser) sampleToEvents(line []byte, metric string, sample []byte, events metrics.Events) metrics.Events {
+	if !p.dryRun {
+		samplesReceived.Inc()
+	}
+
+	var components [4][]byte
+	n := splitComponents(sample, &components)
+	if n < 2 || n > len(components) {
+		p.reject("malformed_component")
+		glog.V(10).Infof("Bad component on line: %s", line)
+		return events
+	}
+	valueStr, statType := components[0], components[1]
+
+	relative := len(valueStr) > 0 && (valueStr[0] == '+' || valueStr[0] == '-')
+
+	value, err := strconv.ParseFloat(unsafeString(valueStr), 64)
+	if err != nil {
+		glog.V(10).Infof("Bad value %s on line: %s", valueStr, line)
+		p.reject("malformed_value")
+		return events
+	}
+
+	for _, component := range components[2:n] {
+		if len(component) == 0 {
+			glog.V(10).Infof("Empty component on line: %s", line)
+			p.reject("malformed_component")
+			return events
+		}
+	}
+
+	sampleRate := 1.0
+	var labels metrics.Labels
+	for _, component := range components[2:n] {
+		switch component[0] {
+		case '@':
+			if string(statType) != "c" && string(statType) != "ms" {
+				glog.V(10).Infof("Illegal sampling factor for non-counter metric on line %s", line)
+				p.reject("illegal_sample_factor")
+				continue
+			}
+			sampleRate, err = strconv.ParseFloat(unsafeString(component[1:]), 64)
+			if err != nil || sampleRate < 0 || sampleRate > 1 {
+				glog.V(10).Infof("Invalid sampling factor %s on line %s", component[1:], line)
+				p.reject("invalid_sample_factor")
+				sampleRate = 1
+			}
+			if sampleRate == 0 {
+				sampleRate = 1
+			}
+
+			if string(statType) == "c" {
+				value /= sampleRate
+			}
+		case '#':
+			if labels == nil {
+				labels = metrics.NewLabels()
+			}
+			p.parseDogStatsDTags(component, labels)
+		default:
+			glog.V(10).Infof("Invalid sampling factor or tag section %s on line %s", component, line)
+			p.reject("invalid_sample_factor")
+			continue
+		}
+	}
+
+	// Source labels take precedence over tags so clients cannot spoof them.
+	if len(p.sourceLabels) > 0 {
+		if labels == nil {
+			labels = metrics.NewLabels()
+		}
+		for name, value := range p.sourceLabels {
+			labels[name] = value
+		}
+	}
+
+	statTypeStr, ok := statTypes[string(statType)]
+	if !ok {
+		statTypeStr = string(statType)
+	}
+	event, err := metrics.NewEvent(statTypeStr, metric, value, relative, sampleRate, labels)
+	if err != nil {
+		glog.V(10).Infof("Error building event on line %s: %s", line, err)
+		p.reject("illegal_event")
+		return events
+	}
+	return append(events, event)
+}
+
+// splitComponents splits sample on '|' into components and returns the
+// number of components found, which exceeds len(components) when the sample
+// has more than StatsD allows.
+func splitComponents(sample []byte, components *[4][]byte) int {
+	n := 0
+	for {
+		i := bytes.IndexByte(sample, '|')
+		if n == len(components) {
+			return n + 1
+		}
+		if i < 0 {
+			components[n] = sample
+			return n + 1
+		}
+		components[n] = sample[:i]
+		n++
+		sample = sample[i+1:]
+	}
+}
+
+func (p *parser) parseDogStatsDTags(component []byte, labels metrics.Labels) {
+	if !p.dryRun {
+		tagsReceived.Inc()
+	}
+	tags := component
+	for len(tags) > 0 {
+		tag := tags
+		if i := bytes.IndexByte(tags, ','); i >= 0 {
+			tag, tags = tags[:i], tags[i+1:]
+		} else {
+			tags = nil
+		}
+		if len(tag) > 0 && tag[0] == '#' {
+			tag = tag[1:]
+		}
+
+		colon := bytes.IndexByte(tag, ':')
+		if colon <= 0 || colon == len(tag)-1 {
+			if p.dryRun {
+				p.rejected = append(p.rejected, "malformed_tag")
+			} else {
+				tagErrors.Inc()
+			}
+			glog.V(10).Infof("Malformed or empty DogStatsD tag %s in component %s", tag, component)
+			continue
+		}
+
+		labels[p.labelName(tag[:colon])] = p.intern(tag[colon+1:])
+	}
+}
+
+// reject counts a sample rejected for reason.
+func (p *parser) reject(reason string) {
+	if p.dryRun {
+		p.rejected = append(p.rejected, reason)
+		return
+	}
+	sampleErrors.WithLabelValues(reason).Inc()
+}
+
+// intern returns b as a string, reusing the string returned for the same
+// bytes before when possible.
+func (p *parser) intern(b []byte) string {
+	if s, ok := p.strings[string(b)]; ok {
+		return s
+	}
+	if len(p.strings) >= maxInternedStrings {
+		p.strings = make(map[string]string)
+	}
+	s := string(b)
+	p.strings[s] = s
+	return s
+}
+
+// labelName returns the escaped label name for the DogStatsD tag name b.
+func (p *parser) labelName(b []byte) string {
+	if name, ok := p.labelNames[string(b)]; ok {
+		return name
+	}
+	if len(p.labelNames) >= maxInternedStrings {
+		p.labelNames = make(map[string]string)
+	}
+	name := metrics.EscapeMetricName(string(b))
+	p.labelNames[string(b)] = name
+	return name
+}
+
+// unsafeString returns a string sharing the memory of b. It must only be used
+// for strings that do not outlive the call they are passed to, such as the
+// arguments to strconv parsers.
+func unsafeString(b []byte) string {
+	return *(*string)(unsafe.Pointer(&b))
+}
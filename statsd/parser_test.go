@@ -0,0 +1,176 @@
+package statsd
+
+import (
+	"context"
+	"net/netip"
+	"reflect"
+	"testing"
+
+	"github.com/jvosantos/statsd_exporter/metrics"
+)
+
+// parsedEvent holds what a test looks at in an event.
+type parsedEvent struct {
+	metricType metrics.MetricType
+	name       string
+	value      float64
+	relative   bool
+	sampleRate float64
+	labels     metrics.Labels
+}
+
+func parsed(events metrics.Events) []parsedEvent {
+	var result []parsedEvent
+	for _, event := range events {
+		e := parsedEvent{
+			metricType: event.MetricType(),
+			name:       event.MetricName(),
+			value:      event.Value(),
+			sampleRate: event.SampleRate(),
+		}
+		if len(event.Labels()) > 0 {
+			e.labels = event.Labels()
+		}
+		if gauge, ok := event.(*metrics.GaugeEvent); ok {
+			e.relative = gauge.Relative()
+		}
+		result = append(result, e)
+	}
+	return result
+}
+
+func TestLineToEvents(t *testing.T) {
+	scenarios := []struct {
+		name   string
+		line   string
+		events []parsedEvent
+	}{
+		{
+			name:   "counter",
+			line:   "foo:2|c",
+			events: []parsedEvent{{metricType: "counter", name: "foo", value: 2, sampleRate: 1}},
+		},
+		{
+			name:   "sampled counter",
+			line:   "foo:2|c|@0.5",
+			events: []parsedEvent{{metricType: "counter", name: "foo", value: 4, sampleRate: 0.5}},
+		},
+		{
+			name:   "gauge",
+			line:   "foo:3|g",
+			events: []parsedEvent{{metricType: "gauge", name: "foo", value: 3, sampleRate: 1}},
+		},
+		{
+			name:   "relative gauge",
+			line:   "foo:-3|g",
+			events: []parsedEvent{{metricType: "gauge", name: "foo", value: -3, relative: true, sampleRate: 1}},
+		},
+		{
+			name:   "sampled timer",
+			line:   "foo:320|ms|@0.1",
+			events: []parsedEvent{{metricType: "timer", name: "foo", value: 320, sampleRate: 0.1}},
+		},
+		{
+			name: "multiple samples",
+			line: "foo:1|c:2|g:3|ms",
+			events: []parsedEvent{
+				{metricType: "counter", name: "foo", value: 1, sampleRate: 1},
+				{metricType: "gauge", name: "foo", value: 2, sampleRate: 1},
+				{metricType: "timer", name: "foo", value: 3, sampleRate: 1},
+			},
+		},
+		{
+			name: "dogstatsd tags",
+			line: "foo:1|c|#env:prod,#tier:web,host-name:a",
+			events: []parsedEvent{{metricType: "counter", name: "foo", value: 1, sampleRate: 1,
+				labels: metrics.Labels{"env": "prod", "tier": "web", "host_name": "a"}}},
+		},
+		{
+			name: "dogstatsd tags after sample rate",
+			line: "foo:10|ms|@0.5|#env:prod",
+			events: []parsedEvent{{metricType: "timer", name: "foo", value: 10, sampleRate: 0.5,
+				labels: metrics.Labels{"env": "prod"}}},
+		},
+		{
+			name: "dogstatsd tag values with colons",
+			line: "foo:1|c|#url:http://x",
+			events: []parsedEvent{{metricType: "counter", name: "foo", value: 1, sampleRate: 1,
+				labels: metrics.Labels{"url": "http://x"}}},
+		},
+		{
+			name:   "malformed dogstatsd tags",
+			line:   "foo:1|c|#env,:prod,tier:",
+			events: []parsedEvent{{metricType: "counter", name: "foo", value: 1, sampleRate: 1}},
+		},
+		{name: "empty line", line: ""},
+		{name: "no value", line: "foo"},
+		{name: "no name", line: ":1|c"},
+		{name: "bad value", line: "foo:x|c"},
+		{name: "empty component", line: "foo:1|c||"},
+		{name: "too many components", line: "foo:1|c|@0.5|#a:b|x"},
+		{name: "unsupported type", line: "foo:1|s"},
+		{name: "invalid utf8", line: "foo\xff:1|c"},
+	}
+
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			p := newParser("udp", nil)
+			events := p.lineToEvents([]byte(s.line), nil)
+			if got := parsed(events); !reflect.DeepEqual(got, s.events) {
+				t.Fatalf("expected %+v, got %+v", s.events, got)
+			}
+		})
+	}
+}
+
+var benchmarkLines = []struct {
+	name string
+	line string
+}{
+	{"counter", "http.requests:1|c"},
+	{"sampled_timer", "http.latency:320|ms|@0.1"},
+	{"multi_metric", "http.requests:1|c:2|c:3|c"},
+	{"dogstatsd_tags", "http.requests:1|c|#method:GET,status:200,host:web-1"},
+}
+
+// BenchmarkParseLine parses lines the way listeners do, handing the events
+// back to the pools once done, so that steady state parsing of lines seen
+// before shouldn't allocate.
+func BenchmarkParseLine(b *testing.B) {
+	for _, bench := range benchmarkLines {
+		line := []byte(bench.line)
+		b.Run(bench.name, func(b *testing.B) {
+			p := newParser("udp", nil)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				events := p.lineToEvents(line, metrics.NewEvents())
+				metrics.ReleaseEvents(events)
+			}
+		})
+	}
+}
+
+func BenchmarkHandlePacket(b *testing.B) {
+	var packet []byte
+	for _, bench := range benchmarkLines {
+		packet = append(packet, bench.line...)
+		packet = append(packet, '\n')
+	}
+	packet = packet[:len(packet)-1]
+
+	l := &UDPListener{config: UDPConfig{Name: "udp"}}
+	p := newParser("udp", nil)
+	q, err := NewEventQueue(1, QueueBlock)
+	if err != nil {
+		b.Fatal(err)
+	}
+	ctx := context.Background()
+	source := netip.MustParseAddr("127.0.0.1")
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(packet)))
+	for i := 0; i < b.N; i++ {
+		l.handlePacket(ctx, p, source, packet, q)
+		metrics.ReleaseEvents(<-q.Events())
+	}
+}
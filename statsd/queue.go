@@ -0,0 +1,119 @@
+package statsd
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jvosantos/statsd_exporter/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// QueuePolicy decides what listeners do when the event queue is full.
+type QueuePolicy string
+
+const (
+	// QueueBlock waits for room in the queue, stalling the listener.
+	QueueBlock QueuePolicy = "block"
+	// QueueDropNewest discards the events that do not fit.
+	QueueDropNewest QueuePolicy = "drop_newest"
+	// QueueDropOldest discards the oldest queued events to make room.
+	QueueDropOldest QueuePolicy = "drop_oldest"
+)
+
+var (
+	queueLengthDesc = prometheus.NewDesc(
+		"statsd_exporter_event_queue_length",
+		"The number of event batches waiting to be exported.",
+		nil, nil,
+	)
+	queueCapacityDesc = prometheus.NewDesc(
+		"statsd_exporter_event_queue_capacity",
+		"The maximum number of event batches waiting to be exported.",
+		nil, nil,
+	)
+)
+
+// EventQueue passes batches of parsed events from the listeners to the
+// exporter. It is a prometheus.Collector reporting its occupancy.
+type EventQueue struct {
+	events chan metrics.Events
+	policy QueuePolicy
+}
+
+func NewEventQueue(size int, policy QueuePolicy) (*EventQueue, error) {
+	switch policy {
+	case QueueBlock, QueueDropNewest, QueueDropOldest:
+	default:
+		return nil, fmt.Errorf("unknown event queue policy %q", policy)
+	}
+	if size < 1 {
+		return nil, fmt.Errorf("event queue size must be at least 1")
+	}
+	return &EventQueue{
+		events: make(chan metrics.Events, size),
+		policy: policy,
+	}, nil
+}
+
+// Events is the channel the exporter receives event batches from.
+func (q *EventQueue) Events() <-chan metrics.Events {
+	return q.events
+}
+
+// Close closes the events channel. It must only be called once every
+// listener has stopped.
+func (q *EventQueue) Close() {
+	close(q.events)
+}
+
+// send queues events according to the queue policy, giving up when ctx is
+// cancelled. Dropped batches are released to the event pools.
+func (q *EventQueue) send(ctx context.Context, events metrics.Events) {
+	if len(events) == 0 {
+		metrics.ReleaseEvents(events)
+		return
+	}
+
+	switch q.policy {
+	case QueueDropNewest:
+		select {
+		case q.events <- events:
+		default:
+			q.drop(events)
+		}
+	case QueueDropOldest:
+		for {
+			select {
+			case q.events <- events:
+				return
+			default:
+			}
+			select {
+			case old := <-q.events:
+				q.drop(old)
+			default:
+			}
+		}
+	default:
+		select {
+		case q.events <- events:
+		case <-ctx.Done():
+		}
+	}
+}
+
+func (q *EventQueue) drop(events metrics.Events) {
+	queueDroppedBatches.WithLabelValues(string(q.policy)).Inc()
+	queueDroppedEvents.WithLabelValues(string(q.policy)).Add(float64(len(events)))
+	metrics.ReleaseEvents(events)
+}
+
+func (q *EventQueue) Describe(ch chan<- *prometheus.Desc) {
+	ch <- queueLengthDesc
+	ch <- queueCapacityDesc
+}
+
+func (q *EventQueue) Collect(ch chan<- prometheus.Metric) {
+	ch <- prometheus.MustNewConstMetric(queueLengthDesc, prometheus.GaugeValue, float64(len(q.events)))
+	ch <- prometheus.MustNewConstMetric(queueCapacityDesc, prometheus.GaugeValue, float64(cap(q.events)))
+}
@@ -0,0 +1,99 @@
+package statsd
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/jvosantos/statsd_exporter/metrics"
+)
+
+func TestEventQueue(t *testing.T) {
+	scenarios := []struct {
+		name   string
+		size   int
+		policy QueuePolicy
+		// cancelAfter is the number of batches sent before the context
+		// is cancelled, if not zero.
+		cancelAfter int
+		sent        []float64
+		queued      []float64
+	}{
+		{
+			name:   "drop newest",
+			size:   2,
+			policy: QueueDropNewest,
+			sent:   []float64{1, 2, 3, 4},
+			queued: []float64{1, 2},
+		},
+		{
+			name:   "drop oldest",
+			size:   2,
+			policy: QueueDropOldest,
+			sent:   []float64{1, 2, 3, 4},
+			queued: []float64{3, 4},
+		},
+		{
+			name:        "block until cancelled",
+			size:        1,
+			policy:      QueueBlock,
+			cancelAfter: 1,
+			sent:        []float64{1, 2},
+			queued:      []float64{1},
+		},
+	}
+
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			q, err := NewEventQueue(s.size, s.policy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			for i, value := range s.sent {
+				if s.cancelAfter > 0 && i == s.cancelAfter {
+					cancel()
+				}
+				event, err := metrics.NewEvent("g", "foo", value, false, 1, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				q.send(ctx, metrics.Events{event})
+				// Nothing is queued for empty batches.
+				q.send(ctx, metrics.Events{})
+			}
+			q.Close()
+
+			var queued []float64
+			for events := range q.Events() {
+				for _, event := range events {
+					queued = append(queued, event.Value())
+				}
+			}
+			if !reflect.DeepEqual(queued, s.queued) {
+				t.Fatalf("expected %v queued, got %v", s.queued, queued)
+			}
+		})
+	}
+}
+
+func TestNewEventQueue(t *testing.T) {
+	scenarios := []struct {
+		size   int
+		policy QueuePolicy
+		valid  bool
+	}{
+		{size: 1, policy: QueueBlock, valid: true},
+		{size: 10, policy: QueueDropOldest, valid: true},
+		{size: 0, policy: QueueBlock},
+		{size: 1, policy: "drop"},
+	}
+
+	for _, s := range scenarios {
+		if _, err := NewEventQueue(s.size, s.policy); (err == nil) != s.valid {
+			t.Errorf("size %d, policy %q: unexpected error %v", s.size, s.policy, err)
+		}
+	}
+}
@@ -0,0 +1,314 @@
+package statsd
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/yaml.v2"
+)
+
+// maxRateLimitedSources bounds the number of clients a RateLimiter keeps a
+// bucket for. The least recently seen clients are forgotten once it is
+// reached.
+const maxRateLimitedSources = 100000
+
+// rateLimitShards is the number of independently locked shards the clients
+// of a RateLimiter are split into, so that readers receiving from different
+// clients don't contend.
+const rateLimitShards = 64
+
+// RateLimitConfig is the YAML configuration of a RateLimiter.
+type RateLimitConfig struct {
+	// Sources limit the packets accepted from every client address in a
+	// network. The first matching rule applies.
+	Sources []SourceLimit `yaml:"sources"`
+	// Prefixes limit the lines accepted for metrics starting with a prefix,
+	// across all clients. Every matching rule applies.
+	Prefixes []PrefixLimit `yaml:"prefixes"`
+}
+
+// SourceLimit allows each client in CIDR Rate packets per second, with bursts
+// of up to Burst packets. TCP lines count as packets.
+type SourceLimit struct {
+	CIDR  string  `yaml:"cidr"`
+	Rate  float64 `yaml:"rate"`
+	Burst float64 `yaml:"burst"`
+
+	prefix netip.Prefix
+}
+
+// PrefixLimit allows Rate lines per second, with bursts of up to Burst
+// lines, for metric names starting with Prefix.
+type PrefixLimit struct {
+	Prefix string  `yaml:"prefix"`
+	Rate   float64 `yaml:"rate"`
+	Burst  float64 `yaml:"burst"`
+
+	prefix []byte
+	bucket *tokenBucket
+}
+
+// RateLimiter drops traffic exceeding the configured limits before it is
+// parsed. It is shared by all listeners; a nil RateLimiter allows everything.
+type RateLimiter struct {
+	sources  []SourceLimit
+	prefixes []PrefixLimit
+
+	shards [rateLimitShards]rateLimitShard
+}
+
+type rateLimitShard struct {
+	sync.Mutex
+	clients map[netip.Addr]*rateLimitedClient
+	// recent orders the clients from the most to the least recently seen.
+	recent *list.List
+}
+
+// rateLimitedClient is the state kept for a client. Clients outside all
+// source limits are kept too, without a bucket, so that their addresses are
+// only looked up in the source limits once.
+type rateLimitedClient struct {
+	source  netip.Addr
+	bucket  *tokenBucket
+	ip      string
+	dropped map[droppedKey]prometheus.Counter
+	element *list.Element
+}
+
+// droppedKey identifies the series of a client in rateLimited.
+type droppedKey struct {
+	listener string
+	limit    string
+}
+
+func NewRateLimiter(config RateLimitConfig) (*RateLimiter, error) {
+	for i := range config.Sources {
+		limit := &config.Sources[i]
+		prefix, err := netip.ParsePrefix(limit.CIDR)
+		if err != nil {
+			return nil, fmt.Errorf("invalid source rate limit: %v", err)
+		}
+		limit.prefix = prefix.Masked()
+		if err := checkRate(limit.Rate, &limit.Burst); err != nil {
+			return nil, fmt.Errorf("source rate limit %s: %v", limit.CIDR, err)
+		}
+	}
+	for i := range config.Prefixes {
+		limit := &config.Prefixes[i]
+		if limit.Prefix == "" {
+			return nil, fmt.Errorf("prefix rate limit without a prefix")
+		}
+		if err := checkRate(limit.Rate, &limit.Burst); err != nil {
+			return nil, fmt.Errorf("prefix rate limit %s: %v", limit.Prefix, err)
+		}
+		limit.prefix = []byte(limit.Prefix)
+		limit.bucket = newTokenBucket(limit.Rate, limit.Burst)
+	}
+
+	r := &RateLimiter{
+		sources:  config.Sources,
+		prefixes: config.Prefixes,
+	}
+	for i := range r.shards {
+		r.shards[i].clients = make(map[netip.Addr]*rateLimitedClient)
+		r.shards[i].recent = list.New()
+	}
+	return r, nil
+}
+
+// LoadRateLimiter reads a RateLimitConfig from a YAML file.
+func LoadRateLimiter(fileName string) (*RateLimiter, error) {
+	content, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	var config RateLimitConfig
+	if err := yaml.UnmarshalStrict(content, &config); err != nil {
+		return nil, err
+	}
+	return NewRateLimiter(config)
+}
+
+func checkRate(rate float64, burst *float64) error {
+	if rate <= 0 {
+		return fmt.Errorf("rate must be positive")
+	}
+	if *burst == 0 {
+		*burst = rate
+	}
+	if *burst < 1 {
+		return fmt.Errorf("burst must be at least 1")
+	}
+	return nil
+}
+
+// allowPacket reports whether a packet from source is within its client's
+// limit, counting it as dropped otherwise.
+func (r *RateLimiter) allowPacket(listener string, source netip.Addr) bool {
+	if r == nil || len(r.sources) == 0 {
+		return true
+	}
+	source = source.Unmap()
+
+	shard := r.shard(source)
+	shard.Lock()
+	defer shard.Unlock()
+
+	c := shard.client(r, source)
+	if c.bucket == nil || c.bucket.take(time.Now()) {
+		return true
+	}
+	r.dropped(c, listener, "source").Inc()
+	return false
+}
+
+// allowLine reports whether line is within the limits of the metric prefixes
+// it matches, counting it as dropped otherwise. A line only takes a token
+// from its prefixes' buckets if all of them have one.
+func (r *RateLimiter) allowLine(listener string, source netip.Addr, line []byte) bool {
+	if r == nil || len(r.prefixes) == 0 {
+		return true
+	}
+
+	// The buckets are locked in configuration order, so concurrent lines
+	// matching several prefixes can't deadlock.
+	now := time.Now()
+	var rejected *PrefixLimit
+	for i := range r.prefixes {
+		limit := &r.prefixes[i]
+		if !bytes.HasPrefix(line, limit.prefix) {
+			continue
+		}
+		limit.bucket.mutex.Lock()
+		limit.bucket.refill(now)
+		if rejected == nil && limit.bucket.tokens < 1 {
+			rejected = limit
+		}
+	}
+	for i := range r.prefixes {
+		limit := &r.prefixes[i]
+		if !bytes.HasPrefix(line, limit.prefix) {
+			continue
+		}
+		if rejected == nil {
+			limit.bucket.tokens--
+		}
+		limit.bucket.mutex.Unlock()
+	}
+	if rejected == nil {
+		return true
+	}
+
+	source = source.Unmap()
+	shard := r.shard(source)
+	shard.Lock()
+	r.dropped(shard.client(r, source), listener, "prefix:"+rejected.Prefix).Inc()
+	shard.Unlock()
+	return false
+}
+
+func (r *RateLimiter) sourceLimit(source netip.Addr) *SourceLimit {
+	for i := range r.sources {
+		if r.sources[i].prefix.Contains(source) {
+			return &r.sources[i]
+		}
+	}
+	return nil
+}
+
+func (r *RateLimiter) shard(source netip.Addr) *rateLimitShard {
+	b := source.As16()
+	h := binary.LittleEndian.Uint64(b[:8]) ^ binary.LittleEndian.Uint64(b[8:])
+	// Mix the bits, as the low bytes of addresses in a network are alike.
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	return &r.shards[h%rateLimitShards]
+}
+
+// client returns the state kept for source, creating it with the bucket of
+// its source limit, if any. Called with the shard locked.
+func (s *rateLimitShard) client(r *RateLimiter, source netip.Addr) *rateLimitedClient {
+	c, ok := s.clients[source]
+	if ok {
+		s.recent.MoveToFront(c.element)
+		return c
+	}
+	s.makeRoom()
+	c = &rateLimitedClient{source: source, ip: source.String(), dropped: make(map[droppedKey]prometheus.Counter)}
+	if limit := r.sourceLimit(source); limit != nil {
+		c.bucket = newTokenBucket(limit.Rate, limit.Burst)
+	}
+	c.element = s.recent.PushFront(c)
+	s.clients[source] = c
+	return c
+}
+
+// dropped returns the counter of the traffic of c dropped by limit. Called
+// with the shard of c locked.
+func (r *RateLimiter) dropped(c *rateLimitedClient, listener, limit string) prometheus.Counter {
+	key := droppedKey{listener: listener, limit: limit}
+	counter, ok := c.dropped[key]
+	if !ok {
+		counter = rateLimited.WithLabelValues(listener, c.ip, limit)
+		c.dropped[key] = counter
+	}
+	return counter
+}
+
+// makeRoom forgets the least recently seen client, and deletes its series,
+// once the shard's share of the client table is full. Called with the shard
+// locked.
+func (s *rateLimitShard) makeRoom() {
+	if len(s.clients) < maxRateLimitedSources/rateLimitShards {
+		return
+	}
+	c := s.recent.Remove(s.recent.Back()).(*rateLimitedClient)
+	for key := range c.dropped {
+		rateLimited.DeleteLabelValues(key.listener, c.ip, key.limit)
+	}
+	delete(s.clients, c.source)
+}
+
+// tokenBucket holds up to burst tokens, refilled at rate tokens per second.
+type tokenBucket struct {
+	mutex  sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst float64) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens += elapsed * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+		b.last = now
+	}
+}
+
+// take removes a token from the bucket, reporting false if it is empty.
+func (b *tokenBucket) take(now time.Time) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.refill(now)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
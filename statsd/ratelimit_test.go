@@ -0,0 +1,201 @@
+package statsd
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	type take struct {
+		after   time.Duration
+		allowed bool
+	}
+	scenarios := []struct {
+		name        string
+		rate, burst float64
+		takes       []take
+	}{
+		{
+			name:  "burst",
+			rate:  1,
+			burst: 2,
+			takes: []take{{0, true}, {0, true}, {0, false}},
+		},
+		{
+			name:  "refill",
+			rate:  2,
+			burst: 1,
+			takes: []take{{0, true}, {0, false}, {250 * time.Millisecond, false}, {250 * time.Millisecond, true}},
+		},
+		{
+			name:  "refill up to burst",
+			rate:  10,
+			burst: 2,
+			takes: []take{{0, true}, {0, true}, {time.Hour, true}, {0, true}, {0, false}},
+		},
+	}
+
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			b := newTokenBucket(s.rate, s.burst)
+			now := b.last
+			for i, take := range s.takes {
+				now = now.Add(take.after)
+				if allowed := b.take(now); allowed != take.allowed {
+					t.Fatalf("take %d: expected %v, got %v", i, take.allowed, allowed)
+				}
+			}
+		})
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	type packet struct {
+		source  string
+		line    string
+		allowed bool
+	}
+	scenarios := []struct {
+		name    string
+		config  RateLimitConfig
+		packets []packet
+	}{
+		{
+			name: "source limits",
+			config: RateLimitConfig{Sources: []SourceLimit{
+				{CIDR: "10.0.0.0/8", Rate: 0.001, Burst: 2},
+				{CIDR: "0.0.0.0/0", Rate: 0.001, Burst: 1},
+			}},
+			packets: []packet{
+				{"10.0.0.1", "foo:1|c", true},
+				{"::ffff:10.0.0.1", "foo:1|c", true},
+				{"10.0.0.1", "foo:1|c", false},
+				{"10.0.0.2", "foo:1|c", true},
+				{"192.168.0.1", "foo:1|c", true},
+				{"192.168.0.1", "foo:1|c", false},
+				{"2001:db8::1", "foo:1|c", true},
+				{"2001:db8::1", "foo:1|c", true},
+			},
+		},
+		{
+			name: "prefix limits",
+			config: RateLimitConfig{Prefixes: []PrefixLimit{
+				{Prefix: "debug.", Rate: 0.001, Burst: 1},
+			}},
+			packets: []packet{
+				{"10.0.0.1", "debug.foo:1|c", true},
+				{"10.0.0.2", "debug.bar:1|c", false},
+				{"10.0.0.1", "foo:1|c", true},
+				{"10.0.0.1", "foo:1|c", true},
+			},
+		},
+		{
+			// A line only takes tokens if all its prefixes have one, so
+			// lines rejected by aa.bb don't use up those of aa.
+			name: "overlapping prefixes",
+			config: RateLimitConfig{Prefixes: []PrefixLimit{
+				{Prefix: "aa.", Rate: 0.001, Burst: 2},
+				{Prefix: "aa.bb", Rate: 0.001, Burst: 1},
+			}},
+			packets: []packet{
+				{"10.0.0.1", "aa.bb:1|c", true},
+				{"10.0.0.1", "aa.bb:1|c", false},
+				{"10.0.0.1", "aa.bb:1|c", false},
+				{"10.0.0.1", "aa.cc:1|c", true},
+				{"10.0.0.1", "aa.cc:1|c", false},
+			},
+		},
+	}
+
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			r, err := NewRateLimiter(s.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, p := range s.packets {
+				source := netip.MustParseAddr(p.source)
+				allowed := r.allowPacket("test", source) && r.allowLine("test", source, []byte(p.line))
+				if allowed != p.allowed {
+					t.Fatalf("packet %d from %s: expected %v, got %v", i, p.source, p.allowed, allowed)
+				}
+			}
+		})
+	}
+}
+
+func TestRateLimiterConfig(t *testing.T) {
+	scenarios := []struct {
+		name   string
+		config RateLimitConfig
+		valid  bool
+	}{
+		{name: "empty", valid: true},
+		{name: "burst defaults to rate", config: RateLimitConfig{Sources: []SourceLimit{{CIDR: "10.0.0.0/8", Rate: 5}}}, valid: true},
+		{name: "bad cidr", config: RateLimitConfig{Sources: []SourceLimit{{CIDR: "10.0.0.0", Rate: 1}}}},
+		{name: "zero rate", config: RateLimitConfig{Sources: []SourceLimit{{CIDR: "10.0.0.0/8"}}}},
+		{name: "small burst", config: RateLimitConfig{Prefixes: []PrefixLimit{{Prefix: "a", Rate: 1, Burst: 0.5}}}},
+		{name: "empty prefix", config: RateLimitConfig{Prefixes: []PrefixLimit{{Rate: 1}}}},
+	}
+
+	for _, s := range scenarios {
+		if _, err := NewRateLimiter(s.config); (err == nil) != s.valid {
+			t.Errorf("%s: unexpected error %v", s.name, err)
+		}
+	}
+}
+
+func TestNilRateLimiter(t *testing.T) {
+	var r *RateLimiter
+	source := netip.MustParseAddr("10.0.0.1")
+	if !r.allowPacket("test", source) || !r.allowLine("test", source, []byte("foo:1|c")) {
+		t.Fatal("expected a nil rate limiter to allow everything")
+	}
+}
+
+// TestRateLimiterEviction checks that once a shard is full, the least
+// recently seen client is forgotten along with its series.
+func TestRateLimiterEviction(t *testing.T) {
+	r, err := NewRateLimiter(RateLimitConfig{Sources: []SourceLimit{{CIDR: "10.0.0.0/8", Rate: 0.001, Burst: 1}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Find enough clients of one shard to fill it.
+	limit := maxRateLimitedSources / rateLimitShards
+	shard := r.shard(netip.MustParseAddr("10.0.0.0"))
+	var sources []netip.Addr
+	for i := 1; len(sources) <= limit; i++ {
+		source := netip.AddrFrom4([4]byte{10, byte(i >> 16), byte(i >> 8), byte(i)})
+		if r.shard(source) == shard {
+			sources = append(sources, source)
+		}
+	}
+
+	// The first client is dropped, and the second seen again after all the
+	// others but the last.
+	first, second := sources[0], sources[1]
+	r.allowPacket("test", first)
+	if r.allowPacket("test", first) {
+		t.Fatal("expected the second packet to be dropped")
+	}
+	for _, source := range sources[1:limit] {
+		r.allowPacket("test", source)
+	}
+	r.allowPacket("test", second)
+	r.allowPacket("test", sources[limit])
+
+	if len(shard.clients) != limit {
+		t.Fatalf("expected %d clients, got %d", limit, len(shard.clients))
+	}
+	if _, ok := shard.clients[first]; ok {
+		t.Fatal("expected the least recently seen client to be forgotten")
+	}
+	if _, ok := shard.clients[second]; !ok {
+		t.Fatal("expected a recently seen client to be kept")
+	}
+	if rateLimited.DeleteLabelValues("test", first.String(), "source") {
+		t.Fatal("expected the series of the forgotten client to be deleted")
+	}
+}
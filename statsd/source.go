@@ -0,0 +1,230 @@
+package statsd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// maxHostnames bounds the reverse DNS cache. A full cache is emptied.
+	maxHostnames = 10000
+	// hostnameLookupTimeout bounds a single reverse DNS lookup.
+	hostnameLookupTimeout = 5 * time.Second
+	// maxSourceSeries bounds the number of clients packets are counted for
+	// in the telemetry. Once it is reached, the series of clients idle for
+	// sourceSeriesIdle are deleted, or else all of them.
+	maxSourceSeries  = 10000
+	sourceSeriesIdle = 10 * time.Minute
+)
+
+var labelNameRE = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// SourceConfig selects the labels identifying where events came from. Empty
+// label names disable the corresponding label.
+type SourceConfig struct {
+	// ListenerLabel carries the name of the listener that received the event.
+	ListenerLabel string
+	// IPLabel carries the IP address of the client that sent the event.
+	IPLabel string
+	// HostnameLabel carries the reverse DNS name of the client, or its IP
+	// address until the lookup completes or when it fails.
+	HostnameLabel string
+	// HostnameTTL is how long reverse DNS results are cached for.
+	HostnameTTL time.Duration
+	// Telemetry counts the packets received from every client.
+	Telemetry bool
+}
+
+// SourceLabeler attaches source labels to events and caches the reverse DNS
+// names of clients. It is shared by all listeners.
+type SourceLabeler struct {
+	config SourceConfig
+
+	mutex     sync.RWMutex
+	hostnames map[netip.Addr]hostnameEntry
+
+	packetsMutex sync.Mutex
+	packets      map[sourceKey]*sourceCounter
+}
+
+type sourceKey struct {
+	listener string
+	addr     netip.Addr
+}
+
+// sourceCounter counts the packets of a client in the telemetry until its
+// series is deleted to make room for other clients.
+type sourceCounter struct {
+	counter prometheus.Counter
+	// last is the Unix time in nanoseconds of the last packet, and deleted
+	// is set to 1 once the series is deleted. Both are accessed atomically.
+	last    int64
+	deleted int32
+}
+
+func (c *sourceCounter) inc(now time.Time) {
+	c.counter.Inc()
+	atomic.StoreInt64(&c.last, now.UnixNano())
+}
+
+type hostnameEntry struct {
+	name    string
+	expires time.Time
+	pending bool
+}
+
+func NewSourceLabeler(config SourceConfig) (*SourceLabeler, error) {
+	for _, name := range []string{config.ListenerLabel, config.IPLabel, config.HostnameLabel} {
+		if name != "" && !labelNameRE.MatchString(name) {
+			return nil, fmt.Errorf("invalid source label name %q", name)
+		}
+	}
+
+	return &SourceLabeler{
+		config:    config,
+		hostnames: make(map[netip.Addr]hostnameEntry),
+		packets:   make(map[sourceKey]*sourceCounter),
+	}, nil
+}
+
+// hostname returns the cached reverse DNS name of addr, or ip if there is
+// none yet. Missing and expired entries are looked up in the background so
+// receiving is never blocked on DNS.
+func (s *SourceLabeler) hostname(addr netip.Addr, ip string) string {
+	s.mutex.RLock()
+	entry, ok := s.hostnames[addr]
+	s.mutex.RUnlock()
+
+	if !ok || (!entry.pending && time.Now().After(entry.expires)) {
+		s.lookup(addr, ip)
+	}
+	if entry.name == "" {
+		return ip
+	}
+	return entry.name
+}
+
+func (s *SourceLabeler) lookup(addr netip.Addr, ip string) {
+	s.mutex.Lock()
+	entry, ok := s.hostnames[addr]
+	if ok && (entry.pending || time.Now().Before(entry.expires)) {
+		// Another reader got here first.
+		s.mutex.Unlock()
+		return
+	}
+	if !ok && len(s.hostnames) >= maxHostnames {
+		s.hostnames = make(map[netip.Addr]hostnameEntry)
+	}
+	entry.pending = true
+	s.hostnames[addr] = entry
+	s.mutex.Unlock()
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), hostnameLookupTimeout)
+		defer cancel()
+
+		name := ip
+		names, err := net.DefaultResolver.LookupAddr(ctx, ip)
+		if err != nil || len(names) == 0 {
+			reverseLookups.WithLabelValues("failure").Inc()
+			glog.V(10).Infof("Reverse lookup of %s failed: %v", ip, err)
+		} else {
+			reverseLookups.WithLabelValues("success").Inc()
+			name = strings.TrimSuffix(names[0], ".")
+		}
+
+		s.mutex.Lock()
+		s.hostnames[addr] = hostnameEntry{name: name, expires: time.Now().Add(s.config.HostnameTTL)}
+		s.mutex.Unlock()
+	}()
+}
+
+// packetCounter returns the packet counter of the client at addr, shared by
+// the readers of listener.
+func (s *SourceLabeler) packetCounter(listener string, addr netip.Addr, ip string) *sourceCounter {
+	s.packetsMutex.Lock()
+	defer s.packetsMutex.Unlock()
+
+	key := sourceKey{listener: listener, addr: addr}
+	c, ok := s.packets[key]
+	if !ok {
+		s.makeRoom(time.Now())
+		c = &sourceCounter{counter: sourcePackets.WithLabelValues(listener, ip)}
+		s.packets[key] = c
+	}
+	return c
+}
+
+// makeRoom deletes the series of idle clients once maxSourceSeries are
+// counted. Called with packetsMutex held.
+func (s *SourceLabeler) makeRoom(now time.Time) {
+	if len(s.packets) < maxSourceSeries {
+		return
+	}
+	idle := now.Add(-sourceSeriesIdle).UnixNano()
+	for key, c := range s.packets {
+		if atomic.LoadInt64(&c.last) < idle {
+			s.deletePackets(key, c)
+		}
+	}
+	if len(s.packets) >= maxSourceSeries {
+		for key, c := range s.packets {
+			s.deletePackets(key, c)
+		}
+	}
+}
+
+func (s *SourceLabeler) deletePackets(key sourceKey, c *sourceCounter) {
+	atomic.StoreInt32(&c.deleted, 1)
+	sourcePackets.DeleteLabelValues(key.listener, key.addr.String())
+	delete(s.packets, key)
+}
+
+// client holds what a parser derived from a client address.
+type client struct {
+	ip      string
+	packets *sourceCounter
+}
+
+// setSource records addr as the sender of the lines parsed next, updating
+// the source labels attached to their events.
+func (p *parser) setSource(addr netip.Addr) {
+	if p.sources == nil {
+		return
+	}
+	addr = addr.Unmap()
+
+	c, ok := p.clients[addr]
+	if !ok {
+		if len(p.clients) >= maxInternedStrings {
+			p.clients = make(map[netip.Addr]*client)
+		}
+		c = &client{ip: addr.String()}
+		p.clients[addr] = c
+	}
+
+	if p.sources.config.Telemetry {
+		// The series may have been deleted to make room since the client
+		// was last seen.
+		if c.packets == nil || atomic.LoadInt32(&c.packets.deleted) != 0 {
+			c.packets = p.sources.packetCounter(p.listener, addr, c.ip)
+		}
+		c.packets.inc(time.Now())
+	}
+	if name := p.sources.config.IPLabel; name != "" {
+		p.sourceLabels[name] = c.ip
+	}
+	if name := p.sources.config.HostnameLabel; name != "" {
+		p.sourceLabels[name] = p.sources.hostname(addr, c.ip)
+	}
+}
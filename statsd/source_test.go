@@ -0,0 +1,124 @@
+package statsd
+
+import (
+	"net/netip"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jvosantos/statsd_exporter/metrics"
+)
+
+func TestSourceLabels(t *testing.T) {
+	scenarios := []struct {
+		name   string
+		config SourceConfig
+		source string
+		line   string
+		labels metrics.Labels
+	}{
+		{
+			name:   "no source labels",
+			source: "10.0.0.1",
+			line:   "foo:1|c|#env:prod",
+			labels: metrics.Labels{"env": "prod"},
+		},
+		{
+			name:   "listener and ip",
+			config: SourceConfig{ListenerLabel: "listener", IPLabel: "source_ip"},
+			source: "10.0.0.1",
+			line:   "foo:1|c",
+			labels: metrics.Labels{"listener": "udp", "source_ip": "10.0.0.1"},
+		},
+		{
+			name:   "ipv4 mapped ipv6 address",
+			config: SourceConfig{IPLabel: "source_ip"},
+			source: "::ffff:10.0.0.1",
+			line:   "foo:1|c",
+			labels: metrics.Labels{"source_ip": "10.0.0.1"},
+		},
+		{
+			name:   "spoofed tag",
+			config: SourceConfig{IPLabel: "source_ip"},
+			source: "10.0.0.1",
+			line:   "foo:1|c|#source_ip:10.0.0.2,env:prod",
+			labels: metrics.Labels{"source_ip": "10.0.0.1", "env": "prod"},
+		},
+		{
+			// The name is looked up in the background; until then the
+			// label holds the address.
+			name:   "hostname before lookup",
+			config: SourceConfig{HostnameLabel: "source_host", HostnameTTL: time.Minute},
+			source: "192.0.2.1",
+			line:   "foo:1|c",
+			labels: metrics.Labels{"source_host": "192.0.2.1"},
+		},
+	}
+
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			sources, err := NewSourceLabeler(s.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			p := newParser("udp", sources)
+			p.setSource(netip.MustParseAddr(s.source))
+			events := p.lineToEvents([]byte(s.line), nil)
+			if len(events) != 1 {
+				t.Fatalf("expected one event, got %d", len(events))
+			}
+			if labels := events[0].Labels(); !reflect.DeepEqual(labels, s.labels) {
+				t.Fatalf("expected labels %v, got %v", s.labels, labels)
+			}
+		})
+	}
+}
+
+func TestSourceLabelNames(t *testing.T) {
+	scenarios := []struct {
+		config SourceConfig
+		valid  bool
+	}{
+		{config: SourceConfig{}, valid: true},
+		{config: SourceConfig{ListenerLabel: "listener", IPLabel: "source_ip", HostnameLabel: "_host"}, valid: true},
+		{config: SourceConfig{IPLabel: "source-ip"}},
+		{config: SourceConfig{HostnameLabel: "1host"}},
+	}
+
+	for _, s := range scenarios {
+		if _, err := NewSourceLabeler(s.config); (err == nil) != s.valid {
+			t.Errorf("%+v: unexpected error %v", s.config, err)
+		}
+	}
+}
+
+// TestSourcePacketsEviction checks that the packet series of idle clients
+// are deleted to make room for new ones, and that parsers still holding a
+// deleted series count into a new one.
+func TestSourcePacketsEviction(t *testing.T) {
+	sources, err := NewSourceLabeler(SourceConfig{Telemetry: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, idle := newParser("udp", sources), newParser("udp", sources)
+	first := netip.MustParseAddr("10.0.0.1")
+	idle.setSource(first)
+	evicted := sources.packets[sourceKey{"udp", first}]
+	atomic.StoreInt64(&evicted.last, 0)
+
+	for i := 0; i < maxSourceSeries; i++ {
+		p.setSource(netip.AddrFrom4([4]byte{11, byte(i >> 16), byte(i >> 8), byte(i)}))
+	}
+	if atomic.LoadInt32(&evicted.deleted) != 1 {
+		t.Fatal("expected the series of the idle client to be deleted")
+	}
+	if len(sources.packets) != maxSourceSeries {
+		t.Fatalf("expected %d series, got %d", maxSourceSeries, len(sources.packets))
+	}
+
+	idle.setSource(first)
+	if c := idle.clients[first].packets; c == evicted || sources.packets[sourceKey{"udp", first}] != c {
+		t.Fatal("expected the client to count into a new series")
+	}
+}
@@ -4,243 +4,424 @@ import (
 	"net"
 	"github.com/golang/glog"
 	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"io"
-	"strings"
+	"net/netip"
 	"strconv"
-	"unicode/utf8"
+	"sync"
+	"time"
 	"github.com/jvosantos/statsd_exporter/metrics"
 )
 
+// Listener receives StatsD lines and sends the parsed events to a channel.
 type Listener interface {
-	Listen(chan<- metrics.Events)
-	Close()
+	// Listen serves until ctx is cancelled, in which case it returns nil, or
+	// until receiving fails, in which case the error is returned. No events
+	// are queued after Listen has returned.
+	Listen(ctx context.Context, q *EventQueue) error
+	Close() error
 }
 
 type TCPListener struct {
-	conn *net.TCPListener
+	conn   *net.TCPListener
+	config TCPConfig
+	slots  chan struct{}
 }
 
+// TCPConfig holds the limits applied to the TCP listener and to every
+// connection it accepts. Zero values disable the corresponding limit.
+type TCPConfig struct {
+	// Name identifies the listener in source labels and telemetry.
+	Name string
+	// Sources attaches source labels to events, if not nil.
+	Sources *SourceLabeler
+	// Limiter drops lines exceeding its rate limits, if not nil.
+	Limiter *RateLimiter
+	// MaxConnections is the maximum number of concurrently open connections.
+	// Connections accepted above this limit are closed immediately.
+	MaxConnections int
+	// IdleTimeout is the maximum time to wait for the first byte of a line.
+	IdleTimeout time.Duration
+	// ReadTimeout is the maximum time to receive a line once it has started.
+	ReadTimeout time.Duration
+	// MaxLineLength is the size of the longest accepted line, in bytes.
+	MaxLineLength int
+	// KeepAlive enables TCP keepalive probes on accepted connections.
+	KeepAlive bool
+	// KeepAlivePeriod is the interval between keepalive probes. Zero keeps
+	// the operating system default.
+	KeepAlivePeriod time.Duration
+}
+
+var (
+	errIdleTimeout = errors.New("idle timeout")
+	errReadTimeout = errors.New("read timeout")
+	errLineTooLong = errors.New("line too long")
+)
+
 type UDPListener struct {
-	conn *net.UDPConn
+	conns  []*net.UDPConn
+	config UDPConfig
+	// inodes are the inodes of the sockets of conns, saved as they can't
+	// be looked up any more once the sockets are closed.
+	inodes []uint64
 }
 
-func NewStatsDTCPListener(address string) *TCPListener {
-	tcpListenAddr := tcpAddrFromString(address)
+// UDPConfig controls how many sockets and goroutines receive UDP packets.
+type UDPConfig struct {
+	// Name identifies the listener in source labels and telemetry.
+	Name string
+	// Sources attaches source labels to events, if not nil.
+	Sources *SourceLabeler
+	// Limiter drops lines exceeding its rate limits, if not nil.
+	Limiter *RateLimiter
+	// ReadBuffer is the size of the kernel receive buffer of every socket.
+	// Zero keeps the operating system default.
+	ReadBuffer int
+	// Readers is the number of goroutines reading and parsing packets.
+	Readers int
+	// ReusePort opens one SO_REUSEPORT socket per reader, letting the kernel
+	// spread packets across them. Otherwise all readers share one socket.
+	ReusePort bool
+	// BatchSize is the number of packets received per system call on
+	// platforms supporting recvmmsg. Values below 2 read one packet at a time.
+	BatchSize int
+}
+
+func NewStatsDTCPListener(address string, config TCPConfig) (*TCPListener, error) {
+	tcpListenAddr, err := tcpAddrFromString(address)
+	if err != nil {
+		return nil, err
+	}
 	tcpConn, err := net.ListenTCP("tcp", tcpListenAddr)
 	if err != nil {
-		glog.Fatal(err)
+		return nil, err
+	}
+
+	if config.Name == "" {
+		config.Name = "tcp"
+	}
+	if config.MaxLineLength <= 0 {
+		config.MaxLineLength = bufio.MaxScanTokenSize
+	}
+
+	l := &TCPListener{conn: tcpConn, config: config}
+	if config.MaxConnections > 0 {
+		l.slots = make(chan struct{}, config.MaxConnections)
 	}
 
-	return &TCPListener{conn: tcpConn}
+	return l, nil
 }
 
-func (l *TCPListener) Listen(e chan<- metrics.Events) {
+func (l *TCPListener) Listen(ctx context.Context, q *EventQueue) error {
+	// Open connections are closed and waited for whenever Listen returns.
+	var conns sync.WaitGroup
+	ctx, cancel := context.WithCancel(ctx)
+	defer conns.Wait()
+	defer cancel()
+
+	stop := closeOnDone(ctx, l.conn)
+	defer stop()
+
 	for {
 		c, err := l.conn.AcceptTCP()
 		if err != nil {
-			glog.Fatalf("AcceptTCP failed: %v", err)
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("AcceptTCP failed: %v", err)
 		}
-		go l.handleConn(c, e)
+		if !l.acquire() {
+			tcpConnectionsRejected.WithLabelValues("max_connections").Inc()
+			glog.V(10).Infof("Rejected %s: %d connections already open", c.RemoteAddr(), l.config.MaxConnections)
+			c.Close()
+			continue
+		}
+		conns.Add(1)
+		go func() {
+			defer conns.Done()
+			l.handleConn(ctx, c, q)
+		}()
+	}
+}
+
+// acquire reserves a connection slot, reporting false when the listener is
+// already handling MaxConnections connections.
+func (l *TCPListener) acquire() bool {
+	if l.slots == nil {
+		return true
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (l *TCPListener) release() {
+	if l.slots != nil {
+		<-l.slots
 	}
 }
 
-func (l *TCPListener) Close() {
-	l.conn.Close()
+func (l *TCPListener) Close() error {
+	return l.conn.Close()
 }
 
-func NewStatsDUDPListener(address string, readBuffer int) *UDPListener {
-	udpListenAddr := udpAddrFromString(address)
-	udpConn, err := net.ListenUDP("udp", udpListenAddr)
+func NewStatsDUDPListener(address string, config UDPConfig) (*UDPListener, error) {
+	udpListenAddr, err := udpAddrFromString(address)
 	if err != nil {
-		glog.Fatal(err)
+		return nil, err
 	}
 
-	if readBuffer != 0 {
-		err = udpConn.SetReadBuffer(readBuffer)
+	if config.Name == "" {
+		config.Name = "udp"
+	}
+	if config.Readers < 1 {
+		config.Readers = 1
+	}
+	sockets := 1
+	if config.ReusePort {
+		sockets = config.Readers
+	}
+
+	l := &UDPListener{config: config}
+	for i := 0; i < sockets; i++ {
+		udpConn, err := listenUDP(udpListenAddr, config.ReusePort)
 		if err != nil {
-			glog.Fatal("Error setting UDP read buffer:", err)
+			l.Close()
+			return nil, err
+		}
+		l.conns = append(l.conns, udpConn)
+
+		if config.ReadBuffer != 0 {
+			err = udpConn.SetReadBuffer(config.ReadBuffer)
+			if err != nil {
+				l.Close()
+				return nil, fmt.Errorf("error setting UDP read buffer: %v", err)
+			}
 		}
+
+		// Bind the remaining sockets to the port picked for the first one.
+		udpListenAddr = udpConn.LocalAddr().(*net.UDPAddr)
 	}
 
-	return &UDPListener{conn: udpConn}
+	l.inodes = trackUDPSockets(address, l.conns)
+	return l, nil
 }
 
-func (l *UDPListener) Listen(e chan<- metrics.Events) {
-	buf := make([]byte, 65535)
-	for {
-		n, _, err := l.conn.ReadFromUDP(buf)
-		if err != nil {
-			glog.Fatal(err)
-		}
-		l.handlePacket(buf[0:n], e)
+func listenUDP(addr *net.UDPAddr, reusePort bool) (*net.UDPConn, error) {
+	if !reusePort {
+		return net.ListenUDP("udp", addr)
 	}
-}
 
-func (l *UDPListener) Close() {
-	// do nothing as there is nothing to close
+	lc := net.ListenConfig{Control: setReusePort}
+	conn, err := lc.ListenPacket(context.Background(), "udp", addr.String())
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
 }
 
-func (l *TCPListener) handleConn(c *net.TCPConn, e chan<- metrics.Events) {
-	defer c.Close()
+func (l *UDPListener) Listen(ctx context.Context, q *EventQueue) error {
+	// The first reader to fail stops all the others.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	for _, conn := range l.conns {
+		stop := closeOnDone(ctx, conn)
+		defer stop()
+	}
+
+	errs := make(chan error, l.config.Readers)
+	var readers sync.WaitGroup
+	for i := 0; i < l.config.Readers; i++ {
+		conn := l.conns[i%len(l.conns)]
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			if err := l.read(ctx, conn, q); err != nil {
+				errs <- err
+				cancel()
+			}
+		}()
+	}
+	readers.Wait()
+	close(errs)
 
-	//tcpConnections.Inc() // self metric
+	return <-errs
+}
 
-	r := bufio.NewReader(c)
+// readPackets receives one packet per system call until ctx is done.
+func (l *UDPListener) readPackets(ctx context.Context, conn *net.UDPConn, q *EventQueue) error {
+	p := newParser(l.config.Name, l.config.Sources)
+	buf := make([]byte, 65535)
 	for {
-		line, isPrefix, err := r.ReadLine()
+		n, addr, err := conn.ReadFromUDPAddrPort(buf)
 		if err != nil {
-			if err != io.EOF {
-				//tcpErrors.Inc() // self metric
-				glog.V(10).Infof("Read %s failed: %v", c.RemoteAddr(), err)
+			if ctx.Err() != nil {
+				return nil
 			}
-			break
-		}
-		if isPrefix {
-			//tcpLineTooLong.Inc() // self metric
-			glog.V(10).Infof("Read %s failed: line too long", c.RemoteAddr())
-			break
+			return fmt.Errorf("ReadFromUDP failed: %v", err)
 		}
-		//linesReceived.Inc() // self metric
-		e <- lineToEvents(string(line))
+		l.handlePacket(ctx, p, addr.Addr(), buf[0:n], q)
 	}
 }
 
-func (l *UDPListener) handlePacket(packet []byte, e chan<- metrics.Events) {
-	//udpPackets.Inc() // self metric
-	lines := strings.Split(string(packet), "\n")
-	events := metrics.Events{}
-	for _, line := range lines {
-		//linesReceived.Inc() // self metric
-		events = append(events, lineToEvents(line)...)
+func (l *UDPListener) Close() error {
+	untrackUDPSockets(l.inodes)
+
+	var err error
+	for _, conn := range l.conns {
+		if cerr := conn.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
 	}
-	e <- events
+	return err
 }
 
-func lineToEvents(line string) metrics.Events {
-	glog.V(100).Infoln(line)
-
-	events := metrics.Events{}
-	if line == "" {
-		return events
-	}
-
-	elements := strings.SplitN(line, ":", 2)
-	if len(elements) < 2 || len(elements[0]) == 0 || !utf8.ValidString(line) {
-		//sampleErrors.WithLabelValues("malformed_line").Inc() // self metric
-		glog.V(10).Infoln("Bad line from StatsD:", line)
-		return events
-	}
-	metric := elements[0]
-	var samples []string
-	if strings.Contains(elements[1], "|#") {
-		// using datadog extensions, disable multi-metrics
-		samples = elements[1:]
-	} else {
-		samples = strings.Split(elements[1], ":")
-	}
-samples:
-	for _, sample := range samples {
-		//samplesReceived.Inc() // self metric
-		components := strings.Split(sample, "|")
-		samplingFactor := 1.0
-		if len(components) < 2 || len(components) > 4 {
-			//sampleErrors.WithLabelValues("malformed_component").Inc()
-			glog.V(10).Infoln("Bad component on line:", line)
-			continue
+// closeOnDone closes c once ctx is done, unblocking any pending accept or
+// read on it. The returned function stops watching ctx.
+func closeOnDone(ctx context.Context, c io.Closer) func() {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Close()
+		case <-done:
 		}
-		valueStr, statType := components[0], components[1]
+	}()
+	return func() { close(done) }
+}
 
-		var relative = false
-		if strings.Index(valueStr, "+") == 0 || strings.Index(valueStr, "-") == 0 {
-			relative = true
-		}
+func (l *TCPListener) handleConn(ctx context.Context, c *net.TCPConn, q *EventQueue) {
+	defer l.release()
+	defer c.Close()
 
-		value, err := strconv.ParseFloat(valueStr, 64)
-		if err != nil {
-			glog.V(10).Infof("Bad value %s on line: %s", valueStr, line)
-			//sampleErrors.WithLabelValues("malformed_value").Inc()  // self metric
-			continue
-		}
+	stop := closeOnDone(ctx, c)
+	defer stop()
 
-		multiplyEvents := 1
-		labels := map[string]string{}
-		if len(components) >= 3 {
-			for _, component := range components[2:] {
-				if len(component) == 0 {
-					glog.V(10).Infoln("Empty component on line: ", line)
-					//sampleErrors.WithLabelValues("malformed_component").Inc() // self metric
-					continue samples
-				}
-			}
+	tcpConnections.Inc()
+	tcpConnectionsActive.Inc()
+	defer tcpConnectionsActive.Dec()
 
-			for _, component := range components[2:] {
-				switch component[0] {
-				case '@':
-					if statType != "c" && statType != "ms" {
-						glog.V(10).Infoln("Illegal sampling factor for non-counter metric on line", line)
-						//sampleErrors.WithLabelValues("illegal_sample_factor").Inc() // self metric
-						continue
-					}
-					samplingFactor, err = strconv.ParseFloat(component[1:], 64)
-					if err != nil {
-						glog.V(10).Infof("Invalid sampling factor %s on line %s", component[1:], line)
-						//sampleErrors.WithLabelValues("invalid_sample_factor").Inc() // self metric
-					}
-					if samplingFactor == 0 {
-						samplingFactor = 1
-					}
-
-					if statType == "c" {
-						value /= samplingFactor
-					} else if statType == "ms" {
-						multiplyEvents = int(1 / samplingFactor)
-					}
-				case '#':
-					labels = parseDogStatsDTagsToLabels(component)
-				default:
-					glog.V(10).Infof("Invalid sampling factor or tag section %s on line %s", components[2], line)
-					//sampleErrors.WithLabelValues("invalid_sample_factor").Inc() // self metric
-					continue
-				}
-			}
+	if err := c.SetKeepAlive(l.config.KeepAlive); err != nil {
+		glog.V(10).Infof("Setting keepalive on %s failed: %v", c.RemoteAddr(), err)
+	}
+	if l.config.KeepAlive && l.config.KeepAlivePeriod > 0 {
+		if err := c.SetKeepAlivePeriod(l.config.KeepAlivePeriod); err != nil {
+			glog.V(10).Infof("Setting keepalive period on %s failed: %v", c.RemoteAddr(), err)
 		}
+	}
 
-		for i := 0; i < multiplyEvents; i++ {
-			event, err := metrics.NewEvent(statType, metric, value, relative, labels)
-			if err != nil {
-				glog.V(10).Infof("Error building event on line %s: %s", line, err)
-				//sampleErrors.WithLabelValues("illegal_event").Inc() // self metric
-				continue
+	p := newParser(l.config.Name, l.config.Sources)
+	source := c.RemoteAddr().(*net.TCPAddr).AddrPort().Addr()
+	r := bufio.NewReaderSize(c, l.config.MaxLineLength)
+	for {
+		line, err := l.readLine(c, r)
+		if len(line) > 0 {
+			linesReceived.Inc()
+			if l.config.Limiter.allowPacket(l.config.Name, source) && l.config.Limiter.allowLine(l.config.Name, source, line) {
+				p.setSource(source)
+				q.send(ctx, p.lineToEvents(line, metrics.NewEvents()))
 			}
-			events = append(events, event)
+		}
+		if err != nil {
+			switch {
+			case ctx.Err() != nil:
+				tcpConnectionsClosed.WithLabelValues("shutdown").Inc()
+			case err == io.EOF:
+				tcpConnectionsClosed.WithLabelValues("eof").Inc()
+			case err == errIdleTimeout:
+				tcpConnectionsClosed.WithLabelValues("idle_timeout").Inc()
+				glog.V(10).Infof("Closing %s: %v", c.RemoteAddr(), err)
+			case err == errReadTimeout:
+				tcpConnectionsClosed.WithLabelValues("read_timeout").Inc()
+				glog.V(10).Infof("Closing %s: %v", c.RemoteAddr(), err)
+			case err == errLineTooLong:
+				tcpLineTooLong.Inc()
+				tcpConnectionsClosed.WithLabelValues("line_too_long").Inc()
+				glog.V(10).Infof("Read %s failed: line longer than %d bytes", c.RemoteAddr(), l.config.MaxLineLength)
+			default:
+				tcpErrors.Inc()
+				tcpConnectionsClosed.WithLabelValues("error").Inc()
+				glog.V(10).Infof("Read %s failed: %v", c.RemoteAddr(), err)
+			}
+			return
 		}
 	}
-	return events
 }
 
-func parseDogStatsDTagsToLabels(component string) map[string]string {
-	labels := map[string]string{}
-	//tagsReceived.Inc() // self metric
-	tags := strings.Split(component, ",")
-	for _, t := range tags {
-		t = strings.TrimPrefix(t, "#")
-		kv := strings.SplitN(t, ":", 2)
-
-		if len(kv) < 2 || len(kv[1]) == 0 {
-			//tagErrors.Inc() // self metric
-			glog.V(10).Infof("Malformed or empty DogStatsD tag %s in component %s", t, component)
-			continue
+// readLine reads the next line from the connection, without its line
+// terminator. The idle timeout applies while waiting for the line to start
+// and the read timeout while waiting for it to complete. A final line that is
+// not newline terminated is returned together with io.EOF.
+func (l *TCPListener) readLine(c *net.TCPConn, r *bufio.Reader) ([]byte, error) {
+	c.SetReadDeadline(deadline(l.config.IdleTimeout))
+	if _, err := r.Peek(1); err != nil {
+		if isTimeout(err) {
+			return nil, errIdleTimeout
 		}
+		return nil, err
+	}
 
-		labels[metrics.EscapeMetricName(kv[0])] = kv[1]
+	c.SetReadDeadline(deadline(l.config.ReadTimeout))
+	line, err := r.ReadSlice('\n')
+	switch {
+	case err == bufio.ErrBufferFull:
+		return nil, errLineTooLong
+	case isTimeout(err):
+		return nil, errReadTimeout
 	}
-	return labels
+
+	return bytes.TrimRight(line, "\r\n"), err
+}
+
+func deadline(timeout time.Duration) time.Time {
+	if timeout <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(timeout)
+}
+
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
+func (l *UDPListener) handlePacket(ctx context.Context, p *parser, source netip.Addr, packet []byte, q *EventQueue) {
+	udpPackets.Inc()
+	if !l.config.Limiter.allowPacket(l.config.Name, source) {
+		return
+	}
+	p.setSource(source)
+	events := metrics.NewEvents()
+	for {
+		line := packet
+		i := bytes.IndexByte(packet, '\n')
+		if i >= 0 {
+			line = packet[:i]
+		}
+		linesReceived.Inc()
+		if l.config.Limiter.allowLine(l.config.Name, source, line) {
+			events = p.lineToEvents(line, events)
+		}
+		if i < 0 {
+			break
+		}
+		packet = packet[i+1:]
+	}
+	q.send(ctx, events)
 }
 
-func ipPortFromString(addr string) (*net.IPAddr, int) {
+func ipPortFromString(addr string) (*net.IPAddr, int, error) {
 	host, portStr, err := net.SplitHostPort(addr)
 	if err != nil {
-		glog.Fatal("Bad StatsD listening address", addr)
+		return nil, 0, fmt.Errorf("bad StatsD listening address %s: %v", addr, err)
 	}
 
 	if host == "" {
@@ -248,31 +429,40 @@ func ipPortFromString(addr string) (*net.IPAddr, int) {
 	}
 	ip, err := net.ResolveIPAddr("ip", host)
 	if err != nil {
-		glog.Fatalf("Unable to resolve %s: %s", host, err)
+		return nil, 0, fmt.Errorf("unable to resolve %s: %v", host, err)
 	}
 
 	port, err := strconv.Atoi(portStr)
-	if err != nil || port < 0 || port > 65535 {
-		glog.Fatalf("Bad port %s: %s", portStr, err)
+	if err != nil {
+		return nil, 0, fmt.Errorf("bad port %s: %v", portStr, err)
+	}
+	if port < 0 || port > 65535 {
+		return nil, 0, fmt.Errorf("bad port %s: out of range", portStr)
 	}
 
-	return ip, port
+	return ip, port, nil
 }
 
-func udpAddrFromString(addr string) *net.UDPAddr {
-	ip, port := ipPortFromString(addr)
+func udpAddrFromString(addr string) (*net.UDPAddr, error) {
+	ip, port, err := ipPortFromString(addr)
+	if err != nil {
+		return nil, err
+	}
 	return &net.UDPAddr{
 		IP:   ip.IP,
 		Port: port,
 		Zone: ip.Zone,
-	}
+	}, nil
 }
 
-func tcpAddrFromString(addr string) *net.TCPAddr {
-	ip, port := ipPortFromString(addr)
+func tcpAddrFromString(addr string) (*net.TCPAddr, error) {
+	ip, port, err := ipPortFromString(addr)
+	if err != nil {
+		return nil, err
+	}
 	return &net.TCPAddr{
 		IP:   ip.IP,
 		Port: port,
 		Zone: ip.Zone,
-	}
-}
\ No newline at end of file
+	}, nil
+}
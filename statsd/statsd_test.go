@@ -0,0 +1,248 @@
+package statsd
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// tcpConn returns both ends of a connection accepted by l.
+func tcpConn(t *testing.T, l *TCPListener) (*net.TCPConn, net.Conn) {
+	client, err := net.Dial("tcp", l.conn.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := l.conn.AcceptTCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server, client
+}
+
+func TestTCPReadLine(t *testing.T) {
+	scenarios := []struct {
+		name   string
+		config TCPConfig
+		input  string
+		// keepOpen leaves the client end open after writing the input.
+		keepOpen bool
+		lines    []string
+		err      error
+	}{
+		{
+			name:  "lines",
+			input: "foo:1|c\nbar:2|g\r\n",
+			lines: []string{"foo:1|c", "bar:2|g"},
+			err:   io.EOF,
+		},
+		{
+			name:  "unterminated last line",
+			input: "foo:1|c\nbar:2|g",
+			lines: []string{"foo:1|c", "bar:2|g"},
+			err:   io.EOF,
+		},
+		{
+			name:   "line too long",
+			config: TCPConfig{MaxLineLength: 16},
+			input:  "foo:1|c\nfoo.bar.baz.qux:1|c\n",
+			lines:  []string{"foo:1|c"},
+			err:    errLineTooLong,
+		},
+		{
+			name:     "idle timeout",
+			config:   TCPConfig{IdleTimeout: 50 * time.Millisecond},
+			input:    "foo:1|c\n",
+			keepOpen: true,
+			lines:    []string{"foo:1|c"},
+			err:      errIdleTimeout,
+		},
+		{
+			name:     "read timeout",
+			config:   TCPConfig{IdleTimeout: time.Minute, ReadTimeout: 50 * time.Millisecond},
+			input:    "foo:1|c\nbar:2",
+			keepOpen: true,
+			lines:    []string{"foo:1|c"},
+			err:      errReadTimeout,
+		},
+	}
+
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			l, err := NewStatsDTCPListener("127.0.0.1:0", s.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+			server, client := tcpConn(t, l)
+			defer server.Close()
+			defer client.Close()
+
+			if _, err := io.WriteString(client, s.input); err != nil {
+				t.Fatal(err)
+			}
+			if !s.keepOpen {
+				client.Close()
+			}
+
+			var lines []string
+			r := bufio.NewReaderSize(server, l.config.MaxLineLength)
+			for {
+				line, err := l.readLine(server, r)
+				if len(line) > 0 {
+					lines = append(lines, string(line))
+				}
+				if err != nil {
+					if err != s.err {
+						t.Fatalf("expected error %v, got %v", s.err, err)
+					}
+					break
+				}
+			}
+			if !reflect.DeepEqual(lines, s.lines) {
+				t.Fatalf("expected lines %q, got %q", s.lines, lines)
+			}
+		})
+	}
+}
+
+func TestTCPMaxConnections(t *testing.T) {
+	scenarios := []struct {
+		maxConnections int
+		accepted       int
+	}{
+		{maxConnections: 0, accepted: 5},
+		{maxConnections: 1, accepted: 1},
+		{maxConnections: 3, accepted: 3},
+	}
+
+	for _, s := range scenarios {
+		l, err := NewStatsDTCPListener("127.0.0.1:0", TCPConfig{MaxConnections: s.maxConnections})
+		if err != nil {
+			t.Fatal(err)
+		}
+		accepted := 0
+		for i := 0; i < 5; i++ {
+			if l.acquire() {
+				accepted++
+			}
+		}
+		if accepted != s.accepted {
+			t.Errorf("max connections %d: expected %d connections, got %d", s.maxConnections, s.accepted, accepted)
+		}
+		if s.maxConnections > 0 {
+			l.release()
+			if !l.acquire() {
+				t.Errorf("max connections %d: released slot not reused", s.maxConnections)
+			}
+		}
+		l.Close()
+	}
+}
+
+// TestListenerStop checks that listeners return nil when stopped through
+// their context, and an error when receiving fails.
+func TestListenerStop(t *testing.T) {
+	bindTCP := func() (Listener, error) { return NewStatsDTCPListener("127.0.0.1:0", TCPConfig{}) }
+	bindUDP := func() (Listener, error) { return NewStatsDUDPListener("127.0.0.1:0", UDPConfig{}) }
+	scenarios := []struct {
+		name string
+		bind func() (Listener, error)
+		// cancel stops the listener through its context rather than by
+		// closing it underneath.
+		cancel bool
+		fails  bool
+	}{
+		{name: "tcp cancelled", bind: bindTCP, cancel: true},
+		{name: "tcp closed", bind: bindTCP, fails: true},
+		{name: "udp cancelled", bind: bindUDP, cancel: true},
+		{name: "udp closed", bind: bindUDP, fails: true},
+	}
+
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			l, err := s.bind()
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			q, err := NewEventQueue(1, QueueBlock)
+			if err != nil {
+				t.Fatal(err)
+			}
+			done := make(chan error)
+			go func() { done <- l.Listen(ctx, q) }()
+
+			time.Sleep(10 * time.Millisecond)
+			if s.cancel {
+				cancel()
+			} else {
+				l.Close()
+			}
+			select {
+			case err := <-done:
+				if (err != nil) != s.fails {
+					t.Fatalf("unexpected error %v", err)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("listener didn't stop")
+			}
+			l.Close()
+		})
+	}
+}
+
+func TestUDPListener(t *testing.T) {
+	scenarios := []struct {
+		name   string
+		config UDPConfig
+	}{
+		{name: "one reader", config: UDPConfig{}},
+		{name: "shared socket", config: UDPConfig{Readers: 3}},
+		{name: "reuseport", config: UDPConfig{Readers: 3, ReusePort: true}},
+		{name: "batches", config: UDPConfig{Readers: 2, ReusePort: true, BatchSize: 8}},
+	}
+
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			l, err := NewStatsDUDPListener("127.0.0.1:0", s.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			q, err := NewEventQueue(100, QueueBlock)
+			if err != nil {
+				t.Fatal(err)
+			}
+			go l.Listen(ctx, q)
+
+			client, err := net.Dial("udp", l.conns[0].LocalAddr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+			const packets = 20
+			for i := 0; i < packets; i++ {
+				if _, err := io.WriteString(client, "foo:1|c\nbar:2|g"); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			received := 0
+			for received < 2*packets {
+				select {
+				case batch := <-q.Events():
+					received += len(batch)
+				case <-time.After(time.Second):
+					t.Fatalf("expected %d events, got %d", 2*packets, received)
+				}
+			}
+		})
+	}
+}
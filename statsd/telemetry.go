@@ -0,0 +1,151 @@
+// Copyright 2013 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statsd
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	udpPackets = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "statsd_exporter_udp_packets_total",
+			Help: "The total number of StatsD packets received over UDP.",
+		},
+	)
+	tcpConnections = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "statsd_exporter_tcp_connections_total",
+			Help: "The total number of TCP connections handled.",
+		},
+	)
+	tcpConnectionsActive = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "statsd_exporter_tcp_connections_active",
+			Help: "The current number of open TCP connections.",
+		},
+	)
+	tcpConnectionsRejected = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "statsd_exporter_tcp_connections_rejected_total",
+			Help: "The total number of TCP connections rejected on accept.",
+		},
+		[]string{"reason"},
+	)
+	tcpConnectionsClosed = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "statsd_exporter_tcp_connections_closed_total",
+			Help: "The total number of TCP connections closed by the exporter or the peer.",
+		},
+		[]string{"reason"},
+	)
+	tcpErrors = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "statsd_exporter_tcp_connection_errors_total",
+			Help: "The number of errors encountered reading from TCP.",
+		},
+	)
+	tcpLineTooLong = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "statsd_exporter_tcp_too_long_lines_total",
+			Help: "The number of lines discarded due to being too long.",
+		},
+	)
+	linesReceived = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "statsd_exporter_lines_total",
+			Help: "The total number of StatsD lines received.",
+		},
+	)
+	samplesReceived = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "statsd_exporter_samples_total",
+			Help: "The total number of StatsD samples received.",
+		},
+	)
+	sampleErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "statsd_exporter_sample_errors_total",
+			Help: "The total number of errors parsing StatsD samples.",
+		},
+		[]string{"reason"},
+	)
+	tagsReceived = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "statsd_exporter_tags_total",
+			Help: "The total number of DogStatsD tags processed.",
+		},
+	)
+	sourcePackets = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "statsd_exporter_source_packets_total",
+			Help: "The total number of UDP packets and TCP lines received, by listener and client address.",
+		},
+		[]string{"listener", "source"},
+	)
+	reverseLookups = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "statsd_exporter_source_reverse_lookups_total",
+			Help: "The total number of reverse DNS lookups of client addresses.",
+		},
+		[]string{"outcome"},
+	)
+	rateLimited = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "statsd_exporter_rate_limited_total",
+			Help: "The total number of UDP packets and lines dropped for exceeding a rate limit, by client address and limit.",
+		},
+		[]string{"listener", "source", "limit"},
+	)
+	queueDroppedBatches = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "statsd_exporter_event_queue_dropped_batches_total",
+			Help: "The total number of event batches dropped because the event queue was full.",
+		},
+		[]string{"policy"},
+	)
+	queueDroppedEvents = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "statsd_exporter_event_queue_dropped_events_total",
+			Help: "The total number of events dropped because the event queue was full.",
+		},
+		[]string{"policy"},
+	)
+	tagErrors = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "statsd_exporter_tag_errors_total",
+			Help: "The number of errors parsign DogStatsD tags.",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(udpPackets)
+	prometheus.MustRegister(tcpConnections)
+	prometheus.MustRegister(tcpConnectionsActive)
+	prometheus.MustRegister(tcpConnectionsRejected)
+	prometheus.MustRegister(tcpConnectionsClosed)
+	prometheus.MustRegister(tcpErrors)
+	prometheus.MustRegister(tcpLineTooLong)
+	prometheus.MustRegister(linesReceived)
+	prometheus.MustRegister(samplesReceived)
+	prometheus.MustRegister(sampleErrors)
+	prometheus.MustRegister(tagsReceived)
+	prometheus.MustRegister(tagErrors)
+	prometheus.MustRegister(sourcePackets)
+	prometheus.MustRegister(reverseLookups)
+	prometheus.MustRegister(rateLimited)
+	prometheus.MustRegister(queueDroppedBatches)
+	prometheus.MustRegister(queueDroppedEvents)
+}
@@ -0,0 +1,216 @@
+//go:build linux
+// +build linux
+
+package statsd
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"golang.org/x/sys/unix"
+)
+
+func setReusePort(network, address string, c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// batchConn is implemented by both ipv4.PacketConn and ipv6.PacketConn, whose
+// ReadBatch use recvmmsg on Linux.
+type batchConn interface {
+	ReadBatch(ms []ipv4.Message, flags int) (int, error)
+}
+
+// read receives up to BatchSize packets per system call until ctx is done.
+func (l *UDPListener) read(ctx context.Context, conn *net.UDPConn, q *EventQueue) error {
+	if l.config.BatchSize < 2 {
+		return l.readPackets(ctx, conn, q)
+	}
+
+	var bc batchConn
+	if conn.LocalAddr().(*net.UDPAddr).IP.To4() != nil {
+		bc = ipv4.NewPacketConn(conn)
+	} else {
+		bc = ipv6.NewPacketConn(conn)
+	}
+
+	p := newParser(l.config.Name, l.config.Sources)
+	msgs := make([]ipv4.Message, l.config.BatchSize)
+	for i := range msgs {
+		msgs[i].Buffers = [][]byte{make([]byte, 65535)}
+	}
+
+	for {
+		n, err := bc.ReadBatch(msgs, 0)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("ReadBatch failed: %v", err)
+		}
+		for _, msg := range msgs[:n] {
+			var source netip.Addr
+			if addr, ok := msg.Addr.(*net.UDPAddr); ok {
+				source = addr.AddrPort().Addr()
+			}
+			l.handlePacket(ctx, p, source, msg.Buffers[0][:msg.N], q)
+		}
+	}
+}
+
+// udpSocketCollector reports the kernel statistics found in /proc/net/udp and
+// /proc/net/udp6 for the sockets of the running UDP listeners.
+type udpSocketCollector struct {
+	mutex   sync.Mutex
+	sockets map[uint64]string // socket inode -> listen address
+
+	drops   *prometheus.Desc
+	rxQueue *prometheus.Desc
+}
+
+var udpSockets = &udpSocketCollector{
+	sockets: map[uint64]string{},
+	drops: prometheus.NewDesc(
+		"statsd_exporter_udp_socket_drops_total",
+		"The total number of UDP packets dropped by the kernel before the exporter could read them.",
+		[]string{"address"}, nil,
+	),
+	rxQueue: prometheus.NewDesc(
+		"statsd_exporter_udp_socket_receive_queue_bytes",
+		"The number of bytes queued in the kernel receive buffers of the UDP sockets.",
+		[]string{"address"}, nil,
+	),
+}
+
+func init() {
+	prometheus.MustRegister(udpSockets)
+}
+
+// trackUDPSockets adds the sockets of conns to the drop collector and
+// returns their inodes, which untrackUDPSockets removes them by once the
+// sockets are closed.
+func trackUDPSockets(address string, conns []*net.UDPConn) []uint64 {
+	udpSockets.mutex.Lock()
+	defer udpSockets.mutex.Unlock()
+
+	var inodes []uint64
+	for _, conn := range conns {
+		inode, err := socketInode(conn)
+		if err != nil {
+			glog.V(10).Infof("Unable to find socket inode for %s: %v", address, err)
+			continue
+		}
+		udpSockets.sockets[inode] = address
+		inodes = append(inodes, inode)
+	}
+	return inodes
+}
+
+func untrackUDPSockets(inodes []uint64) {
+	udpSockets.mutex.Lock()
+	defer udpSockets.mutex.Unlock()
+
+	for _, inode := range inodes {
+		delete(udpSockets.sockets, inode)
+	}
+}
+
+func socketInode(conn *net.UDPConn) (uint64, error) {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var stat unix.Stat_t
+	var statErr error
+	err = rc.Control(func(fd uintptr) {
+		statErr = unix.Fstat(int(fd), &stat)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return stat.Ino, statErr
+}
+
+func (c *udpSocketCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.drops
+	ch <- c.rxQueue
+}
+
+func (c *udpSocketCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if len(c.sockets) == 0 {
+		return
+	}
+
+	drops := map[string]float64{}
+	rxQueue := map[string]float64{}
+	for _, file := range []string{"/proc/net/udp", "/proc/net/udp6"} {
+		err := c.readProcNetUDP(file, drops, rxQueue)
+		if err != nil && !os.IsNotExist(err) {
+			glog.V(10).Infof("Reading %s failed: %v", file, err)
+		}
+	}
+
+	for address, value := range drops {
+		ch <- prometheus.MustNewConstMetric(c.drops, prometheus.CounterValue, value, address)
+		ch <- prometheus.MustNewConstMetric(c.rxQueue, prometheus.GaugeValue, rxQueue[address], address)
+	}
+}
+
+// readProcNetUDP adds up the drops and receive queue sizes of the tracked
+// sockets listed in file, keyed by listen address.
+func (c *udpSocketCollector) readProcNetUDP(file string, drops, rxQueue map[string]float64) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Scan() // header
+	for scanner.Scan() {
+		// sl local_address rem_address st tx_queue:rx_queue tr:tm->when retrnsmt uid timeout inode ref pointer drops
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 13 {
+			continue
+		}
+		inode, err := strconv.ParseUint(fields[9], 10, 64)
+		if err != nil {
+			continue
+		}
+		address, ok := c.sockets[inode]
+		if !ok {
+			continue
+		}
+
+		if queues := strings.SplitN(fields[4], ":", 2); len(queues) == 2 {
+			if rx, err := strconv.ParseUint(queues[1], 16, 64); err == nil {
+				rxQueue[address] += float64(rx)
+			}
+		}
+		if d, err := strconv.ParseUint(fields[12], 10, 64); err == nil {
+			drops[address] += float64(d)
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,34 @@
+package statsd
+
+import (
+	"testing"
+)
+
+func TestUDPSocketTracking(t *testing.T) {
+	scenarios := []UDPConfig{
+		{Readers: 1},
+		{Readers: 4},
+		{Readers: 4, ReusePort: true},
+	}
+
+	for _, config := range scenarios {
+		l, err := NewStatsDUDPListener("127.0.0.1:0", config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		udpSockets.mutex.Lock()
+		tracked := len(udpSockets.sockets)
+		udpSockets.mutex.Unlock()
+		if tracked != len(l.conns) {
+			t.Errorf("%+v: expected %d sockets tracked, got %d", config, len(l.conns), tracked)
+		}
+
+		l.Close()
+		udpSockets.mutex.Lock()
+		tracked = len(udpSockets.sockets)
+		udpSockets.mutex.Unlock()
+		if tracked != 0 {
+			t.Errorf("%+v: expected closed sockets untracked, got %d", config, tracked)
+		}
+	}
+}
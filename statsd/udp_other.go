@@ -0,0 +1,25 @@
+//go:build !linux
+// +build !linux
+
+package statsd
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+)
+
+func setReusePort(network, address string, c syscall.RawConn) error {
+	return errors.New("SO_REUSEPORT is only supported on Linux")
+}
+
+// read receives one packet per system call, as batched receives are only
+// implemented on Linux.
+func (l *UDPListener) read(ctx context.Context, conn *net.UDPConn, q *EventQueue) error {
+	return l.readPackets(ctx, conn, q)
+}
+
+func trackUDPSockets(address string, conns []*net.UDPConn) []uint64 { return nil }
+
+func untrackUDPSockets(inodes []uint64) {}
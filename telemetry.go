@@ -29,93 +29,93 @@ var (
 		Name: "statsd_exporter_events_unmapped_total",
 		Help: "The total number of StatsD events no mapping was found for.",
 	})
-	udpPackets = prometheus.NewCounter(
-		prometheus.CounterOpts{
-			Name: "statsd_exporter_udp_packets_total",
-			Help: "The total number of StatsD packets received over UDP.",
-		},
-	)
-	tcpConnections = prometheus.NewCounter(
-		prometheus.CounterOpts{
-			Name: "statsd_exporter_tcp_connections_total",
-			Help: "The total number of TCP connections handled.",
-		},
-	)
-	tcpErrors = prometheus.NewCounter(
+	configLoads = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
-			Name: "statsd_exporter_tcp_connection_errors_total",
-			Help: "The number of errors encountered reading from TCP.",
+			Name: "statsd_exporter_config_reloads_total",
+			Help: "The number of configuration reloads.",
 		},
+		[]string{"outcome"},
 	)
-	tcpLineTooLong = prometheus.NewCounter(
+	configLastReloadSuccessful = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "statsd_exporter_config_last_reload_successful",
+		Help: "Whether the last attempt to reload the mapping configuration succeeded.",
+	})
+	configLastReloadSuccess = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "statsd_exporter_config_last_reload_success_timestamp_seconds",
+		Help: "Unix time of the last successful load of the mapping configuration.",
+	})
+	mappingsCount = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "statsd_exporter_loaded_mappings",
+		Help: "The current number of configured metric mappings.",
+	})
+	conflictingEventStats = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
-			Name: "statsd_exporter_tcp_too_long_lines_total",
-			Help: "The number of lines discarded due to being too long.",
+			Name: "statsd_exporter_events_conflict_total",
+			Help: "The total number of StatsD events with conflicting names.",
 		},
+		[]string{"type"},
 	)
-	linesReceived = prometheus.NewCounter(
+	templateErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "statsd_exporter_events_template_errors_total",
+		Help: "The number of StatsD events dropped because the templates of their mapping failed.",
+	})
+	seriesExpired = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
-			Name: "statsd_exporter_lines_total",
-			Help: "The total number of StatsD lines received.",
+			Name: "statsd_exporter_series_expired_total",
+			Help: "The number of aggregated series removed for being idle longer than their TTL.",
 		},
+		[]string{"type"},
 	)
-	samplesReceived = prometheus.NewCounter(
+	seriesLimited = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
-			Name: "statsd_exporter_samples_total",
-			Help: "The total number of StatsD samples received.",
+			Name: "statsd_exporter_series_limited_total",
+			Help: "The number of StatsD events of new series beyond the max_series of their metric, by metric name and overflow policy.",
 		},
+		[]string{"metric", "policy"},
 	)
-	sampleErrors = prometheus.NewCounterVec(
+	snapshotWrites = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
-			Name: "statsd_exporter_sample_errors_total",
-			Help: "The total number of errors parsing StatsD samples.",
+			Name: "statsd_exporter_snapshot_writes_total",
+			Help: "The number of snapshots of the series state written, by outcome.",
 		},
-		[]string{"reason"},
+		[]string{"outcome"},
 	)
-	tagsReceived = prometheus.NewCounter(
-		prometheus.CounterOpts{
-			Name: "statsd_exporter_tags_total",
-			Help: "The total number of DogStatsD tags processed.",
-		},
+	snapshotLastSuccess = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "statsd_exporter_snapshot_last_success_timestamp_seconds",
+		Help: "Unix time of the last snapshot of the series state written successfully.",
+	})
+	activeSeriesDesc = prometheus.NewDesc(
+		"statsd_exporter_active_series",
+		"The number of aggregated series held in memory.",
+		[]string{"type"}, nil,
 	)
-	tagErrors = prometheus.NewCounter(
-		prometheus.CounterOpts{
-			Name: "statsd_exporter_tag_errors_total",
-			Help: "The number of errors parsign DogStatsD tags.",
-		},
+	mappingHitsDesc = prometheus.NewDesc(
+		"statsd_exporter_mapping_hits_total",
+		"The number of StatsD events matched by each mapping since the configuration was loaded.",
+		[]string{"index", "match", "source_file"}, nil,
 	)
-	configLoads = prometheus.NewCounterVec(
-		prometheus.CounterOpts{
-			Name: "statsd_exporter_config_reloads_total",
-			Help: "The number of configuration reloads.",
-		},
-		[]string{"outcome"},
+	unmappedHitsDesc = prometheus.NewDesc(
+		"statsd_exporter_unmapped_hits_total",
+		"The number of StatsD events no mapping matched since the configuration was loaded, by the first component of their name.",
+		[]string{"prefix"}, nil,
 	)
-	mappingsCount = prometheus.NewGauge(prometheus.GaugeOpts{
-		Name: "statsd_exporter_loaded_mappings",
-		Help: "The current number of configured metric mappings.",
-	})
-	conflictingEventStats = prometheus.NewCounterVec(
-		prometheus.CounterOpts{
-			Name: "statsd_exporter_events_conflict_total",
-			Help: "The total number of StatsD events with conflicting names.",
-		},
-		[]string{"type"},
+	mappingHitsSinceDesc = prometheus.NewDesc(
+		"statsd_exporter_mapping_hits_since_timestamp_seconds",
+		"Unix time the mapping hit counters were reset at by loading the configuration.",
+		nil, nil,
 	)
 )
 
 func init() {
 	prometheus.MustRegister(eventStats)
-	prometheus.MustRegister(udpPackets)
-	prometheus.MustRegister(tcpConnections)
-	prometheus.MustRegister(tcpErrors)
-	prometheus.MustRegister(tcpLineTooLong)
-	prometheus.MustRegister(linesReceived)
-	prometheus.MustRegister(samplesReceived)
-	prometheus.MustRegister(sampleErrors)
-	prometheus.MustRegister(tagsReceived)
-	prometheus.MustRegister(tagErrors)
 	prometheus.MustRegister(configLoads)
+	prometheus.MustRegister(configLastReloadSuccessful)
+	prometheus.MustRegister(configLastReloadSuccess)
 	prometheus.MustRegister(mappingsCount)
 	prometheus.MustRegister(conflictingEventStats)
+	prometheus.MustRegister(templateErrors)
+	prometheus.MustRegister(seriesExpired)
+	prometheus.MustRegister(seriesLimited)
+	prometheus.MustRegister(snapshotWrites)
+	prometheus.MustRegister(snapshotLastSuccess)
 }